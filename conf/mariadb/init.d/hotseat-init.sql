@@ -1,19 +1,48 @@
 GRANT ALL PRIVILEGES ON `hotseat`.* to 'hotseat'@'%' IDENTIFIED BY 'hotseat';
 
 DROP TABLE IF EXISTS `log`;
+-- audit log of changes: who changed which record when, with the values before and after
+-- (no foreign keys: the log remains when records are deleted)
 CREATE TABLE `log` (
+  `account_id` VARCHAR(40) DEFAULT NULL,
   `table` VARCHAR(40) NOT NULL,
   `id` VARCHAR(40) NOT NULL,
-  `timestamp` TIMESTAMP(6) DEFAULT now(),
+  `timestamp` TIMESTAMP(6) DEFAULT now(6),
   `change` VARCHAR(40) NOT NULL,
-  `details` VARCHAR(64) NOT NULL,
-  UNIQUE KEY `log_id` (`table`,`id`,`timestamp`)
+  `details` VARCHAR(64) DEFAULT NULL,
+  `session_id` VARCHAR(40) DEFAULT NULL,
+  `user_id` VARCHAR(40) DEFAULT NULL,
+  `username` VARCHAR(64) DEFAULT NULL,
+  `impersonator_user_id` VARCHAR(40) DEFAULT NULL,
+  `request_id` VARCHAR(64) DEFAULT NULL,
+  `before` TEXT DEFAULT NULL,
+  `after` TEXT DEFAULT NULL,
+  KEY `log_id` (`table`,`id`,`timestamp`),
+  KEY `log_account` (`account_id`,`timestamp`),
+  KEY `log_request` (`request_id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
 
+DROP TABLE IF EXISTS `events`;
+DROP TABLE IF EXISTS `user_roles`;
+DROP TABLE IF EXISTS `user_invitations`;
+DROP TABLE IF EXISTS `impersonation_log`;
+DROP TABLE IF EXISTS `login_lockouts`;
+DROP TABLE IF EXISTS `login_throttles`;
+DROP TABLE IF EXISTS `login_states`;
+DROP TABLE IF EXISTS `user_identities`;
+DROP TABLE IF EXISTS `identity_providers`;
+DROP TABLE IF EXISTS `api_keys`;
+DROP TABLE IF EXISTS `password_resets`;
+DROP TABLE IF EXISTS `user_recovery_codes`;
 DROP TABLE IF EXISTS `sessions`;
 DROP TABLE IF EXISTS `users`;
 DROP TABLE IF EXISTS `accounts`;
+DROP TABLE IF EXISTS `plans`;
+DROP TABLE IF EXISTS `consents`;
+DROP TABLE IF EXISTS `family_requests`;
+DROP TABLE IF EXISTS `person_erasures`;
 DROP TABLE IF EXISTS `person_nationalities`;
+DROP TABLE IF EXISTS `person_spouses`;
 DROP TABLE IF EXISTS `person_parents`;
 DROP TABLE IF EXISTS `persons`;
 
@@ -27,7 +56,9 @@ CREATE TABLE `persons` (
   `phone` VARCHAR(20) DEFAULT NULL,
   UNIQUE KEY `person_id` (`id`),
   UNIQUE KEY `person_profile` (`name`,`surname`,`gender`,`dob`),
-  KEY `person_name` (`name`,`surname`)
+  KEY `person_name` (`name`,`surname`),
+  KEY `person_dob` (`dob`),
+  FULLTEXT KEY `person_fulltext` (`name`,`surname`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
 
 INSERT INTO `persons` VALUES
@@ -72,65 +103,298 @@ INSERT INTO `person_parents` VALUES
   ((select id from persons where name="Anne-Marie" and surname="Semmelink"), (select id from persons where name="Stefan" and surname="Semmelink")),
   ((select id from persons where name="Anne-Marie" and surname="Semmelink"), (select id from persons where name="Anja" and surname="Semmelink"));
 
+-- spouses are stored once, in any order
+CREATE TABLE `person_spouses` (
+  `person_id_a` VARCHAR(40) NOT NULL,
+  `person_id_b` VARCHAR(40) NOT NULL,
+  UNIQUE KEY `person_spouse` (`person_id_a`,`person_id_b`),
+  KEY `person_spouse_b` (`person_id_b`),
+  FOREIGN KEY (`person_id_a`) REFERENCES persons(`id`),
+  FOREIGN KEY (`person_id_b`) REFERENCES persons(`id`),
+  CONSTRAINT `spouse_diff` CHECK((`person_id_a` <> `person_id_b`))
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+INSERT INTO `person_spouses` VALUES
+  ((select id from persons where name="Jan" and surname="Semmelink"), (select id from persons where name="Anne-Marie" and surname="Semmelink"));
+
+-- right to erasure requests: who asked and when, and who processed it
+-- (no foreign keys on users: the users of an erased person are anonymised, not deleted)
+CREATE TABLE `person_erasures` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `person_id` VARCHAR(40) NOT NULL,
+  `reason` TEXT NOT NULL,
+  `requested_by_user_id` VARCHAR(40) NOT NULL,
+  `time_requested` DATETIME NOT NULL,
+  `status` VARCHAR(10) NOT NULL DEFAULT 'requested',
+  `processed_by_user_id` VARCHAR(40) DEFAULT NULL,
+  `time_processed` DATETIME DEFAULT NULL,
+  `note` TEXT DEFAULT NULL,
+  UNIQUE KEY `person_erasure_id` (`id`),
+  KEY `person_erasure_status` (`status`,`time_requested`),
+  FOREIGN KEY (`person_id`) REFERENCES persons(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+-- guardian consent for minors to register, join a group or send messages, with the decision
+-- (no foreign keys on users or groups: the decision log remains when they are deleted)
+CREATE TABLE `consents` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `person_id` VARCHAR(40) NOT NULL,
+  `action` VARCHAR(20) NOT NULL,
+  `target_id` VARCHAR(40) DEFAULT NULL,
+  `requested_by_user_id` VARCHAR(40) NOT NULL,
+  `time_requested` DATETIME NOT NULL,
+  `guardian_person_id` VARCHAR(40) DEFAULT NULL,
+  `status` VARCHAR(10) NOT NULL DEFAULT 'pending',
+  `decided_by_user_id` VARCHAR(40) DEFAULT NULL,
+  `time_decided` DATETIME DEFAULT NULL,
+  `note` TEXT DEFAULT NULL,
+  UNIQUE KEY `consent_id` (`id`),
+  KEY `consent_person` (`person_id`,`action`,`time_requested`),
+  KEY `consent_guardian` (`guardian_person_id`,`status`),
+  FOREIGN KEY (`person_id`) REFERENCES persons(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+-- links to an existing person who has parents or a user wait for the person's user or a parent to approve,
+-- relation is how the person is related to the person who asked
+CREATE TABLE `family_requests` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `person_id` VARCHAR(40) NOT NULL,
+  `relation` VARCHAR(10) NOT NULL,
+  `requested_by_person_id` VARCHAR(40) NOT NULL,
+  `requested_by_user_id` VARCHAR(40) NOT NULL,
+  `time_requested` DATETIME NOT NULL,
+  `status` VARCHAR(10) NOT NULL DEFAULT 'pending',
+  `decided_by_user_id` VARCHAR(40) DEFAULT NULL,
+  `time_decided` DATETIME DEFAULT NULL,
+  UNIQUE KEY `family_request_id` (`id`),
+  KEY `family_request_person` (`person_id`,`status`),
+  FOREIGN KEY (`person_id`) REFERENCES persons(`id`),
+  FOREIGN KEY (`requested_by_person_id`) REFERENCES persons(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+-- account plans limit usage, NULL limits are unlimited
+CREATE TABLE `plans` (
+  `id` VARCHAR(40) DEFAULT (uuid()),
+  `name` VARCHAR(64) NOT NULL,
+  `max_users` INT DEFAULT NULL,
+  `max_groups` INT DEFAULT NULL,
+  `max_group_members` INT DEFAULT NULL,
+  `max_messages_per_day` INT DEFAULT NULL,
+  UNIQUE KEY `plan_id` (`id`),
+  UNIQUE KEY `plan_name` (`name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+INSERT INTO `plans` values
+  (uuid(), "free", 5, 3, 50, 100),
+  (uuid(), "standard", 50, 50, 500, 2000),
+  (uuid(), "premium", 500, 500, 5000, 20000);
+
 CREATE TABLE `accounts` (
   `id` VARCHAR(40) DEFAULT (uuid()),
   `name` VARCHAR(64) NOT NULL,
   `admin` boolean DEFAULT false,
   `active` boolean DEFAULT true,
   `expiry` DATETIME DEFAULT NULL,
+  `mfa_required` boolean DEFAULT false,
+  `time_deleted` DATETIME DEFAULT NULL,
+  `plan_id` VARCHAR(40) DEFAULT NULL,
   UNIQUE KEY `account_id` (`id`),
-  UNIQUE KEY `account_name` (`name`)
+  UNIQUE KEY `account_name` (`name`),
+  FOREIGN KEY (`plan_id`) REFERENCES plans(`id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
 
+-- system and public accounts have no plan, i.e. no limits
 INSERT INTO `accounts` values
-  (uuid(), "admin", true, true, NULL),
-  (uuid(), "public", false, true, NULL);
+  (uuid(), "admin", true, true, NULL, false, NULL, NULL),
+  (uuid(), "public", false, true, NULL, false, NULL, NULL);
 
 CREATE TABLE `users` (
   `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
   `account_id` VARCHAR(40) NOT NULL,
   `username` VARCHAR(64) NOT NULL,
-  `passhash` VARCHAR(40) NOT NULL,
+  `passhash` VARCHAR(100) NOT NULL,
   `admin` boolean DEFAULT false,
   `active` boolean DEFAULT true,
   `expiry` DATETIME DEFAULT NULL,
   `person_id` VARCHAR(40) DEFAULT NULL,
+  `must_change_password` boolean DEFAULT false,
+  `totp_secret` VARCHAR(64) DEFAULT NULL,
+  `totp_enabled` boolean DEFAULT false,
   UNIQUE KEY `user_id` (`id`),
   UNIQUE KEY `user_name` (`username`),
   FOREIGN KEY (`account_id`) REFERENCES accounts(`id`),
   FOREIGN KEY (`person_id`) REFERENCES persons(`id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
 
--- admin password is 
+-- admin password is "admin" (bcrypt), which must be changed on first login
 INSERT INTO `users` VALUES
-(uuid(),(select id from `accounts` where name='admin'),'admin','c2ed52119def9580a09f5edcc56a99d364d5928b',true,true,NULL,NULL);
+(uuid(),(select id from `accounts` where name='admin'),'admin','bcrypt$$2a$12$udVDwhBEPT3vdPXkIeZGmONzbO/eO.k2ksWHeeMrvJjWe2Jqplxj2',true,true,NULL,NULL,true,NULL,false);
 
 CREATE TABLE `sessions` (
+  `id` VARCHAR(40) DEFAULT(uuid()) NOT NULL,
   `token` VARCHAR(40) DEFAULT(uuid()) NOT NULL,
   `account_id` VARCHAR(40) NOT NULL,
   `user_id` VARCHAR(40) NOT NULL,
+  `scope` VARCHAR(20) NOT NULL DEFAULT '',
+  `user_agent` VARCHAR(255) NOT NULL DEFAULT '',
+  `remote_addr` VARCHAR(64) NOT NULL DEFAULT '',
+  `impersonator_user_id` VARCHAR(40) DEFAULT NULL,
   `time_created` TIMESTAMP(0) NOT NULL DEFAULT now(),
   `time_updated` TIMESTAMP(0) NOT NULL DEFAULT now(),
   FOREIGN KEY (`account_id`) REFERENCES accounts(`id`),
   FOREIGN KEY (`user_id`) REFERENCES users(`id`),
+  FOREIGN KEY (`impersonator_user_id`) REFERENCES users(`id`),
+  UNIQUE KEY `session_id` (`id`),
   UNIQUE KEY `session_token` (`token`),
-  UNIQUE KEY `session_user` (`account_id`,`user_id`)
+  KEY `session_user` (`user_id`,`time_updated`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+-- requests made by a sysadmin while impersonating a user
+-- (no foreign keys: the log remains when sessions and users are deleted)
+CREATE TABLE `impersonation_log` (
+  `session_id` VARCHAR(40) NOT NULL,
+  `impersonator_user_id` VARCHAR(40) NOT NULL,
+  `impersonator_username` VARCHAR(64) NOT NULL,
+  `user_id` VARCHAR(40) NOT NULL,
+  `username` VARCHAR(64) NOT NULL,
+  `method` VARCHAR(10) NOT NULL,
+  `path` VARCHAR(255) NOT NULL,
+  `status` INT NOT NULL,
+  `timestamp` DATETIME NOT NULL,
+  KEY `impersonation_user` (`user_id`,`timestamp`),
+  KEY `impersonation_time` (`timestamp`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+-- invited users are inactive until they accept with their own password
+CREATE TABLE `user_invitations` (
+  `id` VARCHAR(40) NOT NULL,
+  `account_id` VARCHAR(40) NOT NULL,
+  `user_id` VARCHAR(40) NOT NULL,
+  `invited_by_user_id` VARCHAR(40) NOT NULL,
+  `token_hash` VARCHAR(64) NOT NULL,
+  `time_created` DATETIME NOT NULL,
+  `time_sent` DATETIME NOT NULL,
+  `expiry` DATETIME NOT NULL,
+  `time_accepted` DATETIME DEFAULT NULL,
+  UNIQUE KEY `user_invitation_id` (`id`),
+  KEY `user_invitation_token` (`token_hash`),
+  KEY `account_invitations` (`account_id`,`time_sent`),
+  FOREIGN KEY (`account_id`) REFERENCES accounts(`id`),
+  FOREIGN KEY (`user_id`) REFERENCES users(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `user_recovery_codes` (
+  `user_id` VARCHAR(40) NOT NULL,
+  `code_hash` VARCHAR(64) NOT NULL,
+  `time_used` DATETIME DEFAULT NULL,
+  UNIQUE KEY `user_recovery_code` (`user_id`,`code_hash`),
+  FOREIGN KEY (`user_id`) REFERENCES users(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `password_resets` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `user_id` VARCHAR(40) NOT NULL,
+  `token_hash` VARCHAR(64) NOT NULL,
+  `time_created` DATETIME NOT NULL,
+  `expiry` DATETIME NOT NULL,
+  `time_used` DATETIME DEFAULT NULL,
+  UNIQUE KEY `password_reset_id` (`id`),
+  UNIQUE KEY `password_reset_token` (`token_hash`),
+  FOREIGN KEY (`user_id`) REFERENCES users(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `api_keys` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `account_id` VARCHAR(40) NOT NULL,
+  `created_by_user_id` VARCHAR(40) NOT NULL,
+  `name` VARCHAR(64) NOT NULL,
+  `key_hash` VARCHAR(64) NOT NULL,
+  `scopes` VARCHAR(255) NOT NULL,
+  `expiry` DATETIME NOT NULL,
+  `time_created` DATETIME NOT NULL,
+  `time_last_used` DATETIME DEFAULT NULL,
+  `time_revoked` DATETIME DEFAULT NULL,
+  UNIQUE KEY `api_key_id` (`id`),
+  UNIQUE KEY `api_key_hash` (`key_hash`),
+  UNIQUE KEY `api_key_name` (`account_id`,`name`),
+  FOREIGN KEY (`account_id`) REFERENCES accounts(`id`),
+  FOREIGN KEY (`created_by_user_id`) REFERENCES users(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `identity_providers` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `account_id` VARCHAR(40) NOT NULL,
+  `name` VARCHAR(64) NOT NULL,
+  `type` VARCHAR(20) NOT NULL,
+  `config` TEXT NOT NULL,
+  UNIQUE KEY `identity_provider_id` (`id`),
+  UNIQUE KEY `identity_provider_name` (`account_id`,`name`),
+  FOREIGN KEY (`account_id`) REFERENCES accounts(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `user_identities` (
+  `provider_id` VARCHAR(40) NOT NULL,
+  `subject` VARCHAR(255) NOT NULL,
+  `user_id` VARCHAR(40) NOT NULL,
+  `time_created` DATETIME NOT NULL,
+  UNIQUE KEY `user_identity` (`provider_id`,`subject`),
+  FOREIGN KEY (`provider_id`) REFERENCES identity_providers(`id`),
+  FOREIGN KEY (`user_id`) REFERENCES users(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `login_states` (
+  `state` VARCHAR(64) NOT NULL,
+  `provider_id` VARCHAR(40) NOT NULL,
+  `nonce` VARCHAR(64) NOT NULL,
+  `user_id` VARCHAR(40) DEFAULT NULL,
+  `time_created` DATETIME NOT NULL,
+  UNIQUE KEY `login_state` (`state`),
+  FOREIGN KEY (`provider_id`) REFERENCES identity_providers(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `login_throttles` (
+  `kind` VARCHAR(20) NOT NULL,
+  `value` VARCHAR(255) NOT NULL,
+  `failures` INT NOT NULL,
+  `time_last_failure` DATETIME NOT NULL,
+  `locked_until` DATETIME DEFAULT NULL,
+  UNIQUE KEY `login_throttle` (`kind`,`value`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
+CREATE TABLE `login_lockouts` (
+  `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  `kind` VARCHAR(20) NOT NULL,
+  `username` VARCHAR(64) NOT NULL,
+  `remote_addr` VARCHAR(64) NOT NULL,
+  `account_id` VARCHAR(40) DEFAULT NULL,
+  `user_id` VARCHAR(40) DEFAULT NULL,
+  `time_created` DATETIME NOT NULL,
+  `locked_until` DATETIME NOT NULL,
+  `unlocked_by_user_id` VARCHAR(40) DEFAULT NULL,
+  `time_unlocked` DATETIME DEFAULT NULL,
+  UNIQUE KEY `login_lockout_id` (`id`),
+  KEY `login_lockout_account` (`account_id`,`time_created`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
 
 --============================================
 
-DROP TABLE IF EXISTS `adresses`;
+DROP TABLE IF EXISTS `addresses`;
 DROP TABLE IF EXISTS `regions`;
 DROP TABLE IF EXISTS `countries`;
 CREATE TABLE `countries` (
   `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
   `name` VARCHAR(100) NOT NULL,
+  `code` CHAR(2) DEFAULT NULL, -- ISO 3166-1 alpha-2
+  `code3` CHAR(3) DEFAULT NULL, -- ISO 3166-1 alpha-3
   `national_id_regex_pattern` VARCHAR(200) DEFAULT NULL,
   UNIQUE KEY `country_id` (`id`),
-  UNIQUE KEY `country_name` (`name`)
+  UNIQUE KEY `country_name` (`name`),
+  UNIQUE KEY `country_code` (`code`),
+  UNIQUE KEY `country_code3` (`code3`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
 
-INSERT INTO `countries` VALUES (uuid(), 'South Africa','[0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9]');
+-- other ISO 3166 countries and regions are loaded by the API on startup
+INSERT INTO `countries` (id,name,code,code3,national_id_regex_pattern) VALUES (uuid(), 'South Africa','ZA','ZAF','[0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9]');
 
 CREATE TABLE `regions` (
   `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
@@ -145,7 +409,7 @@ CREATE TABLE `regions` (
 
 INSERT INTO `regions` VALUES
   (uuid(), (select id from countries where name="South Africa"), "Gauteng", "GP"),
-  (uuid(), (select id from countries where name="South Africa"), "Kwazulu-Natal", "KZ"),
+  (uuid(), (select id from countries where name="South Africa"), "Kwazulu-Natal", "KZN"),
   (uuid(), (select id from countries where name="South Africa"), "Mpumalanga", "MP"),
   (uuid(), (select id from countries where name="South Africa"), "Western Cape", "WC"),
   (uuid(), (select id from countries where name="South Africa"), "Free State", "FS"),
@@ -155,16 +419,21 @@ INSERT INTO `regions` VALUES
   (uuid(), (select id from countries where name="South Africa"), "Limpopo", "LP");
 
 
+-- addresses of persons, groups and events, each with a unique label per owner
 CREATE TABLE `addresses` (
   id VARCHAR(40) DEFAULT (uuid()) NOT NULL,
+  table_name VARCHAR(40) NOT NULL,
+  table_id VARCHAR(40) NOT NULL,
+  label VARCHAR(40) NOT NULL,
   phone VARCHAR(20) DEFAULT NULL,
   street VARCHAR(100) NOT NULL,
-  info VARCHAR(100) NOT NULL,
+  info VARCHAR(100) NOT NULL DEFAULT '',
   city VARCHAR(100) NOT NULL,
   region_id VARCHAR(40) NOT NULL,
-  code VARCHAR(20) NOT NULL,
+  code VARCHAR(20) NOT NULL DEFAULT '',
   -- lat/lon ...
   UNIQUE KEY `address_id` (`id`),
+  UNIQUE KEY `address_label` (`table_name`,`table_id`,`label`),
   FOREIGN KEY (`region_id`) REFERENCES regions (`id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
 
@@ -194,11 +463,29 @@ CREATE TABLE `group_members` (
   `time_updated` DATETIME NOT NULL,
   `accepted` BOOLEAN DEFAULT FALSE,
   `rejected` TEXT DEFAULT NULL,
+  `field_values` TEXT DEFAULT NULL,
+  `applied_by_user_id` VARCHAR(40) DEFAULT NULL,
+  `reviewed_by_user_id` VARCHAR(40) DEFAULT NULL,
+  `time_reviewed` DATETIME DEFAULT NULL,
   UNIQUE KEY `group_member` (`group_id`,`person_id`),
   FOREIGN KEY (`group_id`) REFERENCES groups(`id`),
   FOREIGN KEY (`person_id`) REFERENCES persons(`id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
 
+-- roles of account users, group_id NULL for the whole account
+-- (admin users have implied roles: sysadmin in the system account, else account-admin)
+CREATE TABLE `user_roles` (
+  `user_id` VARCHAR(40) NOT NULL,
+  `account_id` VARCHAR(40) NOT NULL,
+  `group_id` VARCHAR(40) DEFAULT NULL,
+  `role` VARCHAR(20) NOT NULL,
+  `time_created` DATETIME NOT NULL,
+  KEY `user_role` (`user_id`),
+  FOREIGN KEY (`user_id`) REFERENCES users(`id`),
+  FOREIGN KEY (`account_id`) REFERENCES accounts(`id`),
+  FOREIGN KEY (`group_id`) REFERENCES groups(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
+
 --========================================
 
 DROP TABLE IF EXISTS `metas`;
@@ -230,9 +517,8 @@ CREATE TABLE `events` (
   `id` VARCHAR(40) DEFAULT (uuid()) NOT NULL,
   `account_id` VARCHAR(40) NOT NULL,
   `name` VARCHAR(200) NOT NULL,
-  
-
-
+  UNIQUE KEY `event_id` (`id`),
+  FOREIGN KEY (`account_id`) REFERENCES accounts(`id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3;
 
 
@@ -244,6 +530,7 @@ CREATE TABLE `messages` (
   `time_sent` DATETIME NOT NULL,
   `time_read` DATETIME DEFAULT NULL,
   `message` TEXT NOT NULL,
+  `notification` BOOLEAN DEFAULT false,
   UNIQUE KEY `message_id` (`id`),
   KEY `inbox_messages` (`to_user_id`,`time_sent`,`time_read`),
   FOREIGN KEY (`from_user_id`) REFERENCES `users`(`id`),
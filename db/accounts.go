@@ -1,6 +1,9 @@
 package db
 
 import (
+	"context"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/go-msvc/errors"
@@ -8,11 +11,14 @@ import (
 )
 
 type Account struct {
-	ID     string     `json:"id"`
-	Name   string     `json:"name"`
-	Active bool       `json:"active"`
-	Admin  bool       `json:"admin,omitempty"`
-	Expiry *time.Time `json:"expiry"`
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Active      bool       `json:"active"`
+	Admin       bool       `json:"admin,omitempty"`
+	Expiry      *time.Time `json:"expiry"`
+	MFARequired bool       `json:"mfa_required,omitempty" db:"mfa_required" doc:"Admin users must use MFA to login"`
+	TimeDeleted *SqlTime   `json:"time_deleted,omitempty" db:"time_deleted" doc:"Set when deleted, the account is purged after the grace period"`
+	PlanID      *string    `json:"plan_id,omitempty" db:"plan_id" doc:"Plan that limits usage of the account, none means unlimited"`
 }
 
 type AccountsFilter struct {
@@ -41,7 +47,9 @@ type NewAccount struct {
 	AdminEmail string `json:"admin_email"`
 }
 
-func AddAccount(newAccount NewAccount) (accountAdminUser *User, activationToken string, err error) {
+//AddAccount creates the account with an account admin user and returns the admin user's
+//temporary password, which can only be used to login and change the password
+func AddAccount(ctx context.Context, newAccount NewAccount) (accountAdminUser *User, tempPassword string, err error) {
 	if newAccount.Name == "" {
 		return nil, "", errors.Errorf("missing name")
 	}
@@ -57,11 +65,17 @@ func AddAccount(newAccount NewAccount) (accountAdminUser *User, activationToken
 	accountAdminUser.Account.Admin = false //not system admin account
 	accountAdminUser.Account.Active = true
 	accountAdminUser.Account.Expiry = nil
+	if plan, err := GetPlanByName(defaultPlanName); err != nil {
+		log.Errorf("new account(%s) has no plan: %+v", newAccount.Name, err)
+	} else {
+		accountAdminUser.Account.PlanID = &plan.ID
+	}
 	if _, err := db.NamedExec(
-		"INSERT INTO accounts SET id=:id,name=:name,admin=false,active=true,expiry=null",
+		"INSERT INTO accounts SET id=:id,name=:name,admin=false,active=true,expiry=null,plan_id=:plan_id",
 		map[string]interface{}{
-			"id":   accountAdminUser.Account.ID,
-			"name": newAccount.Name,
+			"id":      accountAdminUser.Account.ID,
+			"name":    newAccount.Name,
+			"plan_id": accountAdminUser.Account.PlanID,
 		},
 	); err != nil {
 		return nil, "", errors.Wrapf(err, "failed to create account")
@@ -70,21 +84,27 @@ func AddAccount(newAccount NewAccount) (accountAdminUser *User, activationToken
 	accountAdminUser.ID = uuid.New().String()
 	accountAdminUser.Username = newAccount.AdminEmail
 	accountAdminUser.Expiry = nil
-	accountAdminUser.Active = false
+	accountAdminUser.Active = true
 	accountAdminUser.Admin = true //account admin user
-	activationToken = passwordHash(*accountAdminUser, newRandomPassword(10))
+	tempPassword = newRandomPassword(12)
+	passhash, err := hashPassword(tempPassword)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to hash temporary password")
+	}
 	if _, err := db.NamedExec(
-		"INSERT INTO users SET id=:id,account_id=:account_id,username=:username,passhash=:passhash,admin=true,active=false,expiry=null",
+		"INSERT INTO users SET id=:id,account_id=:account_id,username=:username,passhash=:passhash,admin=true,active=true,expiry=null,must_change_password=true",
 		map[string]interface{}{
 			"id":         accountAdminUser.ID,
 			"account_id": accountAdminUser.Account.ID,
 			"username":   accountAdminUser.Username,
-			"passhash":   activationToken,
+			"passhash":   passhash,
 		},
 	); err != nil {
 		return nil, "", errors.Wrapf(err, "failed to create account admin user")
 	}
-	return accountAdminUser, activationToken, nil
+	audit(ctx, accountAdminUser.Account.ID, "accounts", accountAdminUser.Account.ID, "create", nil, accountAdminUser.Account)
+	audit(ctx, accountAdminUser.Account.ID, "users", accountAdminUser.ID, "create", nil, accountAdminUser)
+	return accountAdminUser, tempPassword, nil
 }
 
 func GetAccount(accountID string) (*Account, error) {
@@ -116,3 +136,265 @@ func GetAccountByName(name string) (*Account, error) {
 }
 
 var publicAccount *Account
+
+type UpdAccountRequest struct {
+	Name   *string `json:"name,omitempty"`
+	Active *bool   `json:"active,omitempty" doc:"false to suspend the account, true to reactivate"`
+	Expiry *string `json:"expiry,omitempty" doc:"RFC3339 time when users can no longer login, or \"\" to remove the expiry"`
+	Plan   *string `json:"plan,omitempty" doc:"Name of the plan that limits usage, or \"\" for unlimited"`
+}
+
+//UpdAccount renames, suspends/reactivates or sets the expiry of an account (sysadmin only)
+//suspending the account ends the sessions of all its users
+func UpdAccount(ctx context.Context, by User, accountID string, req UpdAccountRequest) (*Account, error) {
+	if err := Authorize(by, PermSystemManage, "", ""); err != nil {
+		return nil, errors.Wrapf(err, "only sysadmin can update accounts")
+	}
+	before, err := GetAccount(accountID)
+	if err != nil {
+		return nil, errors.Errorf("account(%s) not found", accountID)
+	}
+	if before.Admin && req.Active != nil && !*req.Active {
+		return nil, errors.Errorf("cannot suspend the system account")
+	}
+
+	sets := []string{}
+	args := map[string]interface{}{"id": accountID}
+	if req.Name != nil {
+		if *req.Name == "" {
+			return nil, errors.Errorf("missing name")
+		}
+		sets = append(sets, "name=:name")
+		args["name"] = *req.Name
+	}
+	if req.Active != nil {
+		sets = append(sets, "active=:active")
+		args["active"] = *req.Active
+	}
+	if req.Expiry != nil {
+		sets = append(sets, "expiry=:expiry")
+		args["expiry"] = nil
+		if *req.Expiry != "" {
+			t, err := time.Parse(time.RFC3339, *req.Expiry)
+			if err != nil {
+				return nil, errors.Errorf("expiry:\"%s\" is not an RFC3339 time", *req.Expiry)
+			}
+			args["expiry"] = SqlTime(t)
+		}
+	}
+	if req.Plan != nil {
+		sets = append(sets, "plan_id=:plan_id")
+		args["plan_id"] = nil
+		if *req.Plan != "" {
+			plan, err := GetPlanByName(*req.Plan)
+			if err != nil {
+				return nil, err
+			}
+			args["plan_id"] = plan.ID
+		}
+	}
+	if len(sets) == 0 {
+		return before, nil
+	}
+	if _, err := db.NamedExec("UPDATE accounts SET "+strings.Join(sets, ",")+" WHERE id=:id", args); err != nil {
+		return nil, errors.Wrapf(err, "failed to update account")
+	}
+	if req.Active != nil && !*req.Active {
+		if err := delAccountSessions(accountID); err != nil {
+			log.Errorf("%+v", err)
+		}
+	}
+
+	after, err := GetAccount(accountID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get updated account")
+	}
+	audit(ctx, accountID, "accounts", accountID, "update", before, after)
+	return after, nil
+} //UpdAccount()
+
+func delAccountSessions(accountID string) error {
+	if _, err := db.NamedExec("DELETE FROM sessions WHERE account_id=:id", map[string]interface{}{"id": accountID}); err != nil {
+		return errors.Wrapf(err, "failed to end sessions of account(%s)", accountID)
+	}
+	return nil
+}
+
+//deleted accounts are suspended and only purged after the grace period, until then they can be restored
+var accountDeleteGrace time.Duration
+
+func init() {
+	accountDeleteGrace = time.Duration(intDefault(os.Getenv("ACCOUNT_DELETE_GRACE_DAYS"), 30)) * 24 * time.Hour
+	if os.Getenv("ACCOUNT_DELETE_GRACE_DAYS") == "0" {
+		accountDeleteGrace = 0
+	}
+}
+
+//AccountDeletion reports what was (or in a dry run, would be) deleted with an account
+type AccountDeletion struct {
+	Account    Account          `json:"account"`
+	DryRun     bool             `json:"dry_run,omitempty"`
+	PurgeAfter *time.Time       `json:"purge_after,omitempty" doc:"Account can be restored until this time, then it is purged"`
+	Purged     bool             `json:"purged"`
+	Deleted    map[string]int64 `json:"deleted" doc:"Nr of records per table"`
+}
+
+//DelAccount deletes the account (sysadmin only)
+//the account is suspended and purged with all its contents when the grace period expired,
+//with dryRun nothing changes and the report lists what will be purged
+func DelAccount(ctx context.Context, by User, accountID string, dryRun bool) (*AccountDeletion, error) {
+	if err := Authorize(by, PermSystemManage, "", ""); err != nil {
+		return nil, errors.Wrapf(err, "only sysadmin can delete accounts")
+	}
+	account, err := GetAccount(accountID)
+	if err != nil {
+		return nil, errors.Errorf("account(%s) not found", accountID)
+	}
+	if account.Admin || (publicAccount != nil && account.ID == publicAccount.ID) {
+		return nil, errors.Errorf("cannot delete the %s account", account.Name)
+	}
+
+	//counts are exact because the purge is done and rolled back
+	deletion, err := purgeAccount(*account, true)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return deletion, nil
+	}
+	if accountDeleteGrace == 0 {
+		deletion, err = purgeAccount(*account, false)
+		if err != nil {
+			return nil, err
+		}
+		audit(ctx, accountID, "accounts", accountID, "purge", account, nil)
+		return deletion, nil
+	}
+
+	if account.TimeDeleted == nil {
+		if _, err := db.NamedExec(
+			"UPDATE accounts SET active=false,time_deleted=now() WHERE id=:id",
+			map[string]interface{}{"id": accountID},
+		); err != nil {
+			return nil, errors.Wrapf(err, "failed to delete account")
+		}
+		if err := delAccountSessions(accountID); err != nil {
+			log.Errorf("%+v", err)
+		}
+		audit(ctx, accountID, "accounts", accountID, "delete", account, nil)
+	}
+	if account, err = GetAccount(accountID); err != nil {
+		return nil, errors.Wrapf(err, "failed to get deleted account")
+	}
+	purgeAfter := time.Time(*account.TimeDeleted).Add(accountDeleteGrace)
+	deletion.Account = *account
+	deletion.DryRun = false
+	deletion.PurgeAfter = &purgeAfter
+	return deletion, nil
+} //DelAccount()
+
+//RestoreAccount undoes DelAccount during the grace period and reactivates the account
+func RestoreAccount(ctx context.Context, by User, accountID string) (*Account, error) {
+	if err := Authorize(by, PermSystemManage, "", ""); err != nil {
+		return nil, errors.Wrapf(err, "only sysadmin can restore accounts")
+	}
+	result, err := db.NamedExec(
+		"UPDATE accounts SET active=true,time_deleted=NULL WHERE id=:id AND time_deleted IS NOT NULL",
+		map[string]interface{}{"id": accountID},
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to restore account")
+	}
+	if nr, _ := result.RowsAffected(); nr != 1 {
+		return nil, errors.Errorf("account(%s) is not deleted", accountID)
+	}
+	account, err := GetAccount(accountID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get restored account")
+	}
+	audit(ctx, accountID, "accounts", accountID, "restore", nil, account)
+	return account, nil
+} //RestoreAccount()
+
+//PurgeDeletedAccounts purges accounts deleted longer than the grace period ago
+func PurgeDeletedAccounts(ctx context.Context) error {
+	var accounts []Account
+	if err := NamedSelect(
+		&accounts,
+		"SELECT * FROM accounts WHERE time_deleted IS NOT NULL AND time_deleted<now()-INTERVAL :grace SECOND",
+		map[string]interface{}{"grace": int64(accountDeleteGrace / time.Second)},
+	); err != nil {
+		return errors.Wrapf(err, "failed to get deleted accounts")
+	}
+	for _, account := range accounts {
+		deletion, err := purgeAccount(account, false)
+		if err != nil {
+			return errors.Wrapf(err, "failed to purge account(%s)", account.ID)
+		}
+		log.Infof("Purged account(%s) %s: %+v", account.ID, account.Name, deletion.Deleted)
+		audit(ctx, account.ID, "accounts", account.ID, "purge", account, nil)
+	}
+	return nil
+} //PurgeDeletedAccounts()
+
+//accountPurgeSteps delete everything that belongs to an account, in foreign key order
+//(subqueries on groups are wrapped in a derived table because MariaDB cannot select from the table being changed)
+var accountPurgeSteps = []struct {
+	table string //empty to not report
+	query string
+}{
+	{"messages", "DELETE FROM messages WHERE from_user_id IN (SELECT id FROM users WHERE account_id=:id) OR to_user_id IN (SELECT id FROM users WHERE account_id=:id)"},
+	{"sessions", "DELETE FROM sessions WHERE account_id=:id OR user_id IN (SELECT id FROM users WHERE account_id=:id) OR impersonator_user_id IN (SELECT id FROM users WHERE account_id=:id)"},
+	{"user_recovery_codes", "DELETE FROM user_recovery_codes WHERE user_id IN (SELECT id FROM users WHERE account_id=:id)"},
+	{"password_resets", "DELETE FROM password_resets WHERE user_id IN (SELECT id FROM users WHERE account_id=:id)"},
+	{"login_states", "DELETE FROM login_states WHERE provider_id IN (SELECT id FROM identity_providers WHERE account_id=:id)"},
+	{"user_identities", "DELETE FROM user_identities WHERE user_id IN (SELECT id FROM users WHERE account_id=:id) OR provider_id IN (SELECT id FROM identity_providers WHERE account_id=:id)"},
+	{"identity_providers", "DELETE FROM identity_providers WHERE account_id=:id"},
+	{"api_keys", "DELETE FROM api_keys WHERE account_id=:id"},
+	{"user_invitations", "DELETE FROM user_invitations WHERE account_id=:id"},
+	{"user_roles", "DELETE FROM user_roles WHERE account_id=:id OR user_id IN (SELECT id FROM users WHERE account_id=:id)"},
+	{"group_members", "DELETE FROM group_members WHERE group_id IN (SELECT id FROM groups WHERE account_id=:id)"},
+	{"metas", "DELETE FROM metas WHERE table_name='groups' AND table_id IN (SELECT id FROM groups WHERE account_id=:id)"},
+	{"fields", "DELETE FROM fields WHERE table_name='groups' AND table_id IN (SELECT id FROM groups WHERE account_id=:id)"},
+	{"addresses", "DELETE FROM addresses WHERE (table_name='groups' AND table_id IN (SELECT id FROM groups WHERE account_id=:id)) OR (table_name='events' AND table_id IN (SELECT id FROM events WHERE account_id=:id))"},
+	{"events", "DELETE FROM events WHERE account_id=:id"},
+	//sub-group invitations sent to other accounts are deleted, accepted sub-groups of other accounts are detached
+	{"invitations", "DELETE FROM groups WHERE invitation=true AND account_id<>:id AND parent_group_id IN (SELECT id FROM (SELECT id FROM groups WHERE account_id=:id) as g)"},
+	{"detached_groups", "UPDATE groups SET parent_group_id=NULL WHERE account_id<>:id AND parent_group_id IN (SELECT id FROM (SELECT id FROM groups WHERE account_id=:id) as g)"},
+	{"", "UPDATE groups SET parent_group_id=NULL WHERE account_id=:id"},
+	{"groups", "DELETE FROM groups WHERE account_id=:id"},
+	{"users", "DELETE FROM users WHERE account_id=:id"},
+	{"accounts", "DELETE FROM accounts WHERE id=:id"},
+}
+
+//purgeAccount deletes the account and all its contents in one transaction,
+//with dryRun the transaction is rolled back
+func purgeAccount(account Account, dryRun bool) (*AccountDeletion, error) {
+	deletion := &AccountDeletion{
+		Account: account,
+		DryRun:  dryRun,
+		Purged:  !dryRun,
+		Deleted: map[string]int64{},
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	for _, step := range accountPurgeSteps {
+		result, err := tx.NamedExec(step.query, map[string]interface{}{"id": account.ID})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to purge %s", step.table)
+		}
+		if step.table != "" {
+			deletion.Deleted[step.table], _ = result.RowsAffected()
+		}
+	}
+	if dryRun {
+		return deletion, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to purge account")
+	}
+	return deletion, nil
+} //purgeAccount()
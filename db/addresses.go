@@ -1,10 +1,272 @@
 package db
 
+import (
+	"context"
+
+	"github.com/go-msvc/errors"
+	"github.com/google/uuid"
+)
+
 type Address struct {
-	Phone  string  `json:"phone"`
-	Street string  `json:"street"`
-	Info   string  `json:"info,omitempty"`
-	City   string  `json:"city"`
-	Region *Region `json:"region"`
-	Code   string  `json:"code,omitempty"`
+	ID        string  `json:"id"`
+	TableName string  `json:"table_name" doc:"persons|groups|events"`
+	TableID   string  `json:"table_id" doc:"Person, group or event that the address belongs to"`
+	Label     string  `json:"label" doc:"e.g. home, postal or venue, unique per person/group/event"`
+	Phone     string  `json:"phone"`
+	Street    string  `json:"street"`
+	Info      string  `json:"info,omitempty"`
+	City      string  `json:"city"`
+	Region    *Region `json:"region"`
+	Code      string  `json:"code,omitempty"`
+}
+
+type addressRow struct {
+	ID        string  `db:"id"`
+	TableName string  `db:"table_name"`
+	TableID   string  `db:"table_id"`
+	Label     string  `db:"label"`
+	Phone     *string `db:"phone"`
+	Street    string  `db:"street"`
+	Info      string  `db:"info"`
+	City      string  `db:"city"`
+	RegionID  string  `db:"region_id"`
+	Code      string  `db:"code"`
+}
+
+func (ar addressRow) Address() (Address, error) {
+	a := Address{
+		ID:        ar.ID,
+		TableName: ar.TableName,
+		TableID:   ar.TableID,
+		Label:     ar.Label,
+		Street:    ar.Street,
+		Info:      ar.Info,
+		City:      ar.City,
+		Code:      ar.Code,
+	}
+	if ar.Phone != nil {
+		a.Phone = *ar.Phone
+	}
+	var err error
+	if a.Region, err = GetRegion(ar.RegionID); err != nil {
+		return a, errors.Wrapf(err, "failed to get address region")
+	}
+	return a, nil
+}
+
+const addressRowQuery = "SELECT id,table_name,table_id,label,phone,street,info,city,region_id,code FROM addresses"
+
+type NewAddress struct {
+	Label     string `json:"label"`
+	Phone     string `json:"phone,omitempty"`
+	Street    string `json:"street"`
+	Info      string `json:"info,omitempty"`
+	City      string `json:"city"`
+	CountryID string `json:"country_id"`
+	RegionID  string `json:"region_id" doc:"Must be a region of the country, see GET /countries/{country_id}/regions"`
+	Code      string `json:"code,omitempty"`
+}
+
+func (na NewAddress) Validate() error {
+	if na.Label == "" {
+		return errors.Errorf("missing label")
+	}
+	if na.Street == "" {
+		return errors.Errorf("missing street")
+	}
+	if na.City == "" {
+		return errors.Errorf("missing city")
+	}
+	if na.CountryID == "" {
+		return errors.Errorf("missing country_id")
+	}
+	if na.RegionID == "" {
+		return errors.Errorf("missing region_id")
+	}
+	region, err := GetRegion(na.RegionID)
+	if err != nil {
+		return errors.Errorf("unknown region_id(%s)", na.RegionID)
+	}
+	if region.Country.ID != na.CountryID {
+		return errors.Errorf("region_id(%s) %s is not in country_id(%s)", na.RegionID, region.Name, na.CountryID)
+	}
+	return nil
+}
+
+//authorizeAddressOwner checks that the user may read or manage addresses of the person, group or event
+//and returns the account to audit the change in (none for persons)
+func authorizeAddressOwner(user User, tableName string, tableID string, manage bool) (accountID string, err error) {
+	switch tableName {
+	case "persons":
+		if Authorize(user, PermSystemManage, "", "") == nil {
+			return "", nil
+		}
+		//own person or a dependant
+		if _, err := ActFor(user, tableID); err != nil {
+			return "", err
+		}
+		return "", nil
+	case "groups":
+		g, err := GetGroup(tableID)
+		if err != nil {
+			return "", errors.Errorf("group(%s) not found", tableID)
+		}
+		perm := PermGroupsRead
+		if manage {
+			perm = PermGroupsManage
+		}
+		return g.Account.ID, Authorize(user, perm, g.Account.ID, g.ID)
+	case "events":
+		if err := db.Get(&accountID, "SELECT account_id FROM events WHERE id=?", tableID); err != nil {
+			return "", errors.Errorf("event(%s) not found", tableID)
+		}
+		perm := PermGroupsRead
+		if manage {
+			perm = PermGroupsManage
+		}
+		return accountID, Authorize(user, perm, accountID, "")
+	}
+	return "", errors.Errorf("%s cannot have addresses", tableName)
+}
+
+//GetAddresses returns the addresses of a person, group or event
+func GetAddresses(user User, tableName string, tableID string) ([]Address, error) {
+	if _, err := authorizeAddressOwner(user, tableName, tableID, false); err != nil {
+		return nil, err
+	}
+	return getAddresses(tableName, tableID)
+}
+
+func getAddresses(tableName string, tableID string) ([]Address, error) {
+	var rows []addressRow
+	if err := NamedSelect(
+		&rows,
+		addressRowQuery+" WHERE table_name=:table_name AND table_id=:table_id ORDER BY label",
+		map[string]interface{}{
+			"table_name": tableName,
+			"table_id":   tableID,
+		},
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get addresses")
+	}
+	addresses := make([]Address, len(rows))
+	for i, ar := range rows {
+		var err error
+		if addresses[i], err = ar.Address(); err != nil {
+			return nil, err
+		}
+	}
+	return addresses, nil
+}
+
+func getAddress(tableName string, tableID string, id string) (*Address, error) {
+	var row addressRow
+	if err := NamedGet(
+		&row,
+		addressRowQuery+" WHERE table_name=:table_name AND table_id=:table_id AND id=:id",
+		map[string]interface{}{
+			"table_name": tableName,
+			"table_id":   tableID,
+			"id":         id,
+		},
+	); err != nil {
+		return nil, errors.Errorf("address(%s) not found", id)
+	}
+	a, err := row.Address()
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func AddAddress(ctx context.Context, user User, tableName string, tableID string, na NewAddress) (*Address, error) {
+	accountID, err := authorizeAddressOwner(user, tableName, tableID, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := na.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid address")
+	}
+	id := uuid.New().String()
+	if _, err := db.NamedExec(
+		"INSERT INTO addresses SET id=:id,table_name=:table_name,table_id=:table_id,label=:label,phone=:phone,street=:street,info=:info,city=:city,region_id=:region_id,code=:code",
+		addressValues(id, tableName, tableID, na),
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to add address (label must be unique)")
+	}
+	a, err := getAddress(tableName, tableID, id)
+	if err != nil {
+		return nil, err
+	}
+	audit(ctx, accountID, "addresses", id, "create", nil, a)
+	return a, nil
+}
+
+func UpdAddress(ctx context.Context, user User, tableName string, tableID string, id string, na NewAddress) (*Address, error) {
+	accountID, err := authorizeAddressOwner(user, tableName, tableID, true)
+	if err != nil {
+		return nil, err
+	}
+	before, err := getAddress(tableName, tableID, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := na.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid address")
+	}
+	if _, err := db.NamedExec(
+		"UPDATE addresses SET label=:label,phone=:phone,street=:street,info=:info,city=:city,region_id=:region_id,code=:code"+
+			" WHERE id=:id AND table_name=:table_name AND table_id=:table_id",
+		addressValues(id, tableName, tableID, na),
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to update address (label must be unique)")
+	}
+	after, err := getAddress(tableName, tableID, id)
+	if err != nil {
+		return nil, err
+	}
+	audit(ctx, accountID, "addresses", id, "update", before, after)
+	return after, nil
+}
+
+func DelAddress(ctx context.Context, user User, tableName string, tableID string, id string) error {
+	accountID, err := authorizeAddressOwner(user, tableName, tableID, true)
+	if err != nil {
+		return err
+	}
+	before, err := getAddress(tableName, tableID, id)
+	if err != nil {
+		return err
+	}
+	if _, err := db.NamedExec(
+		"DELETE FROM addresses WHERE id=:id AND table_name=:table_name AND table_id=:table_id",
+		map[string]interface{}{
+			"id":         id,
+			"table_name": tableName,
+			"table_id":   tableID,
+		},
+	); err != nil {
+		return errors.Wrapf(err, "failed to delete address")
+	}
+	audit(ctx, accountID, "addresses", id, "delete", before, nil)
+	return nil
+}
+
+func addressValues(id string, tableName string, tableID string, na NewAddress) map[string]interface{} {
+	values := map[string]interface{}{
+		"id":         id,
+		"table_name": tableName,
+		"table_id":   tableID,
+		"label":      na.Label,
+		"phone":      nil,
+		"street":     na.Street,
+		"info":       na.Info,
+		"city":       na.City,
+		"region_id":  na.RegionID,
+		"code":       na.Code,
+	}
+	if na.Phone != "" {
+		values["phone"] = na.Phone
+	}
+	return values
 }
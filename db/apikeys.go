@@ -0,0 +1,250 @@
+package db
+
+import (
+	"strings"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/google/uuid"
+)
+
+//ApiKeyScope limits what an API key may be used for
+type ApiKeyScope string
+
+const (
+	ApiKeyScopeGroupsRead   ApiKeyScope = "groups:read"
+	ApiKeyScopeGroupsWrite  ApiKeyScope = "groups:write"
+	ApiKeyScopeMembersRead  ApiKeyScope = "members:read"
+	ApiKeyScopeMembersWrite ApiKeyScope = "members:write"
+	ApiKeyScopeUsersRead    ApiKeyScope = "users:read"
+)
+
+var apiKeyScopes = map[ApiKeyScope]bool{
+	ApiKeyScopeGroupsRead:   true,
+	ApiKeyScopeGroupsWrite:  true,
+	ApiKeyScopeMembersRead:  true,
+	ApiKeyScopeMembersWrite: true,
+	ApiKeyScopeUsersRead:    true,
+}
+
+const apiKeyPrefix = "hsk_"
+
+type ApiKey struct {
+	ID           string        `json:"id"`
+	AccountID    string        `json:"account_id"`
+	CreatedBy    string        `json:"created_by_user_id"`
+	Name         string        `json:"name"`
+	Scopes       []ApiKeyScope `json:"scopes"`
+	Expiry       SqlTime       `json:"expiry"`
+	TimeCreated  SqlTime       `json:"time_created"`
+	TimeLastUsed *SqlTime      `json:"time_last_used,omitempty"`
+	TimeRevoked  *SqlTime      `json:"time_revoked,omitempty"`
+}
+
+func (k ApiKey) HasScope(scope ApiKeyScope) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type apiKeyRow struct {
+	ID           string   `db:"id"`
+	AccountID    string   `db:"account_id"`
+	CreatedBy    string   `db:"created_by_user_id"`
+	Name         string   `db:"name"`
+	Scopes       string   `db:"scopes"`
+	Expiry       SqlTime  `db:"expiry"`
+	TimeCreated  SqlTime  `db:"time_created"`
+	TimeLastUsed *SqlTime `db:"time_last_used"`
+	TimeRevoked  *SqlTime `db:"time_revoked"`
+}
+
+func (r apiKeyRow) ApiKey() ApiKey {
+	k := ApiKey{
+		ID:           r.ID,
+		AccountID:    r.AccountID,
+		CreatedBy:    r.CreatedBy,
+		Name:         r.Name,
+		Scopes:       []ApiKeyScope{},
+		Expiry:       r.Expiry,
+		TimeCreated:  r.TimeCreated,
+		TimeLastUsed: r.TimeLastUsed,
+		TimeRevoked:  r.TimeRevoked,
+	}
+	for _, s := range strings.Split(r.Scopes, ",") {
+		if s != "" {
+			k.Scopes = append(k.Scopes, ApiKeyScope(s))
+		}
+	}
+	return k
+}
+
+const apiKeyRowQuery = "SELECT id,account_id,created_by_user_id,name,scopes,expiry,time_created,time_last_used,time_revoked FROM api_keys"
+
+type NewApiKey struct {
+	Name   string        `json:"name" doc:"Name to recognise the key, unique in the account"`
+	Scopes []ApiKeyScope `json:"scopes" doc:"What the key may be used for, e.g. groups:read"`
+	Expiry SqlTime       `json:"expiry" doc:"Time when the key stops working"`
+}
+
+func (nk NewApiKey) Validate() error {
+	if strings.TrimSpace(nk.Name) == "" {
+		return errors.Errorf("missing name")
+	}
+	if len(nk.Scopes) == 0 {
+		return errors.Errorf("missing scopes")
+	}
+	for _, s := range nk.Scopes {
+		if !apiKeyScopes[s] {
+			return errors.Errorf("unknown scope \"%s\"", s)
+		}
+	}
+	if !time.Time(nk.Expiry).After(time.Now()) {
+		return errors.Errorf("expiry must be in the future")
+	}
+	return nil
+}
+
+//AddApiKey creates a key for the user's account and returns the secret key value,
+//which is only stored hashed and cannot be retrieved again
+func AddApiKey(user User, nk NewApiKey) (*ApiKey, string, error) {
+	if user.Account == nil {
+		return nil, "", errors.Errorf("only account admin can create API keys")
+	}
+	if err := Authorize(user, PermAccountManage, user.Account.ID, ""); err != nil {
+		return nil, "", err
+	}
+	if user.Account.Admin {
+		return nil, "", errors.Errorf("API keys cannot be created for the system account")
+	}
+	if err := nk.Validate(); err != nil {
+		return nil, "", errors.Wrapf(err, "invalid API key")
+	}
+	scopes := make([]string, len(nk.Scopes))
+	for i, s := range nk.Scopes {
+		scopes[i] = string(s)
+	}
+	secret := apiKeyPrefix + newRandomToken()
+	row := apiKeyRow{
+		ID:          uuid.New().String(),
+		AccountID:   user.Account.ID,
+		CreatedBy:   user.ID,
+		Name:        strings.TrimSpace(nk.Name),
+		Scopes:      strings.Join(scopes, ","),
+		Expiry:      nk.Expiry,
+		TimeCreated: SqlTime(time.Now()),
+	}
+	if _, err := db.NamedExec(
+		"INSERT INTO api_keys SET id=:id,account_id=:account_id,created_by_user_id=:created_by,name=:name,key_hash=:key_hash,scopes=:scopes,expiry=:expiry,time_created=:time_created",
+		map[string]interface{}{
+			"id":           row.ID,
+			"account_id":   row.AccountID,
+			"created_by":   row.CreatedBy,
+			"name":         row.Name,
+			"key_hash":     hashToken(secret),
+			"scopes":       row.Scopes,
+			"expiry":       row.Expiry,
+			"time_created": row.TimeCreated,
+		},
+	); err != nil {
+		return nil, "", errors.Wrapf(err, "failed to create API key")
+	}
+	k := row.ApiKey()
+	return &k, secret, nil
+} //AddApiKey()
+
+func GetApiKeys(accountID string) ([]ApiKey, error) {
+	var rows []apiKeyRow
+	if err := NamedSelect(
+		&rows,
+		apiKeyRowQuery+" WHERE account_id=:account_id ORDER BY name",
+		map[string]interface{}{
+			"account_id": accountID,
+		},
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get API keys")
+	}
+	keys := make([]ApiKey, len(rows))
+	for i, r := range rows {
+		keys[i] = r.ApiKey()
+	}
+	return keys, nil
+} //GetApiKeys()
+
+//RevokeApiKey stops the key from working but keeps it listed
+func RevokeApiKey(accountID string, id string) error {
+	result, err := db.NamedExec(
+		"UPDATE api_keys SET time_revoked=now() WHERE id=:id AND account_id=:account_id AND time_revoked IS NULL",
+		map[string]interface{}{
+			"id":         id,
+			"account_id": accountID,
+		},
+	)
+	if err != nil {
+		return errors.Wrapf(err, "failed to revoke API key")
+	}
+	if nr, _ := result.RowsAffected(); nr != 1 {
+		return errors.Errorf("API key(%s) not found or already revoked", id)
+	}
+	return nil
+} //RevokeApiKey()
+
+//GetApiKeySession returns a session for a valid API key, which acts as an admin of the key's
+//account, limited to the key's scopes which the caller must check with Session.ApiKey.HasScope()
+func GetApiKeySession(secret string) (*Session, error) {
+	if !strings.HasPrefix(secret, apiKeyPrefix) {
+		return nil, errors.Errorf("invalid API key")
+	}
+	var row apiKeyRow
+	if err := NamedGet(
+		&row,
+		apiKeyRowQuery+" WHERE key_hash=:key_hash AND time_revoked IS NULL",
+		map[string]interface{}{
+			"key_hash": hashToken(secret),
+		},
+	); err != nil {
+		return nil, errors.Errorf("invalid API key")
+	}
+	if time.Time(row.Expiry).Before(time.Now()) {
+		return nil, errors.Errorf("API key expired")
+	}
+
+	account, err := GetAccount(row.AccountID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get API key account")
+	}
+	if !account.Active || (account.Expiry != nil && account.Expiry.Before(time.Now())) {
+		return nil, errors.Errorf("account suspended or expired")
+	}
+	//the key acts as account admin on behalf of its creator, who must still be allowed to create keys
+	//(a suspended, expired, demoted, deleted or anonymised creator disables the key)
+	creator, err := GetUser(row.AccountID, row.CreatedBy)
+	if err != nil || !creator.activeAdmin() {
+		return nil, errors.Errorf("API key creator is no longer an active account admin")
+	}
+
+	if _, err := db.NamedExec(
+		"UPDATE api_keys SET time_last_used=now() WHERE id=:id",
+		map[string]interface{}{
+			"id": row.ID,
+		},
+	); err != nil {
+		log.Errorf("failed to update API key(%s) last used: %+v", row.ID, err)
+	}
+
+	k := row.ApiKey()
+	return &Session{
+		ID: row.ID,
+		User: User{
+			ID:       row.CreatedBy,
+			Account:  account,
+			Username: "apikey:" + row.Name,
+			Admin:    true,
+			Active:   true,
+		},
+		ApiKey: &k,
+	}, nil
+} //GetApiKeySession()
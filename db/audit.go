@@ -0,0 +1,146 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-msvc/errors"
+)
+
+//requestIDKey is the context key of the request ID set with WithRequestID
+type requestIDKey struct{}
+
+//WithRequestID returns a context that identifies the request in audit records
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+//audit records a change in the log table, made by the session user in ctx, if any
+//accountID is the account that owns the changed record and scopes who may read the record
+//before and after are stored as JSON, nil for create and delete
+//failures are logged but do not fail the change
+func audit(ctx context.Context, accountID string, table string, id string, change string, before interface{}, after interface{}) {
+	values := map[string]interface{}{
+		"account_id":           nil,
+		"table":                table,
+		"id":                   id,
+		"change":               change,
+		"session_id":           nil,
+		"user_id":              nil,
+		"username":             nil,
+		"impersonator_user_id": nil,
+		"request_id":           nil,
+		"before":               nil,
+		"after":                nil,
+	}
+	if accountID != "" {
+		values["account_id"] = accountID
+	}
+	if session, ok := ctx.Value(Session{}).(Session); ok {
+		values["session_id"] = session.ID
+		values["user_id"] = session.User.ID
+		values["username"] = session.User.Username
+		if session.Impersonator != nil {
+			values["impersonator_user_id"] = session.Impersonator.ID
+		}
+	}
+	if requestID, ok := ctx.Value(requestIDKey{}).(string); ok && requestID != "" {
+		values["request_id"] = requestID
+	}
+	for _, n := range []string{"before", "after"} {
+		v := before
+		if n == "after" {
+			v = after
+		}
+		if v == nil {
+			continue
+		}
+		jsonValue, err := json.Marshal(v)
+		if err != nil {
+			log.Errorf("cannot audit %s.%s(%s) %s value: %+v", table, id, change, n, err)
+			continue
+		}
+		values[n] = string(jsonValue)
+	}
+	if _, err := db.NamedExec(
+		"INSERT INTO `log` SET account_id=:account_id,`table`=:table,id=:id,`timestamp`=now(6),`change`=:change,"+
+			"session_id=:session_id,user_id=:user_id,username=:username,impersonator_user_id=:impersonator_user_id,request_id=:request_id,"+
+			"`before`=:before,`after`=:after",
+		values,
+	); err != nil {
+		log.Errorf("failed to audit %s.%s(%s): %+v", table, id, change, err)
+	}
+} //audit()
+
+type AuditRecord struct {
+	AccountID          *string          `json:"account_id,omitempty" db:"account_id"`
+	Table              string           `json:"table" db:"table"`
+	ID                 string           `json:"id" db:"id"`
+	Timestamp          SqlTime          `json:"timestamp" db:"timestamp"`
+	Change             string           `json:"change" db:"change"`
+	SessionID          *string          `json:"session_id,omitempty" db:"session_id"`
+	UserID             *string          `json:"user_id,omitempty" db:"user_id" doc:"User who made the change, nil when not logged in, e.g. registration"`
+	Username           *string          `json:"username,omitempty" db:"username"`
+	ImpersonatorUserID *string          `json:"impersonator_user_id,omitempty" db:"impersonator_user_id" doc:"Sysadmin who made the change as the user"`
+	RequestID          *string          `json:"request_id,omitempty" db:"request_id"`
+	Before             *json.RawMessage `json:"before,omitempty" db:"before"`
+	After              *json.RawMessage `json:"after,omitempty" db:"after"`
+}
+
+type AuditFilter struct {
+	AccountID *string
+	Table     *string
+	ID        *string
+	UserID    *string
+	RequestID *string
+	From      *time.Time
+	To        *time.Time
+}
+
+//GetAudit returns the most recent audit records matching the filter
+func GetAudit(filter AuditFilter, limit int) ([]AuditRecord, error) {
+	filterQuery := []string{}
+	filterArgs := map[string]interface{}{
+		"limit": limit,
+	}
+	for _, f := range []struct {
+		column string
+		value  *string
+	}{
+		{"account_id", filter.AccountID},
+		{"table", filter.Table},
+		{"id", filter.ID},
+		{"user_id", filter.UserID},
+		{"request_id", filter.RequestID},
+	} {
+		if f.value != nil {
+			filterQuery = append(filterQuery, "`"+f.column+"`=:"+f.column)
+			filterArgs[f.column] = *f.value
+		}
+	}
+	if filter.From != nil {
+		filterQuery = append(filterQuery, "`timestamp`>=:from")
+		filterArgs["from"] = *filter.From
+	}
+	if filter.To != nil {
+		filterQuery = append(filterQuery, "`timestamp`<:to")
+		filterArgs["to"] = *filter.To
+	}
+
+	query := "SELECT account_id,`table`,id,`timestamp`,`change`,session_id,user_id,username,impersonator_user_id,request_id,`before`,`after` FROM `log`"
+	for i, f := range filterQuery {
+		if i == 0 {
+			query += " where " + f
+		} else {
+			query += " and " + f
+		}
+	}
+	query += " ORDER BY `timestamp` DESC LIMIT :limit"
+
+	var list []AuditRecord
+	if err := NamedSelect(&list, query, filterArgs); err != nil {
+		return nil, errors.Wrapf(err, "failed to get audit records")
+	}
+	return list, nil
+} //GetAudit()
@@ -0,0 +1,337 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+//persons younger than this need consent from a guardian to register, join groups and send messages
+var consentAge = intDefault(os.Getenv("CONSENT_AGE"), familyAdultAge)
+
+type ConsentAction string
+
+const (
+	ConsentActionRegister  ConsentAction = "register"   //no target, activation of the new user waits for consent
+	ConsentActionJoinGroup ConsentAction = "join_group" //target is the group, membership is requested after consent
+	ConsentActionMessage   ConsentAction = "message"    //no target, once approved the user may send messages
+)
+
+type ConsentStatus string
+
+const (
+	ConsentPending  ConsentStatus = "pending"
+	ConsentApproved ConsentStatus = "approved"
+	ConsentDeclined ConsentStatus = "declined"
+)
+
+//Consent is a request for a guardian to approve what a minor person wants to do
+type Consent struct {
+	ID                string        `json:"id" db:"id"`
+	PersonID          string        `json:"person_id" db:"person_id"`
+	Person            *Person       `json:"person,omitempty"`
+	Action            ConsentAction `json:"action" db:"action"`
+	TargetID          *string       `json:"target_id,omitempty" db:"target_id" doc:"Group for join_group"`
+	RequestedByUserID string        `json:"requested_by_user_id" db:"requested_by_user_id"`
+	TimeRequested     SqlTime       `json:"time_requested" db:"time_requested"`
+	GuardianPersonID  *string       `json:"guardian_person_id,omitempty" db:"guardian_person_id" doc:"Guardian named at registration, else any parent may decide"`
+	Status            ConsentStatus `json:"status" db:"status"`
+	DecidedByUserID   *string       `json:"decided_by_user_id,omitempty" db:"decided_by_user_id"`
+	TimeDecided       *SqlTime      `json:"time_decided,omitempty" db:"time_decided"`
+	Note              *string       `json:"note,omitempty" db:"note"`
+}
+
+const consentQuery = "SELECT id,person_id,action,target_id,requested_by_user_id,time_requested,guardian_person_id,status,decided_by_user_id,time_decided,note FROM consents"
+
+//ConsentRequiredError is returned when a minor's action waits for a guardian,
+//the consent request was created or already pending
+type ConsentRequiredError struct {
+	Consent Consent
+}
+
+func (e ConsentRequiredError) Error() string {
+	return fmt.Sprintf("guardian consent required to %s, request(%s) is %s", e.Consent.Action, e.Consent.ID, e.Consent.Status)
+}
+
+//needsConsent is true for persons younger than the consent age
+func (p Person) needsConsent() bool {
+	return p.Dob != nil && p.age(time.Now()) < consentAge
+}
+
+//parentIDs returns all parents of the person
+func parentIDs(q sqlx.Queryer, personID string) ([]string, error) {
+	ids := []string{}
+	if err := sqlx.Select(q, &ids, "SELECT person_id_of_parent FROM person_parents WHERE person_id_of_child=?", personID); err != nil {
+		return nil, errors.Wrapf(err, "failed to get parents")
+	}
+	return ids, nil
+}
+
+//guardianIDs returns the adult parents of the person
+func guardianIDs(q sqlx.Queryer, personID string) ([]string, error) {
+	var parents []personRow
+	if err := sqlx.Select(q, &parents, personRowQuery+" WHERE id IN (SELECT person_id_of_parent FROM person_parents WHERE person_id_of_child=?)", personID); err != nil {
+		return nil, errors.Wrapf(err, "failed to get parents")
+	}
+	ids := []string{}
+	for _, pr := range parents {
+		if p := pr.Person(); p.age(time.Now()) >= familyAdultAge {
+			ids = append(ids, p.ID)
+		}
+	}
+	return ids, nil
+}
+
+//consentStatus returns the latest decision or pending request for the person's action, nil if none
+func consentStatus(personID string, action ConsentAction, targetID *string) (*Consent, error) {
+	var list []Consent
+	if err := db.Select(
+		&list,
+		consentQuery+" WHERE person_id=? AND action=? AND (target_id=? OR (target_id IS NULL AND ? IS NULL)) ORDER BY time_requested DESC LIMIT 1",
+		personID, action, targetID, targetID,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get consent")
+	}
+	if len(list) == 0 {
+		return nil, nil
+	}
+	return &list[0], nil
+}
+
+//requireConsent returns nil when the action was approved, else it requests consent
+//(unless already pending) and returns ConsentRequiredError
+func requireConsent(ctx context.Context, user User, person Person, action ConsentAction, targetID *string, guardianPersonID *string) error {
+	consent, err := consentStatus(person.ID, action, targetID)
+	if err != nil {
+		return err
+	}
+	if consent != nil && consent.Status == ConsentApproved {
+		return nil
+	}
+	if consent != nil && consent.Status == ConsentPending {
+		return ConsentRequiredError{Consent: *consent}
+	}
+	if guardianPersonID == nil {
+		guardians, err := guardianIDs(db, person.ID)
+		if err != nil {
+			return err
+		}
+		if len(guardians) == 0 {
+			return errors.Errorf("%s %s is younger than %d and needs a parent or guardian linked as family", person.Name, person.Surname, consentAge)
+		}
+	}
+	id := uuid.New().String()
+	if _, err := db.NamedExec(
+		"INSERT INTO consents SET id=:id,person_id=:person_id,action=:action,target_id=:target_id,"+
+			"requested_by_user_id=:user_id,time_requested=:time_requested,guardian_person_id=:guardian_person_id,status=:status",
+		map[string]interface{}{
+			"id":                 id,
+			"person_id":          person.ID,
+			"action":             action,
+			"target_id":          targetID,
+			"user_id":            user.ID,
+			"time_requested":     SqlTime(time.Now()),
+			"guardian_person_id": guardianPersonID,
+			"status":             ConsentPending,
+		},
+	); err != nil {
+		return errors.Wrapf(err, "failed to request consent")
+	}
+	if consent, err = getConsent(id); err != nil {
+		return err
+	}
+	audit(ctx, "", "consents", id, "request", nil, consent)
+	return ConsentRequiredError{Consent: *consent}
+} //requireConsent()
+
+func getConsent(id string) (*Consent, error) {
+	var c Consent
+	if err := NamedGet(&c, consentQuery+" WHERE id=:id", map[string]interface{}{"id": id}); err != nil {
+		return nil, errors.Errorf("consent(%s) not found", id)
+	}
+	return &c, nil
+}
+
+//GetConsents is the guardian's inbox: consent requests of the user's children
+//and of those who named the user's person as guardian when registering
+func GetConsents(user User, status ConsentStatus) ([]Consent, error) {
+	self, err := userPerson(user)
+	if err != nil {
+		return nil, err
+	}
+	list := []Consent{}
+	if err := NamedSelect(
+		&list,
+		consentQuery+" WHERE status=:status AND (guardian_person_id=:guardian_id"+
+			" OR (guardian_person_id IS NULL AND person_id IN (SELECT person_id_of_child FROM person_parents WHERE person_id_of_parent=:guardian_id)))"+
+			" ORDER BY time_requested",
+		map[string]interface{}{
+			"status":      status,
+			"guardian_id": self.ID,
+		},
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get consents")
+	}
+	for i := range list {
+		if list[i].Person, err = GetPerson(list[i].PersonID); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+//DecideConsent lets a guardian approve or decline a pending request,
+//approving does what the minor asked for
+func DecideConsent(ctx context.Context, user User, id string, approve bool, note string) (*Consent, error) {
+	self, err := userPerson(user)
+	if err != nil {
+		return nil, err
+	}
+	if self.age(time.Now()) < familyAdultAge {
+		return nil, errors.Errorf("guardians must be at least %d years old", familyAdultAge)
+	}
+	before, err := getConsent(id)
+	if err != nil {
+		return nil, err
+	}
+	if before.Status != ConsentPending {
+		return nil, errors.Errorf("consent(%s) is already %s", id, before.Status)
+	}
+	if before.GuardianPersonID != nil {
+		if *before.GuardianPersonID != self.ID {
+			return nil, errors.Errorf("consent(%s) is not for you to decide", id)
+		}
+	} else {
+		guardians, err := guardianIDs(db, before.PersonID)
+		if err != nil {
+			return nil, err
+		}
+		isGuardian := false
+		for _, g := range guardians {
+			isGuardian = isGuardian || g == self.ID
+		}
+		if !isGuardian {
+			return nil, errors.Errorf("consent(%s) is not for you to decide", id)
+		}
+	}
+	person, err := GetPerson(before.PersonID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	status := ConsentDeclined
+	var joined *Group
+	if approve {
+		status = ConsentApproved
+		switch before.Action {
+		case ConsentActionRegister:
+			//the guardian named at registration becomes the parent,
+			//unless the person got parents since, who must then consent
+			if before.GuardianPersonID != nil {
+				parents, err := parentIDs(tx, person.ID)
+				if err != nil {
+					return nil, err
+				}
+				if len(parents) > 0 {
+					return nil, errors.Errorf("%s %s already has parents, one of them must consent", person.Name, person.Surname)
+				}
+				if err := addParent(tx, *self, *person); err != nil {
+					return nil, err
+				}
+			}
+		case ConsentActionJoinGroup:
+			g, err := GetGroup(*before.TargetID)
+			if err != nil {
+				return nil, errors.Errorf("group(%s) not found", *before.TargetID)
+			}
+			added, err := addGroupPerson(tx, g.Account.ID, g.ID, person.ID, false)
+			if err != nil {
+				return nil, err
+			}
+			if added {
+				joined = g
+			}
+		case ConsentActionMessage:
+		}
+	}
+	values := map[string]interface{}{
+		"id":           id,
+		"status":       status,
+		"user_id":      user.ID,
+		"time_decided": SqlTime(time.Now()),
+		"note":         nil,
+	}
+	if note != "" {
+		values["note"] = note
+	}
+	if _, err := tx.NamedExec(
+		"UPDATE consents SET status=:status,decided_by_user_id=:user_id,time_decided=:time_decided,note=:note WHERE id=:id",
+		values,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to update consent")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to decide consent")
+	}
+
+	after, err := getConsent(id)
+	if err != nil {
+		return nil, err
+	}
+	audit(ctx, "", "consents", id, string(status), before, after)
+	if joined != nil {
+		audit(ctx, joined.Account.ID, "group_members", joined.ID, "join", nil, map[string]interface{}{"person_id": person.ID, "by_user_id": user.ID})
+	}
+	return after, nil
+} //DecideConsent()
+
+//checkRegisterConsent fails until the guardian approved the registration of a minor
+func checkRegisterConsent(personID *string) error {
+	if personID == nil {
+		return nil
+	}
+	person, err := GetPerson(*personID)
+	if err != nil {
+		return err
+	}
+	if !person.needsConsent() {
+		return nil
+	}
+	consent, err := consentStatus(person.ID, ConsentActionRegister, nil)
+	if err != nil {
+		return err
+	}
+	if consent == nil || consent.Status != ConsentApproved {
+		return errors.Errorf("waiting for consent from your parent or guardian")
+	}
+	return nil
+}
+
+//checkMessageConsent fails until a guardian approved that a minor user may send messages
+func (u User) checkMessageConsent() error {
+	var personID *string
+	if err := db.Get(&personID, "SELECT person_id FROM users WHERE id=?", u.ID); err != nil {
+		return errors.Wrapf(err, "failed to get user")
+	}
+	if personID == nil {
+		return nil
+	}
+	person, err := GetPerson(*personID)
+	if err != nil {
+		return err
+	}
+	if !person.needsConsent() {
+		return nil
+	}
+	return requireConsent(context.Background(), u, *person, ConsentActionMessage, nil, nil)
+}
@@ -1,20 +1,31 @@
 package db
 
-import "github.com/go-msvc/errors"
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/go-msvc/errors"
+	"github.com/google/uuid"
+)
 
 type Country struct {
 	ID                     string  `json:"id" db:"id"`
 	Name                   string  `json:"name" db:"name"`
+	Code                   *string `json:"code,omitempty" db:"code" doc:"ISO 3166-1 alpha-2 code, e.g. ZA"`
+	Code3                  *string `json:"code3,omitempty" db:"code3" doc:"ISO 3166-1 alpha-3 code, e.g. ZAF"`
 	NationalIDRegexPattern *string `json:"national_id_regex_pattern,omitempty" db:"national_id_regex_pattern"`
 }
 
+const countryQuery = "select id,name,code,code3,national_id_regex_pattern from countries"
+
 func GetCountries(nameFilter string) ([]Country, error) {
 	var list []Country
 	if err := NamedSelect(
 		&list,
-		"select id,name from countries where name like :name_filter order by name",
+		countryQuery+" where name like :name_filter order by name",
 		map[string]interface{}{
-			"name_filter": "%" + nameFilter + "%",
+			"name_filter": likeContains(nameFilter),
 		}); err != nil {
 		return []Country{}, errors.Wrapf(err, "failed to get list of countries")
 	}
@@ -25,7 +36,7 @@ func GetCountryByID(id string) (*Country, error) {
 	country := Country{}
 	if err := NamedGet(
 		&country,
-		"select id,name,national_id_regex_pattern from countries where id=:id",
+		countryQuery+" where id=:id",
 		map[string]interface{}{
 			"id": id,
 		}); err != nil {
@@ -38,7 +49,7 @@ func GetCountryByName(name string) (*Country, error) {
 	country := Country{}
 	if err := NamedGet(
 		&country,
-		"select id,name,national_id_regex_pattern from countries where name=:name",
+		countryQuery+" where name=:name",
 		map[string]interface{}{
 			"name": name,
 		}); err != nil {
@@ -47,16 +58,340 @@ func GetCountryByName(name string) (*Country, error) {
 	return &country, nil
 }
 
+//GetCountryByCode finds a country by ISO 3166-1 alpha-2 or alpha-3 code
+func GetCountryByCode(code string) (*Country, error) {
+	country := Country{}
+	if err := NamedGet(
+		&country,
+		countryQuery+" where code=:code or code3=:code",
+		map[string]interface{}{
+			"code": strings.ToUpper(code),
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to get country by code(%s)", code)
+	}
+	return &country, nil
+}
+
+//FindCountry looks up a country by id, ISO code or name
+func FindCountry(s string) (*Country, error) {
+	if country, err := GetCountryByID(s); err == nil {
+		return country, nil
+	}
+	if len(s) == 2 || len(s) == 3 {
+		if country, err := GetCountryByCode(s); err == nil {
+			return country, nil
+		}
+	}
+	if country, err := GetCountryByName(s); err == nil {
+		return country, nil
+	}
+	return nil, errors.Errorf("unknown country(%s)", s)
+}
+
+type NewCountry struct {
+	Name                   string  `json:"name"`
+	Code                   *string `json:"code,omitempty" doc:"ISO 3166-1 alpha-2 code"`
+	Code3                  *string `json:"code3,omitempty" doc:"ISO 3166-1 alpha-3 code"`
+	NationalIDRegexPattern *string `json:"national_id_regex_pattern,omitempty" doc:"Regular expression that must match the whole national ID"`
+}
+
+func (nc NewCountry) Validate() error {
+	if nc.Name == "" {
+		return errors.Errorf("missing name")
+	}
+	return validateCountryCodes(nc.Code, nc.Code3, nc.NationalIDRegexPattern)
+}
+
+func validateCountryCodes(code, code3, pattern *string) error {
+	if code != nil && !countryCodeRegex.MatchString(*code) {
+		return errors.Errorf("code:\"%s\" is not 2 upper case letters", *code)
+	}
+	if code3 != nil && !countryCode3Regex.MatchString(*code3) {
+		return errors.Errorf("code3:\"%s\" is not 3 upper case letters", *code3)
+	}
+	if pattern != nil && *pattern != "" {
+		if _, err := regexp.Compile(*pattern); err != nil {
+			return errors.Wrapf(err, "invalid national_id_regex_pattern")
+		}
+	}
+	return nil
+}
+
+var (
+	countryCodeRegex  = regexp.MustCompile(`^[A-Z]{2}$`)
+	countryCode3Regex = regexp.MustCompile(`^[A-Z]{3}$`)
+)
+
+func AddCountry(ctx context.Context, by User, nc NewCountry) (*Country, error) {
+	if err := Authorize(by, PermSystemManage, "", ""); err != nil {
+		return nil, errors.Wrapf(err, "only sysadmin can add countries")
+	}
+	if err := nc.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid country")
+	}
+	id := uuid.New().String()
+	if _, err := db.NamedExec(
+		"INSERT INTO countries SET id=:id,name=:name,code=:code,code3=:code3,national_id_regex_pattern=:pattern",
+		map[string]interface{}{
+			"id":      id,
+			"name":    nc.Name,
+			"code":    nc.Code,
+			"code3":   nc.Code3,
+			"pattern": emptyToNil(nc.NationalIDRegexPattern),
+		},
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to add country (name and codes must be unique)")
+	}
+	country, err := GetCountryByID(id)
+	if err != nil {
+		return nil, err
+	}
+	audit(ctx, "", "countries", id, "create", nil, country)
+	return country, nil
+}
+
+type UpdCountryRequest struct {
+	Name                   *string `json:"name,omitempty"`
+	Code                   *string `json:"code,omitempty" doc:"ISO 3166-1 alpha-2 code, or \"\" to remove"`
+	Code3                  *string `json:"code3,omitempty" doc:"ISO 3166-1 alpha-3 code, or \"\" to remove"`
+	NationalIDRegexPattern *string `json:"national_id_regex_pattern,omitempty" doc:"Regular expression that must match the whole national ID, or \"\" to remove"`
+}
+
+func UpdCountry(ctx context.Context, by User, id string, req UpdCountryRequest) (*Country, error) {
+	if err := Authorize(by, PermSystemManage, "", ""); err != nil {
+		return nil, errors.Wrapf(err, "only sysadmin can update countries")
+	}
+	before, err := GetCountryByID(id)
+	if err != nil {
+		return nil, errors.Errorf("country(%s) not found", id)
+	}
+	if req.Name != nil && *req.Name == "" {
+		return nil, errors.Errorf("missing name")
+	}
+	if err := validateCountryCodes(emptyToNil(req.Code), emptyToNil(req.Code3), req.NationalIDRegexPattern); err != nil {
+		return nil, errors.Wrapf(err, "invalid country")
+	}
+	sets := []string{}
+	args := map[string]interface{}{"id": id}
+	if req.Name != nil {
+		sets = append(sets, "name=:name")
+		args["name"] = *req.Name
+	}
+	if req.Code != nil {
+		sets = append(sets, "code=:code")
+		args["code"] = emptyToNil(req.Code)
+	}
+	if req.Code3 != nil {
+		sets = append(sets, "code3=:code3")
+		args["code3"] = emptyToNil(req.Code3)
+	}
+	if req.NationalIDRegexPattern != nil {
+		sets = append(sets, "national_id_regex_pattern=:pattern")
+		args["pattern"] = emptyToNil(req.NationalIDRegexPattern)
+	}
+	if len(sets) == 0 {
+		return before, nil
+	}
+	if _, err := db.NamedExec("UPDATE countries SET "+strings.Join(sets, ",")+" WHERE id=:id", args); err != nil {
+		return nil, errors.Wrapf(err, "failed to update country (name and codes must be unique)")
+	}
+	after, err := GetCountryByID(id)
+	if err != nil {
+		return nil, err
+	}
+	audit(ctx, "", "countries", id, "update", before, after)
+	return after, nil
+}
+
+//DelCountry deletes a country with its regions,
+//but not while persons have that nationality or addresses are in its regions
+func DelCountry(ctx context.Context, by User, id string) error {
+	if err := Authorize(by, PermSystemManage, "", ""); err != nil {
+		return errors.Wrapf(err, "only sysadmin can delete countries")
+	}
+	before, err := GetCountryByID(id)
+	if err != nil {
+		return errors.Errorf("country(%s) not found", id)
+	}
+	var nr int
+	if err := db.Get(&nr, "SELECT COUNT(*) FROM person_nationalities WHERE country_id=?", id); err != nil {
+		return errors.Wrapf(err, "failed to count nationalities")
+	}
+	if nr > 0 {
+		return errors.Errorf("country(%s) is the nationality of %d persons", before.Name, nr)
+	}
+	if err := db.Get(&nr, "SELECT COUNT(*) FROM addresses WHERE region_id IN (SELECT id FROM regions WHERE country_id=?)", id); err != nil {
+		return errors.Wrapf(err, "failed to count addresses")
+	}
+	if nr > 0 {
+		return errors.Errorf("country(%s) has %d addresses", before.Name, nr)
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM regions WHERE country_id=?", id); err != nil {
+		return errors.Wrapf(err, "failed to delete regions")
+	}
+	if _, err := tx.Exec("DELETE FROM countries WHERE id=?", id); err != nil {
+		return errors.Wrapf(err, "failed to delete country")
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrapf(err, "failed to delete country")
+	}
+	audit(ctx, "", "countries", id, "delete", before, nil)
+	return nil
+}
+
 type Region struct {
-	Country *Country `json:"country"`
-	Name    string   `json:"name"`
-	Code    string   `json:"code"`
+	ID      string   `json:"id" db:"id"`
+	Country *Country `json:"country,omitempty"`
+	Name    string   `json:"name" db:"name"`
+	Code    string   `json:"code" db:"code" doc:"ISO 3166-2 subdivision code without the country prefix, e.g. GP for ZA-GP"`
 }
 
 func CountryRegions(countryID string, nameFilter string) ([]Region, error) {
 	var list []Region
-	if err := NamedSelect(&list, "select id,name from regions where country_id=? and name like ? order by name", nameFilter); err != nil {
+	if err := NamedSelect(
+		&list,
+		"select id,name,code from regions where country_id=:country_id and name like :name_filter order by name",
+		map[string]interface{}{
+			"country_id":  countryID,
+			"name_filter": likeContains(nameFilter),
+		}); err != nil {
 		return []Region{}, errors.Wrapf(err, "failed to get list of regions")
 	}
 	return list, nil
 }
+
+//GetRegion returns the region with its country
+func GetRegion(id string) (*Region, error) {
+	var row struct {
+		Region
+		CountryID string `db:"country_id"`
+	}
+	if err := NamedGet(
+		&row,
+		"select id,country_id,name,code from regions where id=:id",
+		map[string]interface{}{
+			"id": id,
+		}); err != nil {
+		return nil, errors.Wrapf(err, "failed to get region by id(%s)", id)
+	}
+	country, err := GetCountryByID(row.CountryID)
+	if err != nil {
+		return nil, err
+	}
+	region := row.Region
+	region.Country = country
+	return &region, nil
+}
+
+type NewRegion struct {
+	Name string `json:"name"`
+	Code string `json:"code" doc:"Unique in the country, e.g. GP"`
+}
+
+func (nr NewRegion) Validate() error {
+	if nr.Name == "" {
+		return errors.Errorf("missing name")
+	}
+	if nr.Code == "" {
+		return errors.Errorf("missing code")
+	}
+	if len(nr.Code) > 10 {
+		return errors.Errorf("code:\"%s\" is longer than 10", nr.Code)
+	}
+	return nil
+}
+
+func AddRegion(ctx context.Context, by User, countryID string, nr NewRegion) (*Region, error) {
+	if err := Authorize(by, PermSystemManage, "", ""); err != nil {
+		return nil, errors.Wrapf(err, "only sysadmin can add regions")
+	}
+	if _, err := GetCountryByID(countryID); err != nil {
+		return nil, errors.Errorf("country(%s) not found", countryID)
+	}
+	if err := nr.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid region")
+	}
+	id := uuid.New().String()
+	if _, err := db.NamedExec(
+		"INSERT INTO regions SET id=:id,country_id=:country_id,name=:name,code=:code",
+		map[string]interface{}{
+			"id":         id,
+			"country_id": countryID,
+			"name":       nr.Name,
+			"code":       nr.Code,
+		},
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to add region (name and code must be unique in the country)")
+	}
+	region, err := GetRegion(id)
+	if err != nil {
+		return nil, err
+	}
+	audit(ctx, "", "regions", id, "create", nil, region)
+	return region, nil
+}
+
+func UpdRegion(ctx context.Context, by User, id string, nr NewRegion) (*Region, error) {
+	if err := Authorize(by, PermSystemManage, "", ""); err != nil {
+		return nil, errors.Wrapf(err, "only sysadmin can update regions")
+	}
+	before, err := GetRegion(id)
+	if err != nil {
+		return nil, errors.Errorf("region(%s) not found", id)
+	}
+	if err := nr.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid region")
+	}
+	if _, err := db.NamedExec(
+		"UPDATE regions SET name=:name,code=:code WHERE id=:id",
+		map[string]interface{}{
+			"id":   id,
+			"name": nr.Name,
+			"code": nr.Code,
+		},
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to update region (name and code must be unique in the country)")
+	}
+	after, err := GetRegion(id)
+	if err != nil {
+		return nil, err
+	}
+	audit(ctx, "", "regions", id, "update", before, after)
+	return after, nil
+}
+
+//DelRegion deletes a region that is not used in addresses
+func DelRegion(ctx context.Context, by User, id string) error {
+	if err := Authorize(by, PermSystemManage, "", ""); err != nil {
+		return errors.Wrapf(err, "only sysadmin can delete regions")
+	}
+	before, err := GetRegion(id)
+	if err != nil {
+		return errors.Errorf("region(%s) not found", id)
+	}
+	var nr int
+	if err := db.Get(&nr, "SELECT COUNT(*) FROM addresses WHERE region_id=?", id); err != nil {
+		return errors.Wrapf(err, "failed to count addresses")
+	}
+	if nr > 0 {
+		return errors.Errorf("region(%s) has %d addresses", before.Name, nr)
+	}
+	if _, err := db.Exec("DELETE FROM regions WHERE id=?", id); err != nil {
+		return errors.Wrapf(err, "failed to delete region")
+	}
+	audit(ctx, "", "regions", id, "delete", before, nil)
+	return nil
+}
+
+//emptyToNil stores "" as NULL
+func emptyToNil(s *string) *string {
+	if s == nil || *s == "" {
+		return nil
+	}
+	return s
+}
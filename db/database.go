@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -231,12 +232,15 @@ func FilteredSelect(list interface{}, selectSQL string, filter map[string]interf
 	for n, v := range filter {
 		log.Debugf("filter(%s)=\"%s\"", n, v)
 		if s, ok := v.(string); ok && strings.HasPrefix(s, "*") {
-			filterQuery = append(filterQuery, fmt.Sprintf("%s like %%:%s%%", n, n))
+			filterQuery = append(filterQuery, fmt.Sprintf("%s like :%s", n, n))
+			filterArgs[n] = likeContains(strings.TrimPrefix(s, "*"))
 		} else {
 			filterQuery = append(filterQuery, fmt.Sprintf("%s=:%s", n, n))
+			filterArgs[n] = v
 		}
-		filterArgs[n] = v
 	}
+	//map iteration order differs, sort to compile the same statement each time
+	sort.Strings(filterQuery)
 
 	query := selectSQL
 	for i, f := range filterQuery {
@@ -250,6 +254,12 @@ func FilteredSelect(list interface{}, selectSQL string, filter map[string]interf
 	return NamedSelect(list, query, filterArgs)
 } //FilteredSelect()
 
+//likeContains is a LIKE pattern matching s anywhere, with wildcards in s escaped
+func likeContains(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+	return "%" + s + "%"
+}
+
 func mapValues(z interface{}) map[string]interface{} {
 	v := map[string]interface{}{}
 	t := reflect.TypeOf(z)
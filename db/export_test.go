@@ -0,0 +1,13 @@
+package db
+
+import "time"
+
+//internal functions used by the tests in package db_test
+var (
+	ImportColumns       = importColumns
+	ImportPerson        = importPerson
+	PublicIP            = publicIP
+	ValidateFieldValues = validateFieldValues
+)
+
+func PersonAge(p Person, at time.Time) int { return p.age(at) }
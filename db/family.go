@@ -0,0 +1,277 @@
+package db
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/jmoiron/sqlx"
+)
+
+//FamilyRelation is how a family member is related to the user's own person
+type FamilyRelation string
+
+const (
+	FamilyRelationChild  FamilyRelation = "child"
+	FamilyRelationSpouse FamilyRelation = "spouse"
+	FamilyRelationParent FamilyRelation = "parent"
+)
+
+var (
+	//parents must be at least this much older than their children
+	familyMinParentAge = intDefault(os.Getenv("FAMILY_MIN_PARENT_AGE"), 12)
+	//children younger than this are dependants, on whose behalf their parents may act
+	familyAdultAge = intDefault(os.Getenv("FAMILY_ADULT_AGE"), 18)
+)
+
+type AddFamilyMemberRequest struct {
+	Relation FamilyRelation `json:"relation" doc:"child|spouse|parent"`
+	Person   Person         `json:"person" doc:"Created, or if a person with the same name, surname, dob and gender exists, linked after the person, a parent or a group admin approves"`
+}
+
+//AddFamilyMember is called by a logged in user to add a child or spouse or own parent
+//to the user's person profile
+func AddFamilyMember(ctx context.Context, user User, req AddFamilyMemberRequest) (*Person, error) {
+	self, err := userPerson(user)
+	if err != nil {
+		return nil, err
+	}
+	switch req.Relation {
+	case FamilyRelationChild, FamilyRelationSpouse, FamilyRelationParent:
+	default:
+		return nil, errors.Errorf("relation:\"%s\" is not child|spouse|parent", req.Relation)
+	}
+	//children do not always have their own email and phone, then use the user's
+	if req.Person.Email == nil || *req.Person.Email == "" {
+		req.Person.Email = self.Email
+	}
+	if req.Person.Phone == nil || *req.Person.Phone == "" {
+		req.Person.Phone = self.Phone
+	}
+	if err := req.Person.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid person")
+	}
+
+	//check before creating the person, then link in one transaction
+	member := req.Person
+	if member.ID, err = findPerson(db, member); err == nil && member.ID == self.ID {
+		return nil, errors.Errorf("cannot add yourself to your family")
+	}
+	if member.ID != "" {
+		//an existing person is not linked until the person, a parent or a group admin approves
+		approval, err := familyApprovalRequired(db, member.ID, self.ID)
+		if err != nil {
+			return nil, err
+		}
+		if approval {
+			return nil, requestFamilyLink(ctx, user, *self, member.ID, req.Relation)
+		}
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	created := false
+	if member.ID == "" {
+		if err := addPerson(tx, &member); err != nil {
+			return nil, err
+		}
+		created = true
+	}
+	if err := linkFamily(tx, req.Relation, *self, member); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to add family member")
+	}
+	if created {
+		audit(ctx, "", "persons", member.ID, "create", nil, member)
+	}
+	audit(ctx, "", "persons", self.ID, "add_"+string(req.Relation), nil, member)
+	return GetPerson(member.ID)
+} //AddFamilyMember()
+
+//linkFamily links the member to the person, relation is what the member is to the person
+func linkFamily(tx *sqlx.Tx, relation FamilyRelation, person Person, member Person) error {
+	switch relation {
+	case FamilyRelationChild:
+		return addParent(tx, person, member)
+	case FamilyRelationParent:
+		return addParent(tx, member, person)
+	case FamilyRelationSpouse:
+		return addSpouse(tx, person, member)
+	}
+	return errors.Errorf("relation:\"%s\" is not child|spouse|parent", relation)
+}
+
+//addParent links parent and child after checking their ages and that it does not make a cycle
+func addParent(tx *sqlx.Tx, parent Person, child Person) error {
+	if parent.Dob == nil || child.Dob == nil ||
+		time.Time(*child.Dob).Before(time.Time(*parent.Dob).AddDate(familyMinParentAge, 0, 0)) {
+		return errors.Errorf("parent must be at least %d years older than child", familyMinParentAge)
+	}
+	//the child may not already be an ancestor of the parent
+	var nr int
+	if err := tx.Get(
+		&nr,
+		"WITH RECURSIVE ancestors(id) AS ("+
+			"SELECT person_id_of_parent FROM person_parents WHERE person_id_of_child=?"+
+			" UNION SELECT p.person_id_of_parent FROM person_parents as p INNER JOIN ancestors as a ON p.person_id_of_child=a.id"+
+			") SELECT COUNT(*) FROM ancestors WHERE id=?",
+		parent.ID,
+		child.ID,
+	); err != nil {
+		return errors.Wrapf(err, "failed to check ancestors")
+	}
+	if nr > 0 {
+		return errors.Errorf("%s %s is an ancestor of %s %s", child.Name, child.Surname, parent.Name, parent.Surname)
+	}
+	if err := tx.Get(
+		&nr,
+		"SELECT COUNT(*) FROM person_spouses WHERE (person_id_a=? AND person_id_b=?) OR (person_id_a=? AND person_id_b=?)",
+		parent.ID, child.ID, child.ID, parent.ID,
+	); err != nil {
+		return errors.Wrapf(err, "failed to check spouses")
+	}
+	if nr > 0 {
+		return errors.Errorf("spouses cannot be parent and child")
+	}
+	if _, err := tx.Exec(
+		"INSERT IGNORE INTO person_parents SET person_id_of_parent=?,person_id_of_child=?",
+		parent.ID,
+		child.ID,
+	); err != nil {
+		return errors.Wrapf(err, "failed to link parent and child")
+	}
+	return nil
+}
+
+//addSpouse links two persons who are not parent and child of each other
+func addSpouse(tx *sqlx.Tx, a Person, b Person) error {
+	var nr int
+	if err := tx.Get(
+		&nr,
+		"SELECT COUNT(*) FROM person_parents WHERE (person_id_of_parent=? AND person_id_of_child=?) OR (person_id_of_parent=? AND person_id_of_child=?)",
+		a.ID, b.ID, b.ID, a.ID,
+	); err != nil {
+		return errors.Wrapf(err, "failed to check parents")
+	}
+	if nr > 0 {
+		return errors.Errorf("parent and child cannot be spouses")
+	}
+	if a.age(time.Now()) < familyAdultAge || b.age(time.Now()) < familyAdultAge {
+		return errors.Errorf("spouses must be at least %d years old", familyAdultAge)
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO person_spouses (person_id_a,person_id_b)"+
+			" SELECT ?,? FROM DUAL WHERE NOT EXISTS (SELECT 1 FROM person_spouses WHERE person_id_a=? AND person_id_b=?)",
+		a.ID, b.ID, b.ID, a.ID,
+	); err != nil {
+		return errors.Wrapf(err, "failed to link spouses")
+	}
+	return nil
+}
+
+//userPerson returns the user's own person with relations
+//(the session user does not have the person loaded)
+func userPerson(user User) (*Person, error) {
+	var personID *string
+	if err := db.Get(&personID, "SELECT person_id FROM users WHERE id=?", user.ID); err != nil {
+		return nil, errors.Wrapf(err, "failed to get user")
+	}
+	if personID == nil {
+		return nil, errors.Errorf("user has no person profile")
+	}
+	person, err := GetPerson(*personID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get user person")
+	}
+	return person, nil
+}
+
+//age in completed years, 0 if dob is unknown
+func (p Person) age(at time.Time) int {
+	if p.Dob == nil {
+		return 0
+	}
+	dob := time.Time(*p.Dob)
+	years := at.Year() - dob.Year()
+	if at.Month() < dob.Month() || (at.Month() == dob.Month() && at.Day() < dob.Day()) {
+		years--
+	}
+	return years
+}
+
+//Household is the user's person with parents, spouses, children and the dependants
+//on whose behalf the user may act
+type Household struct {
+	Person     *Person   `json:"person"`
+	Dependants []*Person `json:"dependants,omitempty" doc:"Children younger than the adult age"`
+}
+
+func GetHousehold(user User) (*Household, error) {
+	self, err := userPerson(user)
+	if err != nil {
+		return nil, err
+	}
+	h := Household{Person: self}
+	for _, child := range self.Children {
+		if child.age(time.Now()) < familyAdultAge {
+			h.Dependants = append(h.Dependants, child)
+		}
+	}
+	return &h, nil
+}
+
+//ActFor returns the person if it is the user's own person or one of the user's dependants
+func ActFor(user User, personID string) (*Person, error) {
+	self, err := userPerson(user)
+	if err != nil {
+		return nil, err
+	}
+	if personID == "" || personID == self.ID {
+		return self, nil
+	}
+	for _, d := range self.Children {
+		if d.ID == personID && d.age(time.Now()) < familyAdultAge {
+			return d, nil
+		}
+	}
+	return nil, errors.Errorf("person(%s) is not your dependant", personID)
+}
+
+//JoinGroup requests membership of the group for the user or one of the user's dependants,
+//the membership is pending until accepted by a group admin
+func JoinGroup(ctx context.Context, user User, groupID string, personID string) (*Person, error) {
+	person, err := ActFor(user, personID)
+	if err != nil {
+		return nil, err
+	}
+	g, err := GetGroup(groupID)
+	if err != nil || (g.Invitation != nil && *g.Invitation) {
+		return nil, errors.Errorf("group(%s) not found", groupID)
+	}
+	//minors joining by themselves need a guardian to consent, guardians acting for them do not
+	if person.needsConsent() {
+		self, err := userPerson(user)
+		if err != nil {
+			return nil, err
+		}
+		if self.ID == person.ID {
+			if err := requireConsent(ctx, user, *person, ConsentActionJoinGroup, &g.ID, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	added, err := addGroupPerson(db, g.Account.ID, g.ID, person.ID, false)
+	if err != nil {
+		return nil, err
+	}
+	if !added {
+		return nil, errors.Errorf("%s %s is already a member of %s", person.Name, person.Surname, g.Name)
+	}
+	audit(ctx, g.Account.ID, "group_members", g.ID, "join", nil, map[string]interface{}{"person_id": person.ID, "by_user_id": user.ID})
+	return person, nil
+}
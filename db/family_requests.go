@@ -0,0 +1,241 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+//FamilyRequest asks to link an existing person to the family of the user who asked,
+//the person's own user, one of the person's parents or an admin of the person's groups must approve
+type FamilyRequest struct {
+	ID                  string         `json:"id" db:"id"`
+	PersonID            string         `json:"person_id" db:"person_id"`
+	Relation            FamilyRelation `json:"relation" db:"relation" doc:"What the person will be to the person who asked"`
+	RequestedByPersonID string         `json:"requested_by_person_id" db:"requested_by_person_id"`
+	RequestedBy         *Person        `json:"requested_by,omitempty"`
+	RequestedByUserID   string         `json:"requested_by_user_id" db:"requested_by_user_id"`
+	TimeRequested       SqlTime        `json:"time_requested" db:"time_requested"`
+	Status              ConsentStatus  `json:"status" db:"status"`
+	DecidedByUserID     *string        `json:"decided_by_user_id,omitempty" db:"decided_by_user_id"`
+	TimeDecided         *SqlTime       `json:"time_decided,omitempty" db:"time_decided"`
+}
+
+const familyRequestQuery = "SELECT id,person_id,relation,requested_by_person_id,requested_by_user_id,time_requested,status,decided_by_user_id,time_decided FROM family_requests"
+
+//FamilyRequestPendingError is returned when the family member waits for approval
+type FamilyRequestPendingError struct {
+	Request FamilyRequest
+}
+
+func (e FamilyRequestPendingError) Error() string {
+	return fmt.Sprintf("adding your %s waits for approval, request(%s) is %s", e.Request.Relation, e.Request.ID, e.Request.Status)
+}
+
+//familyApprovalRequired is true for every existing person, unless the person who asks is already a parent,
+//anybody who knows a person's name, surname, dob and gender could otherwise claim the person as family
+func familyApprovalRequired(q sqlx.Queryer, personID string, byPersonID string) (bool, error) {
+	var nr int
+	if err := sqlx.Get(
+		q,
+		&nr,
+		"SELECT COUNT(*) FROM person_parents WHERE person_id_of_child=? AND person_id_of_parent=?",
+		personID, byPersonID,
+	); err != nil {
+		return false, errors.Wrapf(err, "failed to check family of person")
+	}
+	return nr == 0, nil
+}
+
+//canDecideFamilyRequest allows the person's own user, an adult parent and admins who manage
+//the members of a group that the person belongs to (or sysadmin), but never the user who asked
+func canDecideFamilyRequest(user User, r FamilyRequest) error {
+	if user.ID == r.RequestedByUserID {
+		return errors.Errorf("you cannot decide your own family request(%s)", r.ID)
+	}
+	if self, err := userPerson(user); err == nil {
+		if self.ID == r.PersonID {
+			return nil
+		}
+		guardians, err := guardianIDs(db, r.PersonID)
+		if err != nil {
+			return err
+		}
+		for _, g := range guardians {
+			if g == self.ID && g != r.RequestedByPersonID {
+				return nil
+			}
+		}
+	}
+	if Authorize(user, PermSystemManage, "", "") == nil {
+		return nil
+	}
+	var groups []struct {
+		ID        string `db:"id"`
+		AccountID string `db:"account_id"`
+	}
+	if err := db.Select(
+		&groups,
+		"SELECT g.id,g.account_id FROM groups as g INNER JOIN group_members as m ON m.group_id=g.id WHERE m.person_id=? AND m.accepted=true",
+		r.PersonID,
+	); err != nil {
+		return errors.Wrapf(err, "failed to get groups of person")
+	}
+	for _, g := range groups {
+		if Authorize(user, PermMembersManage, g.AccountID, g.ID) == nil {
+			return nil
+		}
+	}
+	return errors.Errorf("family request(%s) is not for you to decide", r.ID)
+}
+
+//requestFamilyLink creates the request (unless already pending) and returns FamilyRequestPendingError
+func requestFamilyLink(ctx context.Context, user User, self Person, personID string, relation FamilyRelation) error {
+	var list []FamilyRequest
+	if err := db.Select(
+		&list,
+		familyRequestQuery+" WHERE person_id=? AND relation=? AND requested_by_person_id=? AND status=?",
+		personID, relation, self.ID, ConsentPending,
+	); err != nil {
+		return errors.Wrapf(err, "failed to get family requests")
+	}
+	if len(list) > 0 {
+		return FamilyRequestPendingError{Request: list[0]}
+	}
+	id := uuid.New().String()
+	if _, err := db.NamedExec(
+		"INSERT INTO family_requests SET id=:id,person_id=:person_id,relation=:relation,requested_by_person_id=:by_person_id,"+
+			"requested_by_user_id=:user_id,time_requested=:time_requested,status=:status",
+		map[string]interface{}{
+			"id":             id,
+			"person_id":      personID,
+			"relation":       relation,
+			"by_person_id":   self.ID,
+			"user_id":        user.ID,
+			"time_requested": SqlTime(time.Now()),
+			"status":         ConsentPending,
+		},
+	); err != nil {
+		return errors.Wrapf(err, "failed to request family link")
+	}
+	request, err := getFamilyRequest(id)
+	if err != nil {
+		return err
+	}
+	audit(ctx, "", "family_requests", id, "request", nil, request)
+	return FamilyRequestPendingError{Request: *request}
+}
+
+func getFamilyRequest(id string) (*FamilyRequest, error) {
+	var r FamilyRequest
+	if err := NamedGet(&r, familyRequestQuery+" WHERE id=:id", map[string]interface{}{"id": id}); err != nil {
+		return nil, errors.Errorf("family request(%s) not found", id)
+	}
+	return &r, nil
+}
+
+//GetFamilyRequests lists the requests to link the user's person or the user's children to another family,
+//and for admins, to link members of the account's groups (sysadmin sees all)
+func GetFamilyRequests(user User, status ConsentStatus) ([]FamilyRequest, error) {
+	selfID := ""
+	if self, err := userPerson(user); err == nil {
+		selfID = self.ID
+	}
+	accountID := ""
+	if user.Account != nil {
+		accountID = user.Account.ID
+	}
+	query := familyRequestQuery + " WHERE status=:status"
+	if Authorize(user, PermSystemManage, "", "") != nil {
+		query += " AND (person_id=:self_id" +
+			" OR person_id IN (SELECT person_id_of_child FROM person_parents WHERE person_id_of_parent=:self_id)" +
+			" OR person_id IN (SELECT m.person_id FROM group_members as m INNER JOIN groups as g ON g.id=m.group_id WHERE g.account_id=:account_id AND m.accepted=true))"
+	}
+	var candidates []FamilyRequest
+	if err := NamedSelect(
+		&candidates,
+		query+" ORDER BY time_requested",
+		map[string]interface{}{
+			"status":     status,
+			"self_id":    selfID,
+			"account_id": accountID,
+		},
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get family requests")
+	}
+	list := []FamilyRequest{}
+	for _, r := range candidates {
+		if canDecideFamilyRequest(user, r) != nil {
+			continue
+		}
+		var err error
+		if r.RequestedBy, err = GetPerson(r.RequestedByPersonID); err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+	return list, nil
+}
+
+//DecideFamilyRequest lets the person, an adult parent of the person or an admin of the person's groups
+//approve or decline, approving links the person to the family of the person who asked
+func DecideFamilyRequest(ctx context.Context, user User, id string, approve bool) (*FamilyRequest, error) {
+	before, err := getFamilyRequest(id)
+	if err != nil {
+		return nil, err
+	}
+	if before.Status != ConsentPending {
+		return nil, errors.Errorf("family request(%s) is already %s", id, before.Status)
+	}
+	if err := canDecideFamilyRequest(user, *before); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	status := ConsentDeclined
+	if approve {
+		status = ConsentApproved
+		person, err := GetPerson(before.RequestedByPersonID)
+		if err != nil {
+			return nil, err
+		}
+		member, err := GetPerson(before.PersonID)
+		if err != nil {
+			return nil, err
+		}
+		if err := linkFamily(tx, before.Relation, *person, *member); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.NamedExec(
+		"UPDATE family_requests SET status=:status,decided_by_user_id=:user_id,time_decided=:time_decided WHERE id=:id",
+		map[string]interface{}{
+			"id":           id,
+			"status":       status,
+			"user_id":      user.ID,
+			"time_decided": SqlTime(time.Now()),
+		},
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to update family request")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to decide family request")
+	}
+	after, err := getFamilyRequest(id)
+	if err != nil {
+		return nil, err
+	}
+	audit(ctx, "", "family_requests", id, string(status), before, after)
+	if approve {
+		audit(ctx, "", "persons", before.RequestedByPersonID, "add_"+string(before.Relation), nil, map[string]interface{}{"person_id": before.PersonID})
+	}
+	return after, nil
+} //DecideFamilyRequest()
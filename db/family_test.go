@@ -0,0 +1,38 @@
+package db_test
+
+import (
+	"testing"
+	"time"
+
+	"bitbucket.org/vservices/hotseat/db"
+)
+
+func TestPersonAge(t *testing.T) {
+	date := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		dob time.Time
+		at  time.Time
+		age int
+	}{
+		{date(2008, 6, 15), date(2026, 6, 14), 17}, //day before birthday
+		{date(2008, 6, 15), date(2026, 6, 15), 18}, //on birthday
+		{date(2008, 6, 15), date(2026, 5, 31), 17}, //month before birthday
+		{date(2008, 6, 15), date(2026, 12, 31), 18},
+		{date(2008, 6, 15), date(2008, 6, 15), 0},  //born today
+		{date(2008, 2, 29), date(2026, 2, 28), 17}, //leap day birthday only counts from 1 March in other years
+		{date(2008, 2, 29), date(2026, 3, 1), 18},
+		{date(2008, 2, 29), date(2028, 2, 28), 19},
+		{date(2008, 2, 29), date(2028, 2, 29), 20},
+	}
+	for i, test := range tests {
+		dob := db.SqlDate(test.dob)
+		if age := db.PersonAge(db.Person{Dob: &dob}, test.at); age == test.age {
+			t.Logf("[%3d] OK dob %s at %s is %d", i, test.dob.Format("2006-01-02"), test.at.Format("2006-01-02"), age)
+		} else {
+			t.Errorf("[%3d] ERROR dob %s at %s is %d, expected %d", i, test.dob.Format("2006-01-02"), test.at.Format("2006-01-02"), age, test.age)
+		}
+	}
+	if age := db.PersonAge(db.Person{}, date(2026, 1, 1)); age != 0 {
+		t.Errorf("ERROR age without dob is %d, expected 0", age)
+	}
+}
@@ -0,0 +1,347 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-msvc/errors"
+)
+
+type GroupApplicationStatus string
+
+const (
+	GroupApplicationPending  GroupApplicationStatus = "pending"
+	GroupApplicationAccepted GroupApplicationStatus = "accepted"
+	GroupApplicationRejected GroupApplicationStatus = "rejected"
+)
+
+//GroupApplication is a group_members row with the field values submitted to join the group
+type GroupApplication struct {
+	GroupID          string                 `json:"group_id" db:"group_id"`
+	PersonID         string                 `json:"person_id" db:"person_id"`
+	Person           *Person                `json:"person,omitempty"`
+	Values           map[string]interface{} `json:"values,omitempty" doc:"Values of the group fields"`
+	FieldValues      *string                `json:"-" db:"field_values"`
+	AppliedByUserID  *string                `json:"applied_by_user_id,omitempty" db:"applied_by_user_id"`
+	TimeCreated      SqlTime                `json:"time_created" db:"time_created"`
+	TimeUpdated      SqlTime                `json:"time_updated" db:"time_updated"`
+	Accepted         bool                   `json:"accepted" db:"accepted"`
+	Rejected         *string                `json:"rejected,omitempty" db:"rejected" doc:"Reason when rejected"`
+	ReviewedByUserID *string                `json:"reviewed_by_user_id,omitempty" db:"reviewed_by_user_id"`
+	TimeReviewed     *SqlTime               `json:"time_reviewed,omitempty" db:"time_reviewed"`
+}
+
+const groupApplicationQuery = "SELECT group_id,person_id,field_values,applied_by_user_id,time_created,time_updated,accepted,rejected,reviewed_by_user_id,time_reviewed FROM group_members"
+
+func (a *GroupApplication) load() error {
+	if a.FieldValues != nil {
+		if err := json.Unmarshal([]byte(*a.FieldValues), &a.Values); err != nil {
+			return errors.Wrapf(err, "invalid field values of person(%s) in group(%s)", a.PersonID, a.GroupID)
+		}
+	}
+	var err error
+	if a.Person, err = GetPerson(a.PersonID); err != nil {
+		return err
+	}
+	return nil
+}
+
+type GroupApplicationRequest struct {
+	PersonID string                 `json:"person_id,omitempty" doc:"Yourself if not specified, else one of your dependants"`
+	Values   map[string]interface{} `json:"values" doc:"Value for each field of the group and its parent groups, see GET /group/{group_id}/fields?include_parent_fields=true"`
+}
+
+//validateFieldValues checks that there is a value of the right type for each field and no other values
+func validateFieldValues(fields []Field, values map[string]interface{}) error {
+	known := map[string]bool{}
+	for _, f := range fields {
+		known[f.Name] = true
+		v, ok := values[f.Name]
+		if !ok || v == nil {
+			return errors.Errorf("missing value for field \"%s\"", f.Name)
+		}
+		if err := validateFieldValue(f.Type, v); err != nil {
+			return errors.Wrapf(err, "invalid value for field \"%s\"", f.Name)
+		}
+	}
+	for n := range values {
+		if !known[n] {
+			return errors.Errorf("unknown field \"%s\"", n)
+		}
+	}
+	return nil
+}
+
+//validateFieldValue checks the JSON value against the field type,
+//types not known here only need a value that is not empty
+func validateFieldValue(fieldType string, v interface{}) error {
+	switch strings.ToLower(fieldType) {
+	case "date":
+		s, ok := v.(string)
+		if !ok {
+			return errors.Errorf("expecting a date string")
+		}
+		if _, err := time.Parse("2006-01-02", s); err != nil {
+			return errors.Errorf("\"%s\" is not CCYY-MM-DD", s)
+		}
+	case "number", "int", "integer", "amount":
+		switch n := v.(type) {
+		case float64:
+		case string:
+			if _, err := strconv.ParseFloat(n, 64); err != nil {
+				return errors.Errorf("\"%s\" is not a number", n)
+			}
+		default:
+			return errors.Errorf("expecting a number")
+		}
+	case "bool", "boolean":
+		if _, ok := v.(bool); !ok {
+			return errors.Errorf("expecting true|false")
+		}
+	default:
+		s, ok := v.(string)
+		if !ok {
+			return nil
+		}
+		if strings.TrimSpace(s) == "" {
+			return errors.Errorf("empty value")
+		}
+	}
+	return nil
+}
+
+//ApplyToGroup submits the field values of the group and its parent groups to join the group
+//for the user or one of the user's dependants, the membership is pending until reviewed.
+//A pending or rejected application is replaced, e.g. after fields were corrected.
+func ApplyToGroup(ctx context.Context, user User, groupID string, req GroupApplicationRequest) (*GroupApplication, error) {
+	person, err := ActFor(user, req.PersonID)
+	if err != nil {
+		return nil, err
+	}
+	g, err := GetGroup(groupID)
+	if err != nil || (g.Invitation != nil && *g.Invitation) {
+		return nil, errors.Errorf("group(%s) not found", groupID)
+	}
+	fields, err := GetGroupFields(g.ID, true)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get group fields")
+	}
+	if req.Values == nil {
+		req.Values = map[string]interface{}{}
+	}
+	if err := validateFieldValues(fields, req.Values); err != nil {
+		return nil, errors.Wrapf(err, "invalid values")
+	}
+	//minors applying by themselves need a guardian to consent, as when joining
+	if person.needsConsent() {
+		self, err := userPerson(user)
+		if err != nil {
+			return nil, err
+		}
+		if self.ID == person.ID {
+			if err := requireConsent(ctx, user, *person, ConsentActionJoinGroup, &g.ID, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	jsonValues, err := json.Marshal(req.Values)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode values")
+	}
+
+	before, _ := getGroupApplication(g.ID, person.ID)
+	if before != nil && before.Accepted {
+		return nil, errors.Errorf("%s %s is already a member of %s", person.Name, person.Surname, g.Name)
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	if _, err := addGroupPerson(tx, g.Account.ID, g.ID, person.ID, false); err != nil {
+		return nil, err
+	}
+	if _, err := tx.NamedExec(
+		"UPDATE group_members SET field_values=:field_values,applied_by_user_id=:user_id,time_updated=now(),"+
+			"rejected=NULL,reviewed_by_user_id=NULL,time_reviewed=NULL"+
+			" WHERE group_id=:group_id AND person_id=:person_id AND accepted=false",
+		map[string]interface{}{
+			"group_id":     g.ID,
+			"person_id":    person.ID,
+			"field_values": string(jsonValues),
+			"user_id":      user.ID,
+		},
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to store application")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to apply to group")
+	}
+
+	after, err := getGroupApplication(g.ID, person.ID)
+	if err != nil {
+		return nil, err
+	}
+	audit(ctx, g.Account.ID, "group_members", g.ID, "apply", before, after)
+	notifyGroupApplication(user, *g, *person)
+	return after, nil
+} //ApplyToGroup()
+
+func getGroupApplication(groupID string, personID string) (*GroupApplication, error) {
+	var a GroupApplication
+	if err := NamedGet(
+		&a,
+		groupApplicationQuery+" WHERE group_id=:group_id AND person_id=:person_id",
+		map[string]interface{}{
+			"group_id":  groupID,
+			"person_id": personID,
+		},
+	); err != nil {
+		return nil, errors.Errorf("person(%s) did not apply to group(%s)", personID, groupID)
+	}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+//GetGroupApplications is the review queue of the group, oldest first
+func GetGroupApplications(user User, groupID string, status GroupApplicationStatus) ([]GroupApplication, error) {
+	g, err := GetGroup(groupID)
+	if err != nil {
+		return nil, errors.Errorf("group(%s) not found", groupID)
+	}
+	if err := Authorize(user, PermMembersRead, g.Account.ID, g.ID); err != nil {
+		return nil, errors.Wrapf(err, "cannot list group applications")
+	}
+	var where string
+	switch status {
+	case GroupApplicationPending:
+		where = "accepted=false AND rejected IS NULL"
+	case GroupApplicationAccepted:
+		where = "accepted=true"
+	case GroupApplicationRejected:
+		where = "rejected IS NOT NULL"
+	default:
+		return nil, errors.Errorf("status:\"%s\" is not pending|accepted|rejected", status)
+	}
+	list := []GroupApplication{}
+	if err := NamedSelect(
+		&list,
+		groupApplicationQuery+" WHERE group_id=:group_id AND "+where+" ORDER BY time_updated",
+		map[string]interface{}{"group_id": g.ID},
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get group applications")
+	}
+	for i := range list {
+		if err := list[i].load(); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+//ReviewGroupApplication accepts or rejects a pending application and notifies the applicant,
+//a reason is required to reject
+func ReviewGroupApplication(ctx context.Context, user User, groupID string, personID string, accept bool, reason string) (*GroupApplication, error) {
+	g, err := GetGroup(groupID)
+	if err != nil {
+		return nil, errors.Errorf("group(%s) not found", groupID)
+	}
+	if err := Authorize(user, PermMembersManage, g.Account.ID, g.ID); err != nil {
+		return nil, errors.Wrapf(err, "cannot review group applications")
+	}
+	reason = strings.TrimSpace(reason)
+	if !accept && reason == "" {
+		return nil, errors.Errorf("missing reason for rejection")
+	}
+	before, err := getGroupApplication(g.ID, personID)
+	if err != nil {
+		return nil, err
+	}
+	if before.Accepted || before.Rejected != nil {
+		return nil, errors.Errorf("application of person(%s) to group(%s) was already reviewed", personID, g.ID)
+	}
+	values := map[string]interface{}{
+		"group_id":  g.ID,
+		"person_id": personID,
+		"accepted":  accept,
+		"rejected":  nil,
+		"user_id":   user.ID,
+	}
+	if accept {
+		//applications do not count for the quota, accepted members do
+		if err := checkGroupMembersQuota(db, g.Account.ID, g.ID); err != nil {
+			return nil, err
+		}
+	} else {
+		values["rejected"] = reason
+	}
+	if _, err := db.NamedExec(
+		"UPDATE group_members SET accepted=:accepted,rejected=:rejected,reviewed_by_user_id=:user_id,time_reviewed=now(),time_updated=now()"+
+			" WHERE group_id=:group_id AND person_id=:person_id AND accepted=false AND rejected IS NULL",
+		values,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to review application")
+	}
+	after, err := getGroupApplication(g.ID, personID)
+	if err != nil {
+		return nil, err
+	}
+	decision := string(GroupApplicationAccepted)
+	if !accept {
+		decision = string(GroupApplicationRejected)
+	}
+	audit(ctx, g.Account.ID, "group_members", g.ID, decision, before, after)
+	notifyGroupApplicationDecision(user, *g, *after, decision, reason)
+	return after, nil
+} //ReviewGroupApplication()
+
+//notifyGroupApplication sends a message to the users who may review applications to the group
+func notifyGroupApplication(user User, g Group, person Person) {
+	admins, err := usersWithPermission(PermMembersManage, g.Account.ID, g.ID)
+	if err != nil {
+		log.Errorf("Failed to get admins of group(%s) to notify: %+v", g.ID, err)
+		return
+	}
+	for _, admin := range admins {
+		if _, err := user.sendNotification(
+			&admin,
+			fmt.Sprintf("%s %s applied to join %s, see GET /group/%s/applications", person.Name, person.Surname, g.Name, g.ID),
+		); err != nil {
+			log.Errorf("Failed to send group application message: %+v", err)
+		}
+	}
+}
+
+//notifyGroupApplicationDecision sends a message to the user who applied,
+//or to the users of the person when the application did not come from a user (e.g. join or import)
+func notifyGroupApplicationDecision(user User, g Group, a GroupApplication, decision string, reason string) {
+	var userIDs []string
+	if err := db.Select(
+		&userIDs,
+		"SELECT id FROM users WHERE id=? OR (? IS NULL AND person_id=?)",
+		a.AppliedByUserID, a.AppliedByUserID, a.PersonID,
+	); err != nil {
+		log.Errorf("Failed to get users of person(%s) to notify: %+v", a.PersonID, err)
+		return
+	}
+	message := fmt.Sprintf("The application of %s %s to join %s was %s", a.Person.Name, a.Person.Surname, g.Name, decision)
+	if reason != "" {
+		message += ": " + reason
+	}
+	for _, id := range userIDs {
+		toUser, err := GetUser("", id)
+		if err != nil {
+			log.Errorf("Failed to get user(%s) to notify: %+v", id, err)
+			continue
+		}
+		if _, err := user.sendNotification(toUser, message); err != nil {
+			log.Errorf("Failed to send group application %s message: %+v", decision, err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package db_test
+
+import (
+	"strings"
+	"testing"
+
+	"bitbucket.org/vservices/hotseat/db"
+)
+
+func TestValidateFieldValues(t *testing.T) {
+	fields := []db.Field{
+		{Name: "start", Type: "date"},
+		{Name: "size", Type: "select"},
+		{Name: "notes", Type: "text"},
+		{Name: "age", Type: "number"},
+		{Name: "camp", Type: "Boolean"},
+	}
+
+	//JSON numbers decode as float64, unknown types (select) only need a value
+	validValues := []map[string]interface{}{
+		{"start": "2022-01-15", "size": "M", "notes": "none", "age": float64(12), "camp": true},
+		{"start": "2022-01-15", "size": "M", "notes": "none", "age": "12.5", "camp": false},
+		{"start": "2022-01-15", "size": float64(3), "notes": "none", "age": float64(12), "camp": true},
+	}
+	for i, values := range validValues {
+		if err := db.ValidateFieldValues(fields, values); err == nil {
+			t.Logf("[%3d] OK Valid %v", i, values)
+		} else {
+			t.Errorf("[%3d] ERROR %v indicate invalid: %v", i, values, err)
+		}
+	}
+
+	invalidValues := []struct {
+		values map[string]interface{}
+		err    string
+	}{
+		{map[string]interface{}{"size": "M", "notes": "none", "age": float64(12), "camp": true}, "missing value for field \"start\""},
+		{map[string]interface{}{"start": "2022-01-15", "size": "M", "notes": "none", "age": float64(12), "camp": true, "extra": "x"}, "unknown field \"extra\""},
+		{map[string]interface{}{"start": "15/01/2022", "size": "M", "notes": "none", "age": float64(12), "camp": true}, "\"15/01/2022\" is not CCYY-MM-DD"},
+		{map[string]interface{}{"start": float64(20220115), "size": "M", "notes": "none", "age": float64(12), "camp": true}, "expecting a date string"},
+		{map[string]interface{}{"start": "2022-01-15", "size": "M", "notes": "none", "age": "twelve", "camp": true}, "\"twelve\" is not a number"},
+		{map[string]interface{}{"start": "2022-01-15", "size": "M", "notes": "none", "age": true, "camp": true}, "expecting a number"},
+		{map[string]interface{}{"start": "2022-01-15", "size": "M", "notes": "none", "age": float64(12), "camp": "yes"}, "expecting true|false"},
+		{map[string]interface{}{"start": "2022-01-15", "size": "M", "notes": "  ", "age": float64(12), "camp": true}, "empty value"},
+	}
+	for i, v := range invalidValues {
+		if err := db.ValidateFieldValues(fields, v.values); err != nil && strings.Contains(err.Error(), v.err) {
+			t.Logf("[%3d] OK Invalid %v: %v", i, v.values, err)
+		} else {
+			t.Errorf("[%3d] ERROR %v gave err=%v, expected %s", i, v.values, err, v.err)
+		}
+	}
+
+	if err := db.ValidateFieldValues(nil, map[string]interface{}{}); err != nil {
+		t.Errorf("ERROR group without fields: %+v", err)
+	}
+}
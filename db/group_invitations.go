@@ -0,0 +1,140 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-msvc/errors"
+)
+
+//GetGroupInvitations lists the sub-groups that other accounts invited the user's account to create
+func GetGroupInvitations(user User) ([]Group, error) {
+	if err := Authorize(user, PermGroupsManage, user.Account.ID, ""); err != nil {
+		return nil, errors.Wrapf(err, "cannot list group invitations")
+	}
+	invitation := true
+	return GetGroups(
+		GroupsFilter{
+			AccountID:  &user.Account.ID,
+			Invitation: &invitation,
+		},
+		nil,
+		1000,
+	)
+}
+
+type AcceptGroupInvitationRequest struct {
+	Name        string                 `json:"name" doc:"Required name of the group, unique within scope of your account."`
+	Description *string                `json:"description" doc:"Optional description text"`
+	Data        map[string]interface{} `json:"data" doc:"Additional data values for this group, e.g. cost"`
+}
+
+func (req *AcceptGroupInvitationRequest) Validate() error {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return errors.Errorf("missing name")
+	}
+	if req.Description != nil {
+		*req.Description = strings.TrimSpace(*req.Description)
+		if *req.Description == "" {
+			req.Description = nil
+		}
+	}
+	if err := validateData(req.Data); err != nil {
+		return errors.Wrapf(err, "invalid data")
+	}
+	return nil
+}
+
+//getGroupInvitation returns the invitation if the user may accept or decline it for its account
+func getGroupInvitation(user User, id string) (*Group, error) {
+	g, err := GetGroup(id)
+	if err != nil || g.Invitation == nil || !*g.Invitation {
+		return nil, errors.Errorf("group invitation(%s) not found", id)
+	}
+	if err := Authorize(user, PermGroupsManage, g.Account.ID, ""); err != nil {
+		return nil, errors.Wrapf(err, "cannot accept or decline group invitation")
+	}
+	return g, nil
+}
+
+//AcceptGroupInvitation creates the invited sub-group in the user's account,
+//which then counts against the account's groups quota
+func AcceptGroupInvitation(ctx context.Context, user User, id string, req AcceptGroupInvitationRequest) (*Group, error) {
+	before, err := getGroupInvitation(user, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid request")
+	}
+	if err := checkGroupsQuota(db, before.Account.ID); err != nil {
+		return nil, err
+	}
+	if _, err := db.NamedExec(
+		"UPDATE groups SET name=:name,description=:description,invitation=false WHERE id=:id AND invitation=true",
+		map[string]interface{}{
+			"id":          id,
+			"name":        req.Name,
+			"description": req.Description,
+		},
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to accept group invitation (name must be unique in your account)")
+	}
+	if len(req.Data) > 0 {
+		if err := SetMetas("groups", id, req.Data); err != nil {
+			return nil, errors.Wrapf(err, "failed to store group data")
+		}
+	}
+	after, err := GetGroup(id)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get group")
+	}
+	audit(ctx, after.Account.ID, "groups", id, "accept", before, after)
+	if len(req.Data) > 0 {
+		audit(ctx, after.Account.ID, "metas", id, "set", nil, after.Data)
+	}
+	notifyGroupInvitationDecision(user, before, "accepted")
+	return after, nil
+}
+
+//DeclineGroupInvitation deletes the invitation
+func DeclineGroupInvitation(ctx context.Context, user User, id string) error {
+	g, err := getGroupInvitation(user, id)
+	if err != nil {
+		return err
+	}
+	for _, query := range []string{
+		"DELETE FROM metas WHERE table_name='groups' AND table_id=:id",
+		"DELETE FROM fields WHERE table_name='groups' AND table_id=:id",
+		"DELETE FROM groups WHERE id=:id AND invitation=true",
+	} {
+		if _, err := db.NamedExec(query, map[string]interface{}{"id": id}); err != nil {
+			return errors.Wrapf(err, "failed to decline group invitation")
+		}
+	}
+	audit(ctx, g.Account.ID, "groups", id, "decline", g, nil)
+	notifyGroupInvitationDecision(user, g, "declined")
+	return nil
+}
+
+//notifyGroupInvitationDecision sends a message to the users who manage the parent group that sent the invitation
+func notifyGroupInvitationDecision(user User, invitation *Group, decision string) {
+	if invitation.Parent == nil {
+		return
+	}
+	admins, err := usersWithPermission(PermGroupsManage, invitation.Parent.Account.ID, invitation.Parent.ID)
+	if err != nil {
+		log.Errorf("Failed to get admins of group(%s) to notify: %+v", invitation.Parent.ID, err)
+		return
+	}
+	for _, admin := range admins {
+		if _, err := user.sendNotification(
+			&admin,
+			fmt.Sprintf("%s %s your invitation to create a sub-group in %s", user.Account.Name, decision, invitation.Parent.Name),
+		); err != nil {
+			log.Errorf("Failed to send group invitation %s message: %+v", decision, err)
+		}
+	}
+}
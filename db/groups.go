@@ -1,12 +1,14 @@
 package db
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"time"
 
 	"github.com/go-msvc/errors"
 	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
 )
 
 //group of persons that are called members
@@ -50,6 +52,7 @@ type GroupsFilter struct {
 	AccountID     *string `db:"account_id"`
 	ParentGroupID *string `db:"parent_group_id"`
 	Name          *string `db:"name"` //part of name or else any name
+	Invitation    *bool   `db:"invitation"`
 }
 
 func GetGroups(filter GroupsFilter, sort []string, limit int) ([]Group, error) {
@@ -77,6 +80,7 @@ func GetGroups(filter GroupsFilter, sort []string, limit int) ([]Group, error) {
 			Parent:      nil,
 			Name:        gr.Name,
 			Description: gr.Description,
+			Invitation:  gr.Invitation,
 		}
 		if gr.ParentGroupID != nil && *gr.ParentGroupID != "" {
 			parentGroup, err := GetGroup(*gr.ParentGroupID)
@@ -125,13 +129,18 @@ func (ng *NewGroup) Validate() error {
 	return nil
 }
 
-func AddGroup(user User, ng NewGroup) (*Group, error) {
-	if !user.Admin {
-		return nil, errors.Errorf("cannot add a group because user is not account admin user")
-	}
+func AddGroup(ctx context.Context, user User, ng NewGroup) (*Group, error) {
 	if err := ng.Validate(); err != nil {
 		return nil, errors.Wrapf(err, "invalid request")
 	}
+	//group managers can create sub-groups in the group they manage
+	parentGroupID := ""
+	if ng.ParentGroupID != nil {
+		parentGroupID = *ng.ParentGroupID
+	}
+	if err := Authorize(user, PermGroupsManage, user.Account.ID, parentGroupID); err != nil {
+		return nil, errors.Wrapf(err, "cannot add a group")
+	}
 
 	//todo: check if allowed for this account...
 	invitation := false
@@ -172,6 +181,9 @@ func AddGroup(user User, ng NewGroup) (*Group, error) {
 		ng.Description = parentGroupRow.Description
 	} else {
 		ng.AccountID = &user.Account.ID
+		if err := checkGroupsQuota(db, user.Account.ID); err != nil {
+			return nil, err
+		}
 	}
 
 	//create the group
@@ -202,6 +214,10 @@ func AddGroup(user User, ng NewGroup) (*Group, error) {
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to get new group")
 	}
+	audit(ctx, g.Account.ID, "groups", g.ID, "create", nil, g)
+	if len(ng.Data) > 0 {
+		audit(ctx, g.Account.ID, "metas", g.ID, "set", nil, g.Data)
+	}
 
 	if invitation {
 		//send message to other account user about the invitation
@@ -263,9 +279,13 @@ func GetGroup(id string) (*Group, error) {
 } //GetGroup()
 
 //updates group name and description and specified data
-func UpdGroup(user User, g Group) error {
-	if g.Account.ID != user.Account.ID {
-		return errors.Errorf("group does not belong to you")
+func UpdGroup(ctx context.Context, user User, g Group) error {
+	if err := Authorize(user, PermGroupsManage, g.Account.ID, g.ID); err != nil {
+		return errors.Wrapf(err, "cannot update group")
+	}
+	before, err := GetGroup(g.ID)
+	if err != nil {
+		return errors.Wrapf(err, "cannot get group")
 	}
 	if _, err := db.NamedExec(
 		"UPDATE groups SET name=:name,description=:description WHERE id=:id AND account_id=:account_id",
@@ -297,16 +317,37 @@ func UpdGroup(user User, g Group) error {
 			return errors.Wrapf(err, "failed to set metas")
 		}
 	}
+	if after, err := GetGroup(g.ID); err != nil {
+		log.Errorf("cannot audit group(%s) update: %+v", g.ID, err)
+	} else {
+		audit(ctx, g.Account.ID, "groups", g.ID, "update", before, after)
+		if len(dataToDelete) > 0 || len(dataToSet) > 0 {
+			audit(ctx, g.Account.ID, "metas", g.ID, "set", before.Data, after.Data)
+		}
+	}
 	return nil
 } //UpdGroup()
 
-func DelGroup(user User, id string) error {
+func DelGroup(ctx context.Context, user User, id string) error {
+	g, err := GetGroup(id)
+	if err != nil {
+		return errors.Wrapf(err, "cannot get group")
+	}
+	if err := Authorize(user, PermGroupsManage, g.Account.ID, g.ID); err != nil {
+		return errors.Wrapf(err, "cannot delete group")
+	}
+	if _, err := db.NamedExec("DELETE FROM user_roles WHERE group_id=:id", map[string]interface{}{"id": id}); err != nil {
+		return errors.Wrapf(err, "failed to delete group roles")
+	}
+	if _, err := db.NamedExec("DELETE FROM addresses WHERE table_name='groups' AND table_id=:id", map[string]interface{}{"id": id}); err != nil {
+		return errors.Wrapf(err, "failed to delete group addresses")
+	}
 	//note: foreign key prevent deletion of parent group with children
 	result, err := db.NamedExec(
 		"DELETE FROM groups WHERE id=:id AND account_id=:account_id",
 		map[string]interface{}{
 			"id":         id,
-			"account_id": user.Account.ID,
+			"account_id": g.Account.ID,
 		},
 	)
 	if err != nil {
@@ -314,11 +355,12 @@ func DelGroup(user User, id string) error {
 	}
 	nr, err := result.RowsAffected()
 	if nr != 1 {
-		return errors.Errorf("deleted %d groups, not 1: %+v", err)
+		return errors.Errorf("deleted %d groups, not 1: %+v", nr, err)
 	}
 
 	//metas has no foreign key - delete after group was deleted
 	DelAllMetas("groups", id)
+	audit(ctx, g.Account.ID, "groups", g.ID, "delete", g, nil)
 	return nil
 }
 
@@ -350,15 +392,27 @@ func GetGroupFields(id string, includeParentFields bool) ([]Field, error) {
 	return append(pf, fields...), nil
 }
 
-func SetGroupFields(user User, id string, fields []Field) error {
+func SetGroupFields(ctx context.Context, user User, id string, fields []Field) error {
 	g, err := GetGroup(id)
 	if err != nil {
 		return errors.Wrapf(err, "cannot get group")
 	}
-	if g.Account.ID != user.Account.ID {
-		return errors.Errorf("group does not belong to you")
+	if err := Authorize(user, PermGroupsManage, g.Account.ID, g.ID); err != nil {
+		return errors.Wrapf(err, "cannot set group fields")
+	}
+	before, err := GetFields("groups", id)
+	if err != nil {
+		return errors.Wrapf(err, "cannot get group fields")
 	}
-	return SetFields("groups", id, fields)
+	if err := SetFields("groups", id, fields); err != nil {
+		return err
+	}
+	if after, err := GetFields("groups", id); err != nil {
+		log.Errorf("cannot audit group(%s) fields: %+v", id, err)
+	} else {
+		audit(ctx, g.Account.ID, "fields", id, "set", before, after)
+	}
+	return nil
 }
 
 type GroupMembersFilter struct {
@@ -396,6 +450,9 @@ func AddGroupMember(groupID string, memberType string, memberID string) (*GroupM
 	if row.AccountID != g.Account.ID {
 		return nil, errors.Errorf("cannot add %s from other account", memberType)
 	}
+	if err := checkGroupMembersQuota(db, g.Account.ID, g.ID); err != nil {
+		return nil, err
+	}
 
 	id := uuid.New().String()
 	if _, err := db.NamedExec(
@@ -416,6 +473,33 @@ func AddGroupMember(groupID string, memberType string, memberID string) (*GroupM
 	}, nil
 } //AddGroupMember()
 
+//addGroupPerson makes the person a member of the group, already accepted or else pending review,
+//it returns false if the person was already a member
+func addGroupPerson(e sqlx.Ext, accountID string, groupID string, personID string, accepted bool) (bool, error) {
+	var nr int
+	if err := sqlx.Get(e, &nr, "SELECT COUNT(*) FROM group_members WHERE group_id=? AND person_id=?", groupID, personID); err != nil {
+		return false, errors.Wrapf(err, "failed to check group member")
+	}
+	if nr > 0 {
+		return false, nil
+	}
+	if err := checkGroupMembersQuota(e, accountID, groupID); err != nil {
+		return false, err
+	}
+	if _, err := sqlx.NamedExec(
+		e,
+		"INSERT INTO group_members SET group_id=:group_id,person_id=:person_id,time_created=now(),time_updated=now(),accepted=:accepted",
+		map[string]interface{}{
+			"group_id":  groupID,
+			"person_id": personID,
+			"accepted":  accepted,
+		},
+	); err != nil {
+		return false, errors.Wrapf(err, "failed to insert group member")
+	}
+	return true, nil
+}
+
 func DelGroupMember(gid string, uid string) error {
 	stmt, err := getCompiledStatement("DELETE FROM group_members WHERE group_id=:group_id,user_id=:user_id")
 	if err != nil {
@@ -0,0 +1,424 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"bitbucket.org/vservices/hotseat/idp"
+	"github.com/go-msvc/errors"
+	"github.com/google/uuid"
+)
+
+//IdentityProviderType creates a provider from the stored config of an account's identity provider
+type IdentityProviderType func(ctx context.Context, config json.RawMessage) (idp.Provider, error)
+
+var identityProviderTypes = map[string]IdentityProviderType{
+	"oidc": func(ctx context.Context, config json.RawMessage) (idp.Provider, error) {
+		var c idp.OIDCConfig
+		if err := json.Unmarshal(config, &c); err != nil {
+			return nil, errors.Wrapf(err, "invalid oidc config")
+		}
+		if u, err := url.Parse(c.Issuer); err != nil || u.Scheme != "https" || u.Hostname() == "" {
+			return nil, errors.Errorf("issuer \"%s\" is not an https URL", c.Issuer)
+		}
+		return idp.NewOIDCWithClient(ctx, c, externalClient)
+	},
+}
+
+//externalClient only connects to public addresses, so that the identity provider config
+//cannot make the server call internal services, also not with names that resolve to internal addresses
+var externalClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network string, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return errors.Wrapf(err, "invalid address %s", address)
+				}
+				if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+					return errors.Errorf("address %s is not public", address)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+//carrier-grade NAT addresses (RFC 6598) are not covered by net.IP.IsPrivate()
+var sharedAddressSpace = net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() &&
+		!ip.IsPrivate() &&
+		!ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() &&
+		!ip.IsMulticast() &&
+		!ip.IsUnspecified() &&
+		!sharedAddressSpace.Contains(ip)
+}
+
+//RegisterIdentityProviderType adds another type of external identity provider
+func RegisterIdentityProviderType(name string, t IdentityProviderType) {
+	identityProviderTypes[name] = t
+}
+
+//time allowed to login at the external provider
+const externalLoginMaxAge = 10 * time.Minute
+
+type IdentityProvider struct {
+	ID        string                 `json:"id"`
+	AccountID string                 `json:"account_id"`
+	Name      string                 `json:"name" doc:"Name used in the login URL, unique in the account"`
+	Type      string                 `json:"type" doc:"Type of provider, e.g. oidc"`
+	Config    map[string]interface{} `json:"config,omitempty" doc:"Type specific config, without secrets"`
+}
+
+type identityProviderRow struct {
+	ID        string `db:"id"`
+	AccountID string `db:"account_id"`
+	Name      string `db:"name"`
+	Type      string `db:"type"`
+	Config    string `db:"config"`
+}
+
+func (r identityProviderRow) IdentityProvider() IdentityProvider {
+	p := IdentityProvider{
+		ID:        r.ID,
+		AccountID: r.AccountID,
+		Name:      r.Name,
+		Type:      r.Type,
+	}
+	if err := json.Unmarshal([]byte(r.Config), &p.Config); err == nil {
+		for n := range p.Config {
+			if strings.Contains(n, "secret") {
+				p.Config[n] = "***"
+			}
+		}
+	}
+	return p
+}
+
+func (r identityProviderRow) provider(ctx context.Context) (idp.Provider, error) {
+	t, ok := identityProviderTypes[r.Type]
+	if !ok {
+		return nil, errors.Errorf("unknown identity provider type \"%s\"", r.Type)
+	}
+	return t(ctx, json.RawMessage(r.Config))
+}
+
+const identityProviderRowQuery = "SELECT id,account_id,name,type,config FROM identity_providers"
+
+type NewIdentityProvider struct {
+	Name   string          `json:"name"`
+	Type   string          `json:"type"`
+	Config json.RawMessage `json:"config"`
+}
+
+//AddIdentityProvider configures an external identity provider for the user's account
+//the config is checked by creating the provider, e.g. OIDC discovery must succeed
+func AddIdentityProvider(user User, np NewIdentityProvider) (*IdentityProvider, error) {
+	if user.Account == nil {
+		return nil, errors.Errorf("only account admin can add identity providers")
+	}
+	if err := Authorize(user, PermAccountManage, user.Account.ID, ""); err != nil {
+		return nil, err
+	}
+	np.Name = strings.TrimSpace(np.Name)
+	if np.Name == "" {
+		return nil, errors.Errorf("missing name")
+	}
+	row := identityProviderRow{
+		ID:        uuid.New().String(),
+		AccountID: user.Account.ID,
+		Name:      np.Name,
+		Type:      np.Type,
+		Config:    string(np.Config),
+	}
+	if _, err := row.provider(context.Background()); err != nil {
+		return nil, errors.Wrapf(err, "invalid identity provider")
+	}
+	if _, err := db.NamedExec(
+		"INSERT INTO identity_providers SET id=:id,account_id=:account_id,name=:name,type=:type,config=:config",
+		map[string]interface{}{
+			"id":         row.ID,
+			"account_id": row.AccountID,
+			"name":       row.Name,
+			"type":       row.Type,
+			"config":     row.Config,
+		},
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to create identity provider")
+	}
+	p := row.IdentityProvider()
+	return &p, nil
+} //AddIdentityProvider()
+
+func GetIdentityProviders(accountID string) ([]IdentityProvider, error) {
+	var rows []identityProviderRow
+	if err := NamedSelect(
+		&rows,
+		identityProviderRowQuery+" WHERE account_id=:account_id ORDER BY name",
+		map[string]interface{}{
+			"account_id": accountID,
+		},
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get identity providers")
+	}
+	list := make([]IdentityProvider, len(rows))
+	for i, r := range rows {
+		list[i] = r.IdentityProvider()
+	}
+	return list, nil
+} //GetIdentityProviders()
+
+//DelIdentityProvider removes the provider and the links from its identities to local users
+func DelIdentityProvider(accountID string, id string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	args := map[string]interface{}{
+		"id":         id,
+		"account_id": accountID,
+	}
+	for _, query := range []string{
+		"DELETE FROM login_states WHERE provider_id=(SELECT id FROM identity_providers WHERE id=:id AND account_id=:account_id)",
+		"DELETE FROM user_identities WHERE provider_id=(SELECT id FROM identity_providers WHERE id=:id AND account_id=:account_id)",
+	} {
+		if _, err := tx.NamedExec(query, args); err != nil {
+			return errors.Wrapf(err, "failed to delete identity provider logins")
+		}
+	}
+	result, err := tx.NamedExec("DELETE FROM identity_providers WHERE id=:id AND account_id=:account_id", args)
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete identity provider")
+	}
+	if nr, _ := result.RowsAffected(); nr != 1 {
+		return errors.Errorf("identity provider(%s) not found", id)
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrapf(err, "failed to delete identity provider")
+	}
+	return nil
+} //DelIdentityProvider()
+
+//StartExternalLogin returns the URL where the user must login at the account's named provider
+func StartExternalLogin(accountID string, providerName string) (string, error) {
+	return startExternalLogin(accountID, providerName, nil)
+} //StartExternalLogin()
+
+//LinkExternalIdentity returns the URL where the logged in user must login at the account's named provider,
+//to link the external identity to the user, after which the user can login with either
+func LinkExternalIdentity(user User, providerName string) (string, error) {
+	if user.Account == nil {
+		return "", errors.Errorf("user has no account")
+	}
+	return startExternalLogin(user.Account.ID, providerName, &user.ID)
+} //LinkExternalIdentity()
+
+func startExternalLogin(accountID string, providerName string, userID *string) (string, error) {
+	var row identityProviderRow
+	if err := NamedGet(
+		&row,
+		identityProviderRowQuery+" WHERE account_id=:account_id AND name=:name",
+		map[string]interface{}{
+			"account_id": accountID,
+			"name":       providerName,
+		},
+	); err != nil {
+		return "", errors.Errorf("unknown identity provider")
+	}
+	provider, err := row.provider(context.Background())
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create identity provider")
+	}
+
+	state := newRandomToken()
+	nonce := newRandomToken()
+	if _, err := db.NamedExec(
+		"INSERT INTO login_states SET state=:state,provider_id=:provider_id,nonce=:nonce,user_id=:user_id,time_created=now()",
+		map[string]interface{}{
+			"state":       state,
+			"provider_id": row.ID,
+			"nonce":       nonce,
+			"user_id":     userID,
+		},
+	); err != nil {
+		return "", errors.Wrapf(err, "failed to store login state")
+	}
+	return provider.AuthURL(state, nonce), nil
+} //startExternalLogin()
+
+type ExternalLoginRequest struct {
+	State      string `json:"state"`
+	Code       string `json:"code"`
+	UserAgent  string `json:"-"`
+	RemoteAddr string `json:"-"`
+}
+
+//CompleteExternalLogin handles the callback from the provider and returns a normal session for the
+//local user linked to the external identity. The link is created on first login, either to the
+//user who started it with LinkExternalIdentity, or to a new user in the account. Existing users
+//are never linked by email, they must login and link the identity themselves.
+func CompleteExternalLogin(req ExternalLoginRequest) (*Session, error) {
+	if req.State == "" || req.Code == "" {
+		return nil, errors.Errorf("missing state or code")
+	}
+	var loginState struct {
+		ProviderID string  `db:"provider_id"`
+		Nonce      string  `db:"nonce"`
+		UserID     *string `db:"user_id"`
+	}
+	if err := NamedGet(
+		&loginState,
+		"SELECT provider_id,nonce,user_id FROM login_states WHERE state=:state AND time_created>now()-INTERVAL :max_age SECOND",
+		map[string]interface{}{
+			"state":   req.State,
+			"max_age": int64(externalLoginMaxAge / time.Second),
+		},
+	); err != nil {
+		return nil, errors.Errorf("unknown or expired login state")
+	}
+	//state is single use
+	if result, err := db.NamedExec("DELETE FROM login_states WHERE state=:state", map[string]interface{}{"state": req.State}); err != nil {
+		return nil, errors.Wrapf(err, "failed to delete login state")
+	} else if nr, _ := result.RowsAffected(); nr != 1 {
+		return nil, errors.Errorf("login state already used")
+	}
+
+	var providerRow identityProviderRow
+	if err := NamedGet(&providerRow, identityProviderRowQuery+" WHERE id=:id", map[string]interface{}{"id": loginState.ProviderID}); err != nil {
+		return nil, errors.Wrapf(err, "failed to get identity provider")
+	}
+	provider, err := providerRow.provider(context.Background())
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create identity provider")
+	}
+	identity, err := provider.Exchange(context.Background(), req.Code, loginState.Nonce)
+	if err != nil {
+		return nil, errors.Wrapf(err, "external login failed")
+	}
+
+	var userID string
+	if loginState.UserID != nil {
+		userID, err = linkUserIdentity(providerRow, *identity, *loginState.UserID)
+	} else {
+		userID, err = linkedUserID(providerRow, *identity)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to link external identity")
+	}
+
+	var info userRow
+	if err := NamedGet(&info, userRowQuery+" WHERE u.id=:id", map[string]interface{}{"id": userID}); err != nil {
+		return nil, errors.Wrapf(err, "failed to get user")
+	}
+	if err := checkLoginAllowed(info); err != nil {
+		return nil, err
+	}
+	//the external login replaces the password, not the second factor
+	return newSession(info, loginScope(info), req.UserAgent, req.RemoteAddr)
+} //CompleteExternalLogin()
+
+//identityUserID returns the local user linked to the identity, or "" if not yet linked
+func identityUserID(providerRow identityProviderRow, identity idp.Identity) (string, error) {
+	var userIDs []string
+	if err := db.Select(
+		&userIDs,
+		"SELECT user_id FROM user_identities WHERE provider_id=? AND subject=?",
+		providerRow.ID, identity.Subject,
+	); err != nil {
+		return "", errors.Wrapf(err, "failed to get linked user")
+	}
+	if len(userIDs) == 0 {
+		return "", nil
+	}
+	return userIDs[0], nil
+}
+
+//linkUserIdentity links the identity to the user who started the login from an authenticated session
+func linkUserIdentity(providerRow identityProviderRow, identity idp.Identity, userID string) (string, error) {
+	linkedID, err := identityUserID(providerRow, identity)
+	if err != nil {
+		return "", err
+	}
+	if linkedID == userID {
+		return userID, nil
+	}
+	if linkedID != "" {
+		return "", errors.Errorf("external identity is linked to another user")
+	}
+	var user userRow
+	if err := NamedGet(&user, userRowQuery+" WHERE u.id=:id", map[string]interface{}{"id": userID}); err != nil {
+		return "", errors.Wrapf(err, "failed to get user")
+	}
+	if user.AccountID != providerRow.AccountID {
+		return "", errors.Errorf("user(%s) belongs to another account", userID)
+	}
+	if err := addUserIdentity(providerRow, identity, userID); err != nil {
+		return "", err
+	}
+	return userID, nil
+}
+
+//linkedUserID returns the local user linked to the identity, creating the link and a new user if necessary
+func linkedUserID(providerRow identityProviderRow, identity idp.Identity) (string, error) {
+	linkedID, err := identityUserID(providerRow, identity)
+	if err != nil {
+		return "", err
+	}
+	if linkedID != "" {
+		return linkedID, nil
+	}
+
+	//external users are identified by verified email, else by provider and subject
+	username := providerRow.Name + ":" + identity.Subject
+	if identity.Email != "" && identity.EmailVerified {
+		username = identity.Email
+	}
+	//the provider vouching for the email does not prove that the existing user wants the link
+	var existing userRow
+	if err := NamedGet(&existing, userRowQuery+" WHERE u.username=:username", map[string]interface{}{"username": username}); err == nil {
+		return "", errors.Errorf("user(%s) already exists, login and link the external identity with POST /user/identities/%s", username, providerRow.Name)
+	}
+	//the user never logs in with this password, it only satisfies the users table
+	user, err := AddUser(context.Background(), NewUser{
+		Account:  &Account{ID: providerRow.AccountID},
+		Username: username,
+		Password: newRandomToken(),
+		Admin:    false,
+		Active:   true,
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create user")
+	}
+	if err := addUserIdentity(providerRow, identity, user.ID); err != nil {
+		return "", err
+	}
+	return user.ID, nil
+} //linkedUserID()
+
+func addUserIdentity(providerRow identityProviderRow, identity idp.Identity, userID string) error {
+	if _, err := db.NamedExec(
+		"INSERT INTO user_identities SET provider_id=:provider_id,subject=:subject,user_id=:user_id,time_created=now()",
+		map[string]interface{}{
+			"provider_id": providerRow.ID,
+			"subject":     identity.Subject,
+			"user_id":     userID,
+		},
+	); err != nil {
+		return errors.Wrapf(err, "failed to link identity")
+	}
+	return nil
+}
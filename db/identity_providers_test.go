@@ -0,0 +1,48 @@
+package db_test
+
+import (
+	"net"
+	"testing"
+
+	"bitbucket.org/vservices/hotseat/db"
+)
+
+func TestPublicIP(t *testing.T) {
+	publicIPs := []string{
+		"8.8.8.8",
+		"1.1.1.1",
+		"100.63.255.255",
+		"100.128.0.1",
+		"2001:4860:4860::8888",
+	}
+	for i, s := range publicIPs {
+		if db.PublicIP(net.ParseIP(s)) {
+			t.Logf("[%3d] OK Public %s", i, s)
+		} else {
+			t.Errorf("[%3d] ERROR %s indicate not public", i, s)
+		}
+	}
+
+	internalIPs := []string{
+		"127.0.0.1",
+		"10.1.2.3",
+		"172.16.0.1",
+		"192.168.1.1",
+		"169.254.169.254",
+		"100.64.0.1",
+		"0.0.0.0",
+		"224.0.0.1",
+		"::1",
+		"::",
+		"fe80::1",
+		"fd00::1",
+		"::ffff:127.0.0.1",
+	}
+	for i, s := range internalIPs {
+		if !db.PublicIP(net.ParseIP(s)) {
+			t.Logf("[%3d] OK Not public %s", i, s)
+		} else {
+			t.Errorf("[%3d] ERROR %s indicate public", i, s)
+		}
+	}
+}
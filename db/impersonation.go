@@ -0,0 +1,112 @@
+package db
+
+import (
+	"os"
+	"time"
+
+	"github.com/go-msvc/errors"
+)
+
+//impersonated sessions end this long after they were created, even when used
+var impersonationMaxAge time.Duration
+
+func init() {
+	impersonationMaxAge = time.Duration(intDefault(os.Getenv("IMPERSONATION_MINUTES"), 30)) * time.Minute
+}
+
+//Impersonate creates a session for a sysadmin to act as an account user
+//the session carries the admin as Impersonator and every request is logged with AddImpersonationLog
+func Impersonate(admin Session, userID string) (*Session, error) {
+	if admin.Impersonator != nil || admin.ApiKey != nil {
+		return nil, errors.Errorf("impersonation must be started from a sysadmin login session")
+	}
+	if err := Authorize(admin.User, PermSystemManage, "", ""); err != nil {
+		return nil, errors.Wrapf(err, "only sysadmin can impersonate users")
+	}
+	var info userRow
+	if err := NamedGet(&info, userRowQuery+" WHERE u.id=:id", map[string]interface{}{"id": userID}); err != nil {
+		return nil, errors.Errorf("user(%s) not found", userID)
+	}
+	if info.UserID == admin.User.ID {
+		return nil, errors.Errorf("cannot impersonate yourself")
+	}
+	if info.AccountAdmin {
+		return nil, errors.Errorf("cannot impersonate users of the system account")
+	}
+	if err := checkLoginAllowed(info); err != nil {
+		return nil, err
+	}
+	log.Infof("User(%s) impersonates user(%s)", admin.User.Username, info.Username)
+	impersonator := User{
+		ID:       admin.User.ID,
+		Username: admin.User.Username,
+	}
+	session, err := createSession(info, SessionScopeFull, admin.UserAgent, admin.RemoteAddr, &impersonator)
+	if err != nil {
+		return nil, err
+	}
+	if err := AddImpersonationLog(*session, "POST", "/user/"+userID+"/impersonate", 200); err != nil {
+		log.Errorf("%+v", err)
+	}
+	return session, nil
+} //Impersonate()
+
+//ImpersonationLog is one request made by a sysadmin acting as another user
+type ImpersonationLog struct {
+	SessionID            string  `json:"session_id" db:"session_id"`
+	ImpersonatorUserID   string  `json:"impersonator_user_id" db:"impersonator_user_id"`
+	ImpersonatorUsername string  `json:"impersonator_username" db:"impersonator_username"`
+	UserID               string  `json:"user_id" db:"user_id"`
+	Username             string  `json:"username" db:"username"`
+	Method               string  `json:"method" db:"method"`
+	Path                 string  `json:"path" db:"path"`
+	Status               int     `json:"status" db:"status"`
+	Timestamp            SqlTime `json:"timestamp" db:"timestamp"`
+}
+
+func AddImpersonationLog(session Session, method string, path string, status int) error {
+	if session.Impersonator == nil {
+		return nil
+	}
+	if len(path) > 255 {
+		path = path[:255]
+	}
+	if _, err := db.NamedExec(
+		"INSERT INTO impersonation_log SET session_id=:session_id,impersonator_user_id=:impersonator_user_id,"+
+			"impersonator_username=:impersonator_username,user_id=:user_id,username=:username,method=:method,path=:path,status=:status,timestamp=now()",
+		map[string]interface{}{
+			"session_id":            session.ID,
+			"impersonator_user_id":  session.Impersonator.ID,
+			"impersonator_username": session.Impersonator.Username,
+			"user_id":               session.User.ID,
+			"username":              session.User.Username,
+			"method":                method,
+			"path":                  path,
+			"status":                status,
+		},
+	); err != nil {
+		return errors.Wrapf(err, "failed to log impersonated request")
+	}
+	return nil
+} //AddImpersonationLog()
+
+//GetImpersonationLog returns the most recent impersonated requests, optionally only for one user
+func GetImpersonationLog(userID string, limit int) ([]ImpersonationLog, error) {
+	query := "SELECT session_id,impersonator_user_id,impersonator_username,user_id,username,method,path,status,timestamp FROM impersonation_log"
+	if userID != "" {
+		query += " WHERE user_id=:user_id"
+	}
+	query += " ORDER BY timestamp DESC LIMIT :limit"
+	var list []ImpersonationLog
+	if err := NamedSelect(
+		&list,
+		query,
+		map[string]interface{}{
+			"user_id": userID,
+			"limit":   limit,
+		},
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get impersonation log")
+	}
+	return list, nil
+} //GetImpersonationLog()
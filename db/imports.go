@@ -0,0 +1,321 @@
+package db
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-msvc/errors"
+)
+
+//importFields are the person/user fields that can be mapped to CSV columns
+var importFields = []string{"name", "surname", "dob", "gender", "email", "phone", "country", "national_id"}
+
+var importMaxRows = intDefault(os.Getenv("IMPORT_MAX_ROWS"), 1000)
+
+type ImportRequest struct {
+	CSV          string            `json:"csv" doc:"CSV text with a header row"`
+	Columns      map[string]string `json:"columns,omitempty" doc:"Maps fields (name,surname,dob,gender,email,phone,country,national_id) to CSV column headers, unmapped fields use a column with the field name"`
+	CreateUsers  bool              `json:"create_users,omitempty" doc:"Invite an account user for each row, with the email as username"`
+	GroupID      *string           `json:"group_id,omitempty" doc:"Add the imported persons to this group"`
+	Commit       bool              `json:"commit,omitempty" doc:"false (default) only previews the import"`
+	SkipRejected bool              `json:"skip_rejected,omitempty" doc:"Commit the valid rows even when some rows are rejected, else nothing is committed"`
+}
+
+//import row statuses
+const (
+	ImportCreated  = "created"
+	ImportExisting = "matched-existing"
+	ImportRejected = "rejected"
+)
+
+type ImportRowResult struct {
+	Row          int    `json:"row" doc:"Line number in the CSV, the header is line 1"`
+	Status       string `json:"status" doc:"created|matched-existing|rejected"`
+	Reason       string `json:"reason,omitempty" doc:"Why the row was rejected"`
+	PersonID     string `json:"person_id,omitempty"`
+	UserID       string `json:"user_id,omitempty"`
+	AddedToGroup bool   `json:"added_to_group,omitempty"`
+}
+
+type ImportReport struct {
+	Committed bool              `json:"committed"`
+	Created   int               `json:"created"`
+	Existing  int               `json:"matched_existing"`
+	Rejected  int               `json:"rejected"`
+	Rows      []ImportRowResult `json:"rows"`
+}
+
+//Import adds persons (and optionally users and group members) from CSV
+//all rows are processed in one transaction that is only committed when requested and
+//no rows were rejected (unless skipping rejected rows), so a preview reports exactly what commit will do
+func Import(ctx context.Context, by User, req ImportRequest) (*ImportReport, error) {
+	if by.Account == nil {
+		return nil, errors.Errorf("not an account user")
+	}
+	groupID := ""
+	if req.GroupID != nil && *req.GroupID != "" {
+		groupID = *req.GroupID
+		g, err := GetGroup(groupID)
+		if err != nil || g.Account == nil || g.Account.ID != by.Account.ID {
+			return nil, errors.Errorf("group(%s) not found in your account", groupID)
+		}
+	}
+	if err := Authorize(by, PermMembersManage, by.Account.ID, groupID); err != nil {
+		return nil, err
+	}
+	if req.CreateUsers {
+		if err := Authorize(by, PermUsersManage, by.Account.ID, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	r := csv.NewReader(strings.NewReader(req.CSV))
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read CSV header")
+	}
+	index, err := importColumns(header, req.Columns)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	report := ImportReport{Rows: []ImportRowResult{}}
+	createdPersons := []Person{}
+	createdUsers := []*User{}
+	invitationIDs := []string{}
+	for line := 2; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if line-1 > importMaxRows {
+			return nil, errors.Errorf("more than %d rows", importMaxRows)
+		}
+		result := ImportRowResult{Row: line}
+		if err != nil {
+			result.Status = ImportRejected
+			result.Reason = err.Error()
+			report.add(result)
+			continue
+		}
+		value := func(field string) string {
+			if i := index[field]; i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		p, err := importPerson(value)
+		if err == nil && req.CreateUsers && by.Account.Admin {
+			err = errors.Errorf("cannot create users in the system account")
+		}
+		if err != nil {
+			result.Status = ImportRejected
+			result.Reason = err.Error()
+			report.add(result)
+			continue
+		}
+
+		//each row is a savepoint, so a rejected row does not leave partial records
+		if _, err := tx.Exec("SAVEPOINT import_row"); err != nil {
+			return nil, errors.Wrapf(err, "failed to create savepoint")
+		}
+		result.Status = ImportExisting
+		if result.PersonID, err = findPerson(tx, p); err != nil {
+			if err := addPerson(tx, &p); err != nil {
+				result.Status = ImportRejected
+				result.Reason = err.Error()
+			} else {
+				result.Status = ImportCreated
+				result.PersonID = p.ID
+				createdPersons = append(createdPersons, p)
+			}
+		}
+		var newUser *User
+		invitationID := ""
+		if result.Status != ImportRejected && req.CreateUsers {
+			var existing struct {
+				ID        string `db:"id"`
+				AccountID string `db:"account_id"`
+			}
+			if err := tx.Get(&existing, "SELECT id,account_id FROM users WHERE username=?", *p.Email); err == nil {
+				if existing.AccountID != by.Account.ID {
+					result.Status = ImportRejected
+					result.Reason = "username " + *p.Email + " belongs to another account"
+				} else {
+					result.UserID = existing.ID
+				}
+			} else if claimed, err := personClaimed(tx, result.PersonID); err != nil || claimed {
+				//an existing person with a user or family is not given to a new login, as when accepting invitations
+				result.Status = ImportRejected
+				result.Reason = "person already has a user or family, cannot create another user for it"
+				if err != nil {
+					result.Reason = err.Error()
+				}
+			} else {
+				if newUser, err = addUser(tx, NewUser{
+					Account:  by.Account,
+					Username: *p.Email,
+					Password: newRandomToken(),
+					Active:   false,
+					Person:   &Person{ID: result.PersonID},
+				}); err == nil {
+					invitationID, err = addUserInvitation(tx, by, newUser.ID)
+				}
+				if err != nil {
+					result.Status = ImportRejected
+					result.Reason = err.Error()
+				} else {
+					result.UserID = newUser.ID
+					result.Status = ImportCreated
+				}
+			}
+		}
+		if result.Status != ImportRejected && groupID != "" {
+			if result.AddedToGroup, err = addGroupPerson(tx, by.Account.ID, groupID, result.PersonID, true); err != nil {
+				result.Status = ImportRejected
+				result.Reason = err.Error()
+			} else if result.AddedToGroup {
+				result.Status = ImportCreated
+			}
+		}
+		if result.Status == ImportRejected {
+			if _, err := tx.Exec("ROLLBACK TO SAVEPOINT import_row"); err != nil {
+				return nil, errors.Wrapf(err, "failed to rollback row")
+			}
+			if len(createdPersons) > 0 && createdPersons[len(createdPersons)-1].ID == result.PersonID {
+				createdPersons = createdPersons[:len(createdPersons)-1]
+			}
+			result.PersonID = ""
+			result.UserID = ""
+			result.AddedToGroup = false
+		} else if newUser != nil {
+			createdUsers = append(createdUsers, newUser)
+			invitationIDs = append(invitationIDs, invitationID)
+		}
+		report.add(result)
+	}
+
+	if !req.Commit || (report.Rejected > 0 && !req.SkipRejected) {
+		return &report, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to commit import")
+	}
+	report.Committed = true
+
+	for _, p := range createdPersons {
+		audit(ctx, "", "persons", p.ID, "import", nil, p)
+	}
+	for i, u := range createdUsers {
+		audit(ctx, by.Account.ID, "users", u.ID, "import", nil, u)
+		if _, err := sendUserInvitation(ctx, by, invitationIDs[i], "create"); err != nil {
+			log.Errorf("failed to send invitation to imported user(%s): %+v", u.Username, err)
+		}
+	}
+	if groupID != "" {
+		audit(ctx, by.Account.ID, "groups", groupID, "import_members", nil, report.Rows)
+	}
+	return &report, nil
+} //Import()
+
+//importColumns maps each import field to the index of its CSV column,
+//columns maps fields to other headers, else the header is the field name (case insensitive)
+func importColumns(header []string, columns map[string]string) (map[string]int, error) {
+	for field := range columns {
+		if !importField(field) {
+			return nil, errors.Errorf("unknown field \"%s\" in columns", field)
+		}
+	}
+	index := map[string]int{}
+	for _, field := range importFields {
+		column := field
+		if c, ok := columns[field]; ok {
+			column = c
+		}
+		for i, h := range header {
+			if strings.EqualFold(strings.TrimSpace(h), column) {
+				index[field] = i
+			}
+		}
+		if _, ok := index[field]; !ok {
+			return nil, errors.Errorf("CSV has no column \"%s\" for %s", column, field)
+		}
+	}
+	return index, nil
+}
+
+func importField(name string) bool {
+	for _, f := range importFields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (report *ImportReport) add(result ImportRowResult) {
+	switch result.Status {
+	case ImportCreated:
+		report.Created++
+	case ImportExisting:
+		report.Existing++
+	case ImportRejected:
+		report.Rejected++
+	}
+	report.Rows = append(report.Rows, result)
+}
+
+//importPerson parses and validates the person with the same rules as AddPerson()
+func importPerson(value func(field string) string) (Person, error) {
+	p := Person{
+		Name:    value("name"),
+		Surname: value("surname"),
+	}
+	if s := value("dob"); s != "" {
+		t, err := time.ParseInLocation("2006-01-02", s, time.UTC)
+		if err != nil {
+			return p, errors.Errorf("dob:\"%s\" is not CCYY-MM-DD", s)
+		}
+		dob := SqlDate(t)
+		p.Dob = &dob
+	}
+	switch strings.ToLower(value("gender")) {
+	case "male", "m":
+		g := SqlGenderMale
+		p.Gender = &g
+	case "female", "f":
+		g := SqlGenderFemale
+		p.Gender = &g
+	}
+	if s := value("email"); s != "" {
+		p.Email = &s
+	}
+	if s := value("phone"); s != "" {
+		p.Phone = &s
+	}
+	if s := value("country"); s != "" {
+		country, err := FindCountry(s)
+		if err != nil {
+			return p, err
+		}
+		if nid := value("national_id"); nid != "" {
+			p.Nationalities = []Nationality{{Country: country, NationalID: nid}}
+		}
+	}
+	if err := p.Validate(); err != nil {
+		return p, err
+	}
+	return p, nil
+}
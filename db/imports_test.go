@@ -0,0 +1,108 @@
+package db_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"bitbucket.org/vservices/hotseat/db"
+)
+
+func TestImportColumns(t *testing.T) {
+	header := []string{"Name", "Surname", " DOB ", "gender", "email", "cell", "country", "national_id", "notes"}
+	index, err := db.ImportColumns(header, map[string]string{"phone": "Cell"})
+	if err != nil {
+		t.Errorf("ERROR columns not mapped: %+v", err)
+	}
+	expectedIndex := map[string]int{"name": 0, "surname": 1, "dob": 2, "gender": 3, "email": 4, "phone": 5, "country": 6, "national_id": 7}
+	for field, col := range expectedIndex {
+		if index[field] == col {
+			t.Logf("OK %s in column %d", field, col)
+		} else {
+			t.Errorf("ERROR %s in column %d, expected %d", field, index[field], col)
+		}
+	}
+	if len(index) != len(expectedIndex) {
+		t.Errorf("ERROR mapped %d columns %v, expected %d", len(index), index, len(expectedIndex))
+	}
+
+	invalidColumns := []struct {
+		columns map[string]string
+		err     string
+	}{
+		{nil, "CSV has no column \"phone\" for phone"},
+		{map[string]string{"phone": "cell", "dob": "birthday"}, "CSV has no column \"birthday\" for dob"},
+		{map[string]string{"phone": "cell", "notes": "notes"}, "unknown field \"notes\" in columns"},
+	}
+	for i, c := range invalidColumns {
+		if _, err := db.ImportColumns(header, c.columns); err != nil && strings.Contains(err.Error(), c.err) {
+			t.Logf("[%3d] OK Invalid %v: %v", i, c.columns, err)
+		} else {
+			t.Errorf("[%3d] ERROR %v gave err=%v, expected %s", i, c.columns, err, c.err)
+		}
+	}
+}
+
+//rows without country are rejected before the country is looked up in the database,
+//so these only test parsing and the reasons for rejection
+func TestImportPerson(t *testing.T) {
+	fields := []string{"name", "surname", "dob", "gender", "email", "phone"}
+	row := func(values []string) func(string) string {
+		return func(field string) string {
+			for i, f := range fields {
+				if f == field {
+					return values[i]
+				}
+			}
+			return ""
+		}
+	}
+
+	invalidRows := []struct {
+		values []string
+		err    string
+	}{
+		{[]string{"Anna", "Smit", "2010-03-04", "F", "anna@example.com", "0821234567"}, "missing nationalities"},
+		{[]string{"", "Smit", "2010-03-04", "F", "anna@example.com", "0821234567"}, "missing name"},
+		{[]string{"Anna", "", "2010-03-04", "F", "anna@example.com", "0821234567"}, "missing surname"},
+		{[]string{"Anna", "Smit", "04/03/2010", "F", "anna@example.com", "0821234567"}, "dob:\"04/03/2010\" is not CCYY-MM-DD"},
+		{[]string{"Anna", "Smit", "", "F", "anna@example.com", "0821234567"}, "missing or invalid dob"},
+		{[]string{"Anna", "Smit", "1899-12-31", "F", "anna@example.com", "0821234567"}, "missing or invalid dob"},
+		{[]string{"Anna", "Smit", "2010-03-04", "x", "anna@example.com", "0821234567"}, "missing or invalid gender"},
+		{[]string{"Anna", "Smit", "2010-03-04", "F", "anna", "0821234567"}, "missing/invalid email"},
+		{[]string{"Anna", "Smit", "2010-03-04", "F", "anna@example.com", ""}, "missing phone"},
+	}
+	for i, r := range invalidRows {
+		if _, err := db.ImportPerson(row(r.values)); err != nil && strings.Contains(err.Error(), r.err) {
+			t.Logf("[%3d] OK Rejected %v: %v", i, r.values, err)
+		} else {
+			t.Errorf("[%3d] ERROR %v gave err=%v, expected %s", i, r.values, err, r.err)
+		}
+	}
+
+	genders := []struct {
+		value  string
+		gender db.SqlGender
+	}{
+		{"m", db.SqlGenderMale},
+		{"Male", db.SqlGenderMale},
+		{"F", db.SqlGenderFemale},
+		{"female", db.SqlGenderFemale},
+	}
+	for i, g := range genders {
+		p, _ := db.ImportPerson(row([]string{"Anna", "Smit", "2010-03-04", g.value, "anna@example.com", "0821234567"}))
+		if p.Gender != nil && *p.Gender == g.gender {
+			t.Logf("[%3d] OK Gender \"%s\" is %v", i, g.value, g.gender)
+		} else {
+			t.Errorf("[%3d] ERROR Gender \"%s\" not parsed as %v", i, g.value, g.gender)
+		}
+	}
+
+	p, _ := db.ImportPerson(row([]string{"Anna", "Smit", "2010-03-04", "F", "anna@example.com", "0821234567"}))
+	if p.Dob == nil || !time.Time(*p.Dob).Equal(time.Date(2010, 3, 4, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("ERROR dob parsed as %v", p.Dob)
+	}
+	if p.Email == nil || *p.Email != "anna@example.com" || p.Phone == nil || *p.Phone != "0821234567" {
+		t.Errorf("ERROR email/phone parsed as %v/%v", p.Email, p.Phone)
+	}
+}
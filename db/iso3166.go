@@ -0,0 +1,161 @@
+package db
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"strings"
+
+	"github.com/go-msvc/errors"
+)
+
+//iso3166 holds the ISO 3166-1 countries and ISO 3166-2 subdivisions
+//from the Debian iso-codes project (LGPL-2.1+)
+//
+//go:embed iso3166/iso_3166-1.json iso3166/iso_3166-2.json
+var iso3166 embed.FS
+
+type iso3166Country struct {
+	Alpha2 string `json:"alpha_2"`
+	Alpha3 string `json:"alpha_3"`
+	Name   string `json:"name"`
+}
+
+type iso3166Subdivision struct {
+	Code string `json:"code"` //e.g. ZA-GP
+	Name string `json:"name"`
+}
+
+func iso3166Data() ([]iso3166Country, []iso3166Subdivision, error) {
+	var countries struct {
+		List []iso3166Country `json:"3166-1"`
+	}
+	var subdivisions struct {
+		List []iso3166Subdivision `json:"3166-2"`
+	}
+	for fn, v := range map[string]interface{}{
+		"iso3166/iso_3166-1.json": &countries,
+		"iso3166/iso_3166-2.json": &subdivisions,
+	} {
+		data, err := iso3166.ReadFile(fn)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to read %s", fn)
+		}
+		if err := json.Unmarshal(data, v); err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to decode %s", fn)
+		}
+	}
+	return countries.List, subdivisions.List, nil
+}
+
+type ISO3166Load struct {
+	Countries int64 `json:"countries" doc:"Nr of countries added or given ISO codes"`
+	Regions   int64 `json:"regions" doc:"Nr of regions added"`
+}
+
+//LoadISO3166 adds the ISO countries and subdivisions that are not yet in the database (sysadmin only)
+func LoadISO3166(ctx context.Context, by User) (*ISO3166Load, error) {
+	if err := Authorize(by, PermSystemManage, "", ""); err != nil {
+		return nil, errors.Wrapf(err, "only sysadmin can load countries")
+	}
+	load, err := loadISO3166()
+	if err != nil {
+		return nil, err
+	}
+	audit(ctx, "", "countries", "", "iso3166", nil, load)
+	return load, nil
+}
+
+//sqlSeedCountries is the nr of countries inserted by the SQL init script
+const sqlSeedCountries = 1
+
+//SeedISO3166 loads the ISO countries and subdivisions into a fresh database (only the SQL seed countries),
+//after that it does nothing, so that countries and regions deleted by sysadmin stay deleted
+func SeedISO3166() (*ISO3166Load, error) {
+	var nr int
+	if err := db.Get(&nr, "SELECT COUNT(*) FROM countries"); err != nil {
+		return nil, errors.Wrapf(err, "failed to count countries")
+	}
+	if nr > sqlSeedCountries {
+		return &ISO3166Load{}, nil
+	}
+	return loadISO3166()
+}
+
+//loadISO3166 matches existing countries on name or code and only sets missing codes,
+//existing regions are matched on name or code and kept as is
+func loadISO3166() (*ISO3166Load, error) {
+	countries, subdivisions, err := iso3166Data()
+	if err != nil {
+		return nil, err
+	}
+	load := &ISO3166Load{}
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	for _, c := range countries {
+		result, err := tx.Exec(
+			"INSERT INTO countries SET name=?,code=?,code3=?"+
+				" ON DUPLICATE KEY UPDATE code=IFNULL(code,VALUES(code)),code3=IFNULL(code3,VALUES(code3))",
+			c.Name, c.Alpha2, c.Alpha3)
+		if err != nil {
+			//e.g. a country with this name already has another code
+			log.Errorf("skipped ISO country %s(%s): %+v", c.Alpha2, c.Name, err)
+			continue
+		}
+		if nr, _ := result.RowsAffected(); nr > 0 {
+			load.Countries++
+		}
+	}
+
+	var rows []struct {
+		ID   string `db:"id"`
+		Code string `db:"code"`
+	}
+	if err := tx.Select(&rows, "SELECT id,code FROM countries WHERE code IS NOT NULL"); err != nil {
+		return nil, errors.Wrapf(err, "failed to get country codes")
+	}
+	countryIDs := map[string]string{}
+	for _, row := range rows {
+		countryIDs[row.Code] = row.ID
+	}
+
+	//insert in batches, ignoring those that already exist by name or code
+	const batchSize = 500
+	for start := 0; start < len(subdivisions); start += batchSize {
+		end := start + batchSize
+		if end > len(subdivisions) {
+			end = len(subdivisions)
+		}
+		values := []string{}
+		args := []interface{}{}
+		for _, s := range subdivisions[start:end] {
+			parts := strings.SplitN(s.Code, "-", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			countryID, ok := countryIDs[parts[0]]
+			if !ok {
+				continue
+			}
+			values = append(values, "(?,?,?)")
+			args = append(args, countryID, s.Name, parts[1])
+		}
+		if len(values) == 0 {
+			continue
+		}
+		result, err := tx.Exec("INSERT IGNORE INTO regions (country_id,name,code) VALUES "+strings.Join(values, ","), args...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to add regions")
+		}
+		nr, _ := result.RowsAffected()
+		load.Regions += nr
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to load ISO 3166")
+	}
+	log.Infof("loaded ISO 3166: %+v", *load)
+	return load, nil
+} //loadISO3166()
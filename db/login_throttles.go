@@ -0,0 +1,286 @@
+package db
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/go-msvc/errors"
+)
+
+//failed logins are counted per username and per client IP
+//after loginDelayAfter failures, the next attempt must wait progressively longer,
+//and after the threshold the username or IP is locked out for a while
+var (
+	loginDelayAfter         int
+	loginMaxDelay           time.Duration
+	loginLockoutThreshold   int
+	loginIPLockoutThreshold int
+	loginLockoutDuration    time.Duration
+)
+
+func init() {
+	loginDelayAfter = intDefault(os.Getenv("LOGIN_DELAY_AFTER"), 3)
+	loginMaxDelay = time.Duration(intDefault(os.Getenv("LOGIN_MAX_DELAY_SECONDS"), 60)) * time.Second
+	loginLockoutThreshold = intDefault(os.Getenv("LOGIN_LOCKOUT_THRESHOLD"), 10)
+	loginIPLockoutThreshold = intDefault(os.Getenv("LOGIN_IP_LOCKOUT_THRESHOLD"), 50)
+	loginLockoutDuration = time.Duration(intDefault(os.Getenv("LOGIN_LOCKOUT_MINUTES"), 15)) * time.Minute
+}
+
+const (
+	throttleUsername = "username"
+	throttleIP       = "ip"
+)
+
+//LoginThrottledError is returned by Login instead of checking the password
+//while the username or client IP must wait or is locked out
+type LoginThrottledError struct {
+	Locked bool
+	Wait   time.Duration
+}
+
+func (e LoginThrottledError) Error() string {
+	if e.Locked {
+		return fmt.Sprintf("too many failed logins, locked for %v", e.Wait)
+	}
+	return fmt.Sprintf("too many failed logins, try again in %v", e.Wait)
+}
+
+//loginDelay is the time to wait after the last of nrFailures failed logins
+func loginDelay(nrFailures int) time.Duration {
+	if nrFailures < loginDelayAfter {
+		return 0
+	}
+	delay := loginMaxDelay
+	if n := nrFailures - loginDelayAfter; n < 16 {
+		if d := time.Second << uint(n); d < delay {
+			delay = d
+		}
+	}
+	return delay
+}
+
+//clientIP removes the port from the HTTP remote address
+func clientIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+//checkLoginThrottle returns LoginThrottledError if a login may not be attempted now
+func checkLoginThrottle(kind string, value string) error {
+	if value == "" {
+		return nil
+	}
+	var throttle struct {
+		Failures  int   `db:"failures"`
+		SinceLast int64 `db:"since_last"`
+		LockedFor int64 `db:"locked_for"`
+	}
+	if err := NamedGet(
+		&throttle,
+		"SELECT failures,TIMESTAMPDIFF(SECOND,time_last_failure,now()) as since_last,IFNULL(TIMESTAMPDIFF(SECOND,now(),locked_until),0) as locked_for"+
+			" FROM login_throttles WHERE kind=:kind AND value=:value",
+		map[string]interface{}{
+			"kind":  kind,
+			"value": value,
+		},
+	); err != nil {
+		return nil //no failures
+	}
+	if throttle.LockedFor > 0 {
+		return LoginThrottledError{Locked: true, Wait: time.Duration(throttle.LockedFor) * time.Second}
+	}
+	if throttle.SinceLast > int64(loginLockoutDuration/time.Second) {
+		return nil //failures are forgotten
+	}
+	if wait := loginDelay(throttle.Failures) - time.Duration(throttle.SinceLast)*time.Second; wait > 0 {
+		return LoginThrottledError{Wait: wait}
+	}
+	return nil
+}
+
+//addLoginFailure counts a failed login and returns true when it caused a lockout
+func addLoginFailure(kind string, value string, threshold int) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	args := map[string]interface{}{
+		"kind":   kind,
+		"value":  value,
+		"window": int64(loginLockoutDuration / time.Second),
+	}
+	//start counting again when previous failures were long ago or after a lockout ended
+	if _, err := db.NamedExec(
+		"INSERT INTO login_throttles SET kind=:kind,value=:value,failures=1,time_last_failure=now(),locked_until=NULL"+
+			" ON DUPLICATE KEY UPDATE"+
+			" failures=IF(TIMESTAMPDIFF(SECOND,time_last_failure,now())>:window OR locked_until<now(),1,failures+1),"+
+			" locked_until=IF(locked_until<now(),NULL,locked_until),"+
+			" time_last_failure=now()",
+		args,
+	); err != nil {
+		return false, errors.Wrapf(err, "failed to count failed login")
+	}
+	result, err := db.NamedExec(
+		"UPDATE login_throttles SET locked_until=now()+INTERVAL :window SECOND"+
+			" WHERE kind=:kind AND value=:value AND locked_until IS NULL AND failures>=:threshold",
+		map[string]interface{}{
+			"kind":      kind,
+			"value":     value,
+			"window":    args["window"],
+			"threshold": threshold,
+		},
+	)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to lock out")
+	}
+	nr, _ := result.RowsAffected()
+	return nr == 1, nil
+}
+
+//loginFailed counts the failure for the username and client IP
+//and records a lockout event when either got locked out
+func loginFailed(req LoginRequest, info *userRow) {
+	ip := clientIP(req.RemoteAddr)
+	lockedUser, err := addLoginFailure(throttleUsername, req.Username, loginLockoutThreshold)
+	if err != nil {
+		log.Errorf("%+v", err)
+	}
+	lockedIP, err := addLoginFailure(throttleIP, ip, loginIPLockoutThreshold)
+	if err != nil {
+		log.Errorf("%+v", err)
+	}
+	if !lockedUser && !lockedIP {
+		return
+	}
+	kind := throttleUsername
+	if !lockedUser {
+		kind = throttleIP
+	}
+	lockout := map[string]interface{}{
+		"kind":        kind,
+		"username":    req.Username,
+		"remote_addr": ip,
+		"account_id":  nil,
+		"user_id":     nil,
+		"duration":    int64(loginLockoutDuration / time.Second),
+	}
+	if info != nil {
+		lockout["account_id"] = info.AccountID
+		lockout["user_id"] = info.UserID
+	}
+	log.Errorf("Login lockout of %s: username(%s) from %s", kind, req.Username, ip)
+	if _, err := db.NamedExec(
+		"INSERT INTO login_lockouts SET kind=:kind,username=:username,remote_addr=:remote_addr,account_id=:account_id,user_id=:user_id,"+
+			"time_created=now(),locked_until=now()+INTERVAL :duration SECOND",
+		lockout,
+	); err != nil {
+		log.Errorf("failed to record lockout: %+v", err)
+	}
+}
+
+//loginSucceeded forgets failures of the username, but not of the IP,
+//else an attacker with one valid login can keep guessing other users' passwords
+func loginSucceeded(username string) {
+	if _, err := db.NamedExec(
+		"DELETE FROM login_throttles WHERE kind=:kind AND value=:value",
+		map[string]interface{}{
+			"kind":  throttleUsername,
+			"value": username,
+		},
+	); err != nil {
+		log.Errorf("failed to reset login failures of user(%s): %+v", username, err)
+	}
+}
+
+//LoginLockout is a recorded lockout caused by failed logins
+type LoginLockout struct {
+	ID           string   `json:"id" db:"id"`
+	Kind         string   `json:"kind" db:"kind" doc:"username or ip, depending on which exceeded the threshold"`
+	Username     string   `json:"username" db:"username" doc:"Username of the failed login that caused the lockout"`
+	RemoteAddr   string   `json:"remote_addr" db:"remote_addr"`
+	AccountID    *string  `json:"account_id,omitempty" db:"account_id"`
+	UserID       *string  `json:"user_id,omitempty" db:"user_id"`
+	TimeCreated  SqlTime  `json:"time_created" db:"time_created"`
+	LockedUntil  SqlTime  `json:"locked_until" db:"locked_until"`
+	UnlockedBy   *string  `json:"unlocked_by,omitempty" db:"unlocked_by_user_id"`
+	TimeUnlocked *SqlTime `json:"time_unlocked,omitempty" db:"time_unlocked"`
+}
+
+//GetLoginLockouts returns the most recent lockouts of users in the account,
+//or of all users and IPs when accountID is ""
+func GetLoginLockouts(accountID string, limit int) ([]LoginLockout, error) {
+	query := "SELECT id,kind,username,remote_addr,account_id,user_id,time_created,locked_until,unlocked_by_user_id,time_unlocked FROM login_lockouts"
+	if accountID != "" {
+		query += " WHERE account_id=:account_id"
+	}
+	query += " ORDER BY time_created DESC LIMIT :limit"
+	var lockouts []LoginLockout
+	if err := NamedSelect(
+		&lockouts,
+		query,
+		map[string]interface{}{
+			"account_id": accountID,
+			"limit":      limit,
+		},
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get lockouts")
+	}
+	return lockouts, nil
+} //GetLoginLockouts()
+
+//UnlockUser clears the failed logins of the user so the user can login immediately
+func UnlockUser(admin User, user User) error {
+	if _, err := db.NamedExec(
+		"DELETE FROM login_throttles WHERE kind=:kind AND value=:value",
+		map[string]interface{}{
+			"kind":  throttleUsername,
+			"value": user.Username,
+		},
+	); err != nil {
+		return errors.Wrapf(err, "failed to unlock user")
+	}
+	if _, err := db.NamedExec(
+		"UPDATE login_lockouts SET unlocked_by_user_id=:admin_id,time_unlocked=now()"+
+			" WHERE user_id=:user_id AND kind=:kind AND time_unlocked IS NULL AND locked_until>now()",
+		map[string]interface{}{
+			"admin_id": admin.ID,
+			"user_id":  user.ID,
+			"kind":     throttleUsername,
+		},
+	); err != nil {
+		return errors.Wrapf(err, "failed to record unlock")
+	}
+	return nil
+} //UnlockUser()
+
+//UnlockIP clears the failed logins from a client IP (sysadmin only)
+func UnlockIP(admin User, ip string) error {
+	result, err := db.NamedExec(
+		"DELETE FROM login_throttles WHERE kind=:kind AND value=:value",
+		map[string]interface{}{
+			"kind":  throttleIP,
+			"value": ip,
+		},
+	)
+	if err != nil {
+		return errors.Wrapf(err, "failed to unlock ip")
+	}
+	if nr, _ := result.RowsAffected(); nr == 0 {
+		return errors.Errorf("ip(%s) has no failed logins", ip)
+	}
+	if _, err := db.NamedExec(
+		"UPDATE login_lockouts SET unlocked_by_user_id=:admin_id,time_unlocked=now()"+
+			" WHERE remote_addr=:ip AND kind=:kind AND time_unlocked IS NULL AND locked_until>now()",
+		map[string]interface{}{
+			"admin_id": admin.ID,
+			"ip":       ip,
+			"kind":     throttleIP,
+		},
+	); err != nil {
+		return errors.Wrapf(err, "failed to record unlock")
+	}
+	return nil
+} //UnlockIP()
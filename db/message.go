@@ -26,21 +26,40 @@ func (fromUser User) SendMessage(toUser *User, message string) (messageID string
 	if message == "" {
 		return "", errors.Errorf("cannot send empty message")
 	}
+	if err := fromUser.checkMessageConsent(); err != nil {
+		return "", err
+	}
+	if fromUser.Account != nil {
+		if err := checkMessagesQuota(db, fromUser.Account.ID); err != nil {
+			return "", err
+		}
+	}
+	return fromUser.addMessage(toUser, message, false)
+} //User.SendMessage()
+
+//sendNotification is for messages that the system sends on behalf of the user, e.g. about a request
+//the user made, it does not need the user's consent and is marked as notification to not count for the quota
+func (fromUser User) sendNotification(toUser *User, message string) (messageID string, err error) {
+	return fromUser.addMessage(toUser, message, true)
+} //User.sendNotification()
+
+func (fromUser User) addMessage(toUser *User, message string, notification bool) (messageID string, err error) {
 	id := uuid.New().String()
 	if _, err := db.NamedExec(
-		"INSERT INTO `messages` SET id=:id,from_user_id=:from_uid,to_user_id=:to_uid,message=:message,time_sent=:time_sent",
+		"INSERT INTO `messages` SET id=:id,from_user_id=:from_uid,to_user_id=:to_uid,message=:message,time_sent=:time_sent,notification=:notification",
 		map[string]interface{}{
-			"id":        id,
-			"from_uid":  fromUser.ID,
-			"to_uid":    toUser.ID,
-			"message":   message,
-			"time_sent": SqlTime(time.Now()),
+			"id":           id,
+			"from_uid":     fromUser.ID,
+			"to_uid":       toUser.ID,
+			"message":      message,
+			"time_sent":    SqlTime(time.Now()),
+			"notification": notification,
 		},
 	); err != nil {
 		return "", errors.Wrapf(err, "failed to create message")
 	}
 	return id, nil
-} //User.SendMessage()
+} //User.addMessage()
 
 type MessageRow struct {
 	ID           string   `db:"id"`
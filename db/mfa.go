@@ -0,0 +1,247 @@
+package db
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/go-msvc/errors"
+)
+
+const (
+	nrRecoveryCodes = 10
+	mfaLoginMaxAge  = 5 * time.Minute //time allowed to enter the code after the password was accepted
+)
+
+type TOTPEnrolment struct {
+	Secret          string   `json:"secret" doc:"Base32 secret to enter manually in an authenticator app"`
+	ProvisioningURI string   `json:"provisioning_uri" doc:"otpauth:// URI to show as QR code"`
+	RecoveryCodes   []string `json:"recovery_codes" doc:"Single use codes to login when the authenticator is lost. They are only shown once."`
+}
+
+//EnrolTOTP generates a new TOTP secret and recovery codes for the user
+//MFA is only enabled after ConfirmTOTP() proved that the user added the secret to an authenticator app
+func EnrolTOTP(user User) (*TOTPEnrolment, error) {
+	var row struct {
+		Enabled bool `db:"totp_enabled"`
+	}
+	if err := NamedGet(&row, "SELECT totp_enabled FROM users WHERE id=:id", map[string]interface{}{"id": user.ID}); err != nil {
+		return nil, errors.Wrapf(err, "failed to get user")
+	}
+	if row.Enabled {
+		return nil, errors.Errorf("TOTP already enabled, disable it before enrolling again")
+	}
+
+	e := TOTPEnrolment{
+		Secret:        newTOTPSecret(),
+		RecoveryCodes: make([]string, nrRecoveryCodes),
+	}
+	e.ProvisioningURI = TOTPProvisioningURI(strDefault(os.Getenv("MFA_ISSUER"), "hotseat"), user.Username, e.Secret)
+	if _, err := db.NamedExec(
+		"UPDATE users SET totp_secret=:secret,totp_enabled=false WHERE id=:id",
+		map[string]interface{}{
+			"id":     user.ID,
+			"secret": e.Secret,
+		},
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to store TOTP secret")
+	}
+
+	if _, err := db.NamedExec(
+		"DELETE FROM `user_recovery_codes` WHERE user_id=:user_id",
+		map[string]interface{}{
+			"user_id": user.ID,
+		},
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to delete old recovery codes")
+	}
+	for i := range e.RecoveryCodes {
+		e.RecoveryCodes[i] = newRandomToken()[:16]
+		if _, err := db.NamedExec(
+			"INSERT INTO `user_recovery_codes` SET user_id=:user_id,code_hash=:code_hash",
+			map[string]interface{}{
+				"user_id":   user.ID,
+				"code_hash": hashToken(e.RecoveryCodes[i]),
+			},
+		); err != nil {
+			return nil, errors.Wrapf(err, "failed to store recovery code")
+		}
+	}
+	return &e, nil
+} //EnrolTOTP()
+
+type MFACodeRequest struct {
+	Code         string `json:"code,omitempty" doc:"Current code from the authenticator app"`
+	RecoveryCode string `json:"recovery_code,omitempty" doc:"One of the recovery codes, if the authenticator is lost"`
+}
+
+//ConfirmTOTP enables TOTP when the code matches the enrolled secret
+//a session that was restricted to MFA enrolment becomes a full session
+func ConfirmTOTP(session Session, req MFACodeRequest) error {
+	secret, _, err := getTOTPSecret(session.User.ID)
+	if err != nil {
+		return errors.Wrapf(err, "not enrolled")
+	}
+	if !ValidTOTP(secret, req.Code, time.Now()) {
+		return errors.Errorf("wrong code")
+	}
+	if _, err := db.NamedExec(
+		"UPDATE users SET totp_enabled=true WHERE id=:id",
+		map[string]interface{}{
+			"id": session.User.ID,
+		},
+	); err != nil {
+		return errors.Wrapf(err, "failed to enable TOTP")
+	}
+	if session.Scope == SessionScopeMFAEnrol {
+		if _, err := db.NamedExec(
+			"UPDATE sessions SET scope=:scope WHERE id=:id",
+			map[string]interface{}{
+				"id":    session.ID,
+				"scope": SessionScopeFull,
+			},
+		); err != nil {
+			return errors.Wrapf(err, "failed to update session")
+		}
+	}
+	return nil
+} //ConfirmTOTP()
+
+//DisableTOTP removes TOTP after checking a current code
+//admins cannot disable it when their account requires MFA
+func DisableTOTP(user User, req MFACodeRequest) error {
+	if mfaMandatory(user) {
+		return errors.Errorf("account requires MFA for admin users")
+	}
+	secret, enabled, err := getTOTPSecret(user.ID)
+	if err != nil || !enabled {
+		return errors.Errorf("TOTP is not enabled")
+	}
+	if !ValidTOTP(secret, req.Code, time.Now()) && !useRecoveryCode(user.ID, req.RecoveryCode) {
+		return errors.Errorf("wrong code")
+	}
+	if _, err := db.NamedExec(
+		"UPDATE users SET totp_secret=NULL,totp_enabled=false WHERE id=:id",
+		map[string]interface{}{
+			"id": user.ID,
+		},
+	); err != nil {
+		return errors.Wrapf(err, "failed to disable TOTP")
+	}
+	if _, err := db.NamedExec(
+		"DELETE FROM `user_recovery_codes` WHERE user_id=:user_id",
+		map[string]interface{}{
+			"user_id": user.ID,
+		},
+	); err != nil {
+		return errors.Wrapf(err, "failed to delete recovery codes")
+	}
+	return nil
+} //DisableTOTP()
+
+//CompleteMFALogin exchanges a session with scope mfa_required for a full session when the code is correct
+//the restricted session is deleted on any attempt, so a wrong code requires a new login
+func CompleteMFALogin(session Session, req MFACodeRequest) (*Session, error) {
+	if session.Scope != SessionScopeMFARequired {
+		return nil, errors.Errorf("session is not waiting for MFA")
+	}
+	if err := Logout(session.Token); err != nil {
+		return nil, errors.Wrapf(err, "failed to delete restricted session")
+	}
+	var info userRow
+	if err := NamedGet(
+		&info,
+		userRowQuery+" WHERE u.id=:id",
+		map[string]interface{}{
+			"id": session.User.ID,
+		},
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get user")
+	}
+	//wrong codes count as failed logins, like wrong passwords
+	login := LoginRequest{
+		Username:   info.Username,
+		UserAgent:  session.UserAgent,
+		RemoteAddr: session.RemoteAddr,
+	}
+	if err := checkLoginThrottle(throttleIP, clientIP(login.RemoteAddr)); err != nil {
+		return nil, err
+	}
+	if err := checkLoginThrottle(throttleUsername, login.Username); err != nil {
+		return nil, err
+	}
+	secret, enabled, err := getTOTPSecret(session.User.ID)
+	if err != nil || !enabled {
+		return nil, errors.Errorf("TOTP is not enabled")
+	}
+	if !ValidTOTP(secret, req.Code, time.Now()) && !useRecoveryCode(session.User.ID, req.RecoveryCode) {
+		loginFailed(login, &info)
+		return nil, errors.Errorf("wrong code")
+	}
+	loginSucceeded(login.Username)
+	return newSession(info, SessionScopeFull, session.UserAgent, session.RemoteAddr)
+} //CompleteMFALogin()
+
+//SetAccountMFARequired makes MFA mandatory (or optional) for admin users of the account
+func SetAccountMFARequired(ctx context.Context, accountID string, required bool) error {
+	before, err := GetAccount(accountID)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get account")
+	}
+	if _, err := db.NamedExec(
+		"UPDATE accounts SET mfa_required=:required WHERE id=:id",
+		map[string]interface{}{
+			"id":       accountID,
+			"required": required,
+		},
+	); err != nil {
+		return errors.Wrapf(err, "failed to update account")
+	}
+	after := *before
+	after.MFARequired = required
+	audit(ctx, accountID, "accounts", accountID, "update", before, after)
+	return nil
+} //SetAccountMFARequired()
+
+//mfaMandatory is true for admin users in accounts that require MFA for their admins,
+//incl. users who are account admin by role, so the user's roles must be loaded
+func mfaMandatory(user User) bool {
+	if user.Account == nil || !user.Account.MFARequired {
+		return false
+	}
+	return user.Account.Admin || Authorize(user, PermAccountManage, user.Account.ID, "") == nil
+}
+
+func getTOTPSecret(userID string) (secret string, enabled bool, err error) {
+	var row struct {
+		Secret  *string `db:"totp_secret"`
+		Enabled bool    `db:"totp_enabled"`
+	}
+	if err := NamedGet(&row, "SELECT totp_secret,totp_enabled FROM users WHERE id=:id", map[string]interface{}{"id": userID}); err != nil {
+		return "", false, errors.Wrapf(err, "failed to get user")
+	}
+	if row.Secret == nil || *row.Secret == "" {
+		return "", false, errors.Errorf("no TOTP secret")
+	}
+	return *row.Secret, row.Enabled, nil
+}
+
+//useRecoveryCode returns true if the code was valid and is now used
+func useRecoveryCode(userID string, code string) bool {
+	if code == "" {
+		return false
+	}
+	result, err := db.NamedExec(
+		"UPDATE `user_recovery_codes` SET time_used=now() WHERE user_id=:user_id AND code_hash=:code_hash AND time_used IS NULL",
+		map[string]interface{}{
+			"user_id":   userID,
+			"code_hash": hashToken(code),
+		},
+	)
+	if err != nil {
+		log.Errorf("failed to use recovery code: %+v", err)
+		return false
+	}
+	nr, _ := result.RowsAffected()
+	return nr == 1
+}
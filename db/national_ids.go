@@ -0,0 +1,112 @@
+package db
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-msvc/errors"
+)
+
+//NationalIDValidator checks a national ID of a country,
+//and when dob and gender are known, that the ID agrees with them
+type NationalIDValidator func(country Country, nationalID string, dob *SqlDate, gender *SqlGender) error
+
+var (
+	nationalIDValidatorsMutex sync.Mutex
+	nationalIDValidators      = map[string]NationalIDValidator{
+		"ZA": ValidateSANationalID,
+	}
+)
+
+//RegisterNationalIDValidator sets the validator for the country by ISO 3166-1 alpha-2 code (or by name
+//for countries without a code), countries without a validator use their national ID regex pattern
+func RegisterNationalIDValidator(countryCodeOrName string, validator NationalIDValidator) {
+	nationalIDValidatorsMutex.Lock()
+	defer nationalIDValidatorsMutex.Unlock()
+	nationalIDValidators[countryCodeOrName] = validator
+}
+
+//ValidateNationalID applies the country's validator, or else the country's regex pattern
+func ValidateNationalID(country Country, nationalID string, dob *SqlDate, gender *SqlGender) error {
+	if nationalID == "" {
+		return errors.Errorf("missing national_id")
+	}
+	nationalIDValidatorsMutex.Lock()
+	validator, ok := nationalIDValidators[country.Name]
+	if country.Code != nil {
+		if v, found := nationalIDValidators[*country.Code]; found {
+			validator, ok = v, true
+		}
+	}
+	nationalIDValidatorsMutex.Unlock()
+	if ok {
+		return validator(country, nationalID, dob, gender)
+	}
+	return validateNationalIDPattern(country, nationalID)
+}
+
+//validateNationalIDPattern matches the whole ID against the country pattern, if the country has one
+func validateNationalIDPattern(country Country, nationalID string) error {
+	if country.NationalIDRegexPattern == nil || *country.NationalIDRegexPattern == "" {
+		return nil
+	}
+	re, err := regexp.Compile("^(?:" + *country.NationalIDRegexPattern + ")$")
+	if err != nil {
+		return errors.Wrapf(err, "invalid national ID pattern for %s", country.Name)
+	}
+	if !re.MatchString(nationalID) {
+		return errors.Errorf("national_id:\"%s\" is not in the format of %s", nationalID, country.Name)
+	}
+	return nil
+}
+
+//ValidateSANationalID checks a South African ID number YYMMDDSSSSCAZ:
+//date of birth, gender sequence (0000-4999 female, 5000-9999 male),
+//citizenship (0 citizen, 1 permanent resident, 2 refugee) and the Luhn check digit Z
+func ValidateSANationalID(country Country, nationalID string, dob *SqlDate, gender *SqlGender) error {
+	if len(nationalID) != 13 || strings.Trim(nationalID, "0123456789") != "" {
+		return errors.Errorf("national_id:\"%s\" must be 13 digits", nationalID)
+	}
+	if !luhnValid(nationalID) {
+		return errors.Errorf("national_id:\"%s\" has an invalid check digit", nationalID)
+	}
+	if _, err := time.Parse("060102", nationalID[0:6]); err != nil {
+		return errors.Errorf("national_id:\"%s\" does not start with a valid date YYMMDD", nationalID)
+	}
+	if c := nationalID[10]; c != '0' && c != '1' && c != '2' {
+		return errors.Errorf("national_id:\"%s\" has invalid citizenship digit %c", nationalID, c)
+	}
+	if dob != nil {
+		if expected := time.Time(*dob).UTC().Format("060102"); nationalID[0:6] != expected {
+			return errors.Errorf("national_id:\"%s\" date of birth %s does not match dob %s", nationalID, nationalID[0:6], dob.String())
+		}
+	}
+	if gender != nil && *gender != SqlGenderUndefined {
+		idGender := SqlGenderFemale
+		if nationalID[6] >= '5' {
+			idGender = SqlGenderMale
+		}
+		if idGender != *gender {
+			return errors.Errorf("national_id:\"%s\" is for a %s, not %s", nationalID, idGender, *gender)
+		}
+	}
+	return nil
+} //ValidateSANationalID()
+
+//luhnValid is true when the last digit is the correct Luhn check digit
+func luhnValid(digits string) bool {
+	sum := 0
+	for i := 0; i < len(digits); i++ {
+		d := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
@@ -0,0 +1,73 @@
+package db_test
+
+import (
+	"testing"
+	"time"
+
+	"bitbucket.org/vservices/hotseat/db"
+)
+
+func TestSANationalID(t *testing.T) {
+	za := "ZA"
+	sa := db.Country{Name: "South Africa", Code: &za}
+	dob := func(s string) *db.SqlDate {
+		d, _ := time.ParseInLocation("2006-01-02", s, time.UTC)
+		sd := db.SqlDate(d)
+		return &sd
+	}
+	male := db.SqlGenderMale
+	female := db.SqlGenderFemale
+
+	tests := []struct {
+		id     string
+		dob    *db.SqlDate
+		gender *db.SqlGender
+		valid  bool
+	}{
+		{"0602271356084", dob("2006-02-27"), &female, true},
+		{"7311185229089", dob("1973-11-18"), &male, true},
+		{"7311185229089", nil, nil, true},
+		{"0602271356085", nil, nil, false},                   //check digit
+		{"060227135608", nil, nil, false},                    //too short
+		{"06022713560a4", nil, nil, false},                   //not digits
+		{"0602271356084", dob("2006-02-28"), nil, false},     //dob mismatch
+		{"0602271356084", dob("2006-02-27"), &male, false},   //gender mismatch
+		{"7311185229089", dob("1973-11-18"), &female, false}, //gender mismatch
+		{"0613271356081", nil, nil, false},                   //month 13
+	}
+	for i, test := range tests {
+		err := db.ValidateNationalID(sa, test.id, test.dob, test.gender)
+		if test.valid && err != nil {
+			t.Errorf("[%d] %s rejected: %+v", i, test.id, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("[%d] %s accepted", i, test.id)
+		}
+		if err != nil {
+			t.Logf("[%d] %s: %v", i, test.id, err)
+		}
+	}
+}
+
+func TestNationalIDPattern(t *testing.T) {
+	pattern := "[A-Z][0-9]{4}"
+	country := db.Country{Name: "Testland", NationalIDRegexPattern: &pattern}
+	if err := db.ValidateNationalID(country, "A1234", nil, nil); err != nil {
+		t.Errorf("A1234 rejected: %+v", err)
+	}
+	for _, id := range []string{"", "A123", "A12345", "XA1234", "a1234"} {
+		if err := db.ValidateNationalID(country, id, nil, nil); err == nil {
+			t.Errorf("%s accepted", id)
+		}
+	}
+	if err := db.ValidateNationalID(db.Country{Name: "Nopattern"}, "anything", nil, nil); err != nil {
+		t.Errorf("country without pattern rejected: %+v", err)
+	}
+
+	db.RegisterNationalIDValidator("Testland", func(country db.Country, nationalID string, dob *db.SqlDate, gender *db.SqlGender) error {
+		return nil
+	})
+	if err := db.ValidateNationalID(country, "A123", nil, nil); err != nil {
+		t.Errorf("registered validator not used: %+v", err)
+	}
+}
@@ -1,10 +1,17 @@
 package db
 
 import (
-	"math/rand"
+	cryptorand "crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"math/big"
 	"strings"
 
 	"github.com/go-msvc/errors"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const (
@@ -32,21 +39,32 @@ func newRandomPassword(n int) string {
 
 	//start with one char from each set at least
 	for _, c := range charSets {
-		s += string(c[rand.Intn(len(c))])
+		s += string(c[randomIntn(len(c))])
 	}
 
 	//add more chars from any set to fill the required length
 	for len(s) < n {
-		s += string(charsAll[rand.Intn(len(charsAll))])
+		s += string(charsAll[randomIntn(len(charsAll))])
 	}
 
+	//shuffle so the first chars are not always from the same sets
 	sRune := []rune(s)
-	rand.Shuffle(len(sRune), func(i, j int) {
+	for i := len(sRune) - 1; i > 0; i-- {
+		j := randomIntn(i + 1)
 		sRune[i], sRune[j] = sRune[j], sRune[i]
-	})
+	}
 	return string(sRune)
 }
 
+//randomIntn is rand.Intn() from crypto/rand because passwords must not be predictable
+func randomIntn(n int) int {
+	i, err := cryptorand.Int(cryptorand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		panic(errors.Wrapf(err, "failed to read random number"))
+	}
+	return int(i.Int64())
+}
+
 func CheckPasswordStrength(s string, minLen int) error {
 	if len(s) < minLen {
 		return errors.Errorf("shorter than %d characters", minLen)
@@ -69,3 +87,76 @@ func CheckPasswordStrength(s string, minLen int) error {
 	}
 	return nil //password is strong enough
 } //CheckPasswordStrength()
+
+//passhash values are stored as "<algorithm>$<hash>" so the algorithm can be
+//upgraded over time, while legacy values without a prefix are sha1 hex strings
+//(salted with the user and account ids) from before passwords were versioned
+const (
+	passhashBcrypt     = "bcrypt"
+	passhashBcryptCost = 12
+)
+
+func hashPassword(password string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), passhashBcryptCost)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to hash password")
+	}
+	return passhashBcrypt + "$" + string(h), nil
+} //hashPassword()
+
+//checkPassword returns ok=true when password matches the stored passhash, and
+//rehash=true when the passhash should be replaced with hashPassword()
+//userID and accountID are only used to verify legacy sha1 hashes
+func checkPassword(passhash string, userID string, accountID string, password string) (ok bool, rehash bool) {
+	if legacyPasshash(passhash) {
+		h := legacyPasswordHash(userID, accountID, password)
+		return subtle.ConstantTimeCompare([]byte(h), []byte(passhash)) == 1, true
+	}
+	parts := strings.SplitN(passhash, "$", 2)
+	if len(parts) != 2 {
+		return false, false
+	}
+	switch parts[0] {
+	case passhashBcrypt:
+		if err := bcrypt.CompareHashAndPassword([]byte(parts[1]), []byte(password)); err != nil {
+			return false, false
+		}
+		cost, err := bcrypt.Cost([]byte(parts[1]))
+		return true, err != nil || cost < passhashBcryptCost
+	default:
+		log.Errorf("unknown passhash algorithm \"%s\"", parts[0])
+		return false, false
+	}
+} //checkPassword()
+
+func legacyPasshash(passhash string) bool {
+	if len(passhash) != sha1.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(passhash)
+	return err == nil
+}
+
+//legacyPasswordHash is the sha1 of user id, account id and password used before passwords were versioned
+//it is only used to verify existing hashes, never to store new ones
+func legacyPasswordHash(userID string, accountID string, password string) string {
+	h := sha1.New()
+	h.Write([]byte(userID + accountID + password))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+//newRandomToken returns a random hex string for single use secrets like activation tokens
+func newRandomToken() string {
+	b := make([]byte, 32)
+	if _, err := cryptorand.Read(b); err != nil {
+		panic(errors.Wrapf(err, "failed to read random bytes"))
+	}
+	return hex.EncodeToString(b)
+}
+
+//hashToken is used to store random tokens, which unlike passwords are long enough
+//not to need a slow hash
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
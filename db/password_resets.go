@@ -0,0 +1,146 @@
+package db
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/google/uuid"
+)
+
+//PasswordResetNotifier must deliver the reset token to the user, e.g. by email
+//the default only logs that a reset was issued, never the token, which would let
+//anyone who reads the logs take over the user
+var PasswordResetNotifier = func(user User, token string, expiry time.Time) error {
+	log.Infof("password reset issued for user(%s), expires %s (no notifier to deliver it)", user.Username, expiry.Format("2006-01-02 15:04:05"))
+	return nil
+}
+
+type ForgotPasswordRequest struct {
+	Username string `json:"username"`
+}
+
+//ForgotPassword issues a single use reset token to the user and returns no error when the user
+//does not exist, so that callers cannot tell which usernames exist
+func ForgotPassword(req ForgotPasswordRequest) error {
+	if req.Username == "" {
+		return errors.Errorf("missing username")
+	}
+	var info userRow
+	if err := NamedGet(
+		&info,
+		userRowQuery+" WHERE u.username=:username",
+		map[string]interface{}{
+			"username": req.Username,
+		},
+	); err != nil {
+		log.Debugf("forgot password for unknown user(%s): %+v", req.Username, err)
+		return nil
+	}
+
+	//only the latest token is valid
+	if _, err := db.NamedExec(
+		"DELETE FROM `password_resets` WHERE user_id=:user_id",
+		map[string]interface{}{
+			"user_id": info.UserID,
+		},
+	); err != nil {
+		return errors.Wrapf(err, "failed to delete old password reset tokens")
+	}
+
+	token := newRandomToken()
+	now := time.Now()
+	expiry := now.Add(time.Duration(intDefault(os.Getenv("PASSWORD_RESET_MINUTES"), 30)) * time.Minute)
+	if _, err := db.NamedExec(
+		"INSERT INTO `password_resets` SET id=:id,user_id=:user_id,token_hash=:token_hash,time_created=:time_created,expiry=:expiry",
+		map[string]interface{}{
+			"id":           uuid.New().String(),
+			"user_id":      info.UserID,
+			"token_hash":   hashToken(token),
+			"time_created": SqlTime(now),
+			"expiry":       SqlTime(expiry),
+		},
+	); err != nil {
+		return errors.Wrapf(err, "failed to create password reset token")
+	}
+	if err := PasswordResetNotifier(info.User(), token, expiry); err != nil {
+		return errors.Wrapf(err, "failed to send password reset token")
+	}
+	return nil
+} //ForgotPassword()
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token" doc:"Token sent to the user after POST /password/forgot"`
+	NewPassword string `json:"new_password"`
+}
+
+//ResetPassword consumes the reset token, sets the new password and ends all sessions of the user
+func ResetPassword(ctx context.Context, req ResetPasswordRequest) error {
+	if req.Token == "" {
+		return errors.Errorf("missing token")
+	}
+	if req.NewPassword == "" {
+		return errors.Errorf("missing new_password")
+	}
+	if err := CheckPasswordStrength(req.NewPassword, 8); err != nil {
+		return errors.Wrapf(err, "new_password not strong enough")
+	}
+
+	var reset struct {
+		ID        string `db:"id"`
+		UserID    string `db:"user_id"`
+		AccountID string `db:"account_id"`
+	}
+	if err := NamedGet(
+		&reset,
+		"SELECT r.id,r.user_id,u.account_id FROM `password_resets` as r INNER JOIN users as u ON u.id=r.user_id"+
+			" WHERE r.token_hash=:token_hash AND r.time_used IS NULL AND r.expiry>:now",
+		map[string]interface{}{
+			"token_hash": hashToken(req.Token),
+			"now":        SqlTime(time.Now()),
+		},
+	); err != nil {
+		return errors.Errorf("invalid or expired token")
+	}
+
+	//use the token, set the password and clear must_change_password together,
+	//else a failure spends the token without changing the password
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	result, err := tx.NamedExec(
+		"UPDATE `password_resets` SET time_used=:now WHERE id=:id AND time_used IS NULL",
+		map[string]interface{}{
+			"id":  reset.ID,
+			"now": SqlTime(time.Now()),
+		},
+	)
+	if err != nil {
+		return errors.Wrapf(err, "failed to use token")
+	}
+	if nr, _ := result.RowsAffected(); nr != 1 {
+		return errors.Errorf("invalid or expired token")
+	}
+	if err := setPassword(tx, reset.UserID, req.NewPassword); err != nil {
+		return errors.Wrapf(err, "failed to set new password")
+	}
+	if _, err := tx.NamedExec(
+		"UPDATE users SET must_change_password=false WHERE id=:user_id",
+		map[string]interface{}{
+			"user_id": reset.UserID,
+		},
+	); err != nil {
+		return errors.Wrapf(err, "failed to clear must_change_password")
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrapf(err, "failed to reset password")
+	}
+	audit(ctx, reset.AccountID, "users", reset.UserID, "reset_password", nil, nil)
+	if _, err := DelUserSessions(reset.UserID, ""); err != nil {
+		return errors.Wrapf(err, "failed to delete user sessions")
+	}
+	return nil
+} //ResetPassword()
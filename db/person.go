@@ -1,11 +1,14 @@
 package db
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/go-msvc/errors"
 	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
 )
 
 type Person struct {
@@ -20,6 +23,7 @@ type Person struct {
 	Nationalities []Nationality `json:"nationalities,omitempty"`
 	Parents       []*Person     `json:"parent,omitempty"`
 	Children      []*Person     `json:"children,omitempty"`
+	Spouses       []*Person     `json:"spouses,omitempty"`
 }
 
 type Nationality struct {
@@ -57,41 +61,70 @@ func (pr personRow) Person() Person {
 const personRowQuery = "SELECT id,name,surname,dob,gender,email,phone FROM persons"
 
 type PersonsFilter struct {
-	Name    *string
-	Surname *string
+	Name       *string    //part of name
+	Surname    *string    //part of surname
+	Email      *string    //part of email
+	Phone      *string    //part of phone
+	Gender     *SqlGender //exact
+	DobFrom    *SqlDate   //born on or after
+	DobTo      *SqlDate   //born on or before
+	NationalID *string    //exact, any nationality
+	GroupID    *string    //member of the group
+	Query      *string    //fuzzy full-text match on name and surname
 }
 
-func GetPersons(filter PersonsFilter, sort []string, limit int) ([]Person, error) {
-	log.Debugf("GetPersons(filter:%+v, sort:%+v, limit:%v)", filter, sort, limit)
+//personSorts whitelists the fields that persons can be sorted on, prefix with "-" for descending
+var personSorts = map[string]string{
+	"name":    "name",
+	"surname": "surname",
+	"dob":     "dob",
+	"email":   "email",
+	"gender":  "gender",
+}
+
+func GetPersons(filter PersonsFilter, sort []string, offset int, limit int) ([]Person, error) {
+	log.Debugf("GetPersons(filter:%+v, sort:%+v, offset:%d, limit:%v)", filter, sort, offset, limit)
 	filterQuery := []string{}
 	filterArgs := map[string]interface{}{}
-	if filter.Name != nil && *filter.Name != "" {
-		filterQuery = append(filterQuery, "name like %%:name%%")
-		filterArgs["name"] = *filter.Name
-	}
-	if filter.Surname != nil && *filter.Surname != "" {
-		filterQuery = append(filterQuery, "surname like %%:surname%%")
-		filterArgs["surname"] = *filter.Surname
-	}
-	// 	case "email":
-	// 		filterQuery = append(filterQuery, "email like %%:email%%")
-	// 		filterArgs["email"] = v
-	// 	case "phone":
-	// 		filterQuery = append(filterQuery, "phone like %%:phone%%")
-	// 		filterArgs["phone"] = v
-	// 	case "gender":
-	// 		filterQuery = append(filterQuery, "gender=:gender")
-	// 		filterArgs["gender"] = v
-	// 	case "dob_before":
-	// 		filterQuery = append(filterQuery, "dob<=:dob_before")
-	// 		filterArgs["dob_before"] = v
-	// 	case "dob_after":
-	// 		filterQuery = append(filterQuery, "dob>=:dob_after")
-	// 		filterArgs["dob_after"] = v
-	// 	default:
-	// 		return nil, errors.Errorf("unknown filter field \"%s\"", n)
-	// 	}
-	// }
+	for _, f := range []struct {
+		column string
+		value  *string
+	}{
+		{"name", filter.Name},
+		{"surname", filter.Surname},
+		{"email", filter.Email},
+		{"phone", filter.Phone},
+	} {
+		if f.value != nil && *f.value != "" {
+			filterQuery = append(filterQuery, f.column+" like :"+f.column)
+			filterArgs[f.column] = likeContains(*f.value)
+		}
+	}
+	if filter.Gender != nil {
+		filterQuery = append(filterQuery, "gender=:gender")
+		filterArgs["gender"] = *filter.Gender
+	}
+	if filter.DobFrom != nil {
+		filterQuery = append(filterQuery, "dob>=:dob_from")
+		filterArgs["dob_from"] = *filter.DobFrom
+	}
+	if filter.DobTo != nil {
+		filterQuery = append(filterQuery, "dob<=:dob_to")
+		filterArgs["dob_to"] = *filter.DobTo
+	}
+	if filter.NationalID != nil && *filter.NationalID != "" {
+		filterQuery = append(filterQuery, "id IN (SELECT person_id FROM person_nationalities WHERE national_id=:national_id)")
+		filterArgs["national_id"] = *filter.NationalID
+	}
+	if filter.GroupID != nil && *filter.GroupID != "" {
+		filterQuery = append(filterQuery, "id IN (SELECT person_id FROM group_members WHERE group_id=:group_id)")
+		filterArgs["group_id"] = *filter.GroupID
+	}
+	if filter.Query != nil && *filter.Query != "" {
+		//uses the FULLTEXT index on name,surname
+		filterQuery = append(filterQuery, "MATCH(name,surname) AGAINST(:query)")
+		filterArgs["query"] = *filter.Query
+	}
 
 	query := personRowQuery
 	for i, f := range filterQuery {
@@ -101,22 +134,31 @@ func GetPersons(filter PersonsFilter, sort []string, limit int) ([]Person, error
 			query += " and " + f
 		}
 	}
-	if len(sort) > 0 {
-		query += " order by "
-		for i, s := range sort {
-			if i > 0 {
-				query += ","
-			}
-			query += s
+	orderBy := []string{}
+	for _, s := range sort {
+		desc := strings.HasPrefix(s, "-")
+		column, ok := personSorts[strings.TrimPrefix(s, "-")]
+		if !ok {
+			return nil, errors.Errorf("cannot sort on \"%s\"", s)
 		}
+		if desc {
+			column += " desc"
+		}
+		orderBy = append(orderBy, column)
 	}
+	//id makes the order stable for paging
+	orderBy = append(orderBy, "id")
+	query += " order by " + strings.Join(orderBy, ",")
 	if limit <= 0 {
 		limit = 10
 	}
 	if limit > 100 {
 		limit = 100
 	}
-	query += fmt.Sprintf(" limit %d", limit)
+	if offset < 0 {
+		offset = 0
+	}
+	query += fmt.Sprintf(" limit %d offset %d", limit, offset)
 
 	var personRows []personRow
 	if err := NamedSelect(&personRows, query, filterArgs); err != nil {
@@ -130,62 +172,143 @@ func GetPersons(filter PersonsFilter, sort []string, limit int) ([]Person, error
 	return persons, nil
 }
 
+//GetPerson returns the person with parents, children and spouses (without their relations)
 func GetPerson(id string) (*Person, error) {
 	var pr personRow
 	if err := NamedGet(&pr, personRowQuery+" where id=:id", map[string]interface{}{"id": id}); err != nil {
 		return nil, errors.Errorf("failed to read person record")
 	}
 	person := pr.Person()
+	var err error
+	if person.Parents, err = getRelatives(personRowQuery+" WHERE id IN (SELECT person_id_of_parent FROM person_parents WHERE person_id_of_child=:id)", id); err != nil {
+		return nil, errors.Wrapf(err, "failed to read parents")
+	}
+	if person.Children, err = getRelatives(personRowQuery+" WHERE id IN (SELECT person_id_of_child FROM person_parents WHERE person_id_of_parent=:id)", id); err != nil {
+		return nil, errors.Wrapf(err, "failed to read children")
+	}
+	if person.Spouses, err = getRelatives(personRowQuery+" WHERE id IN (SELECT person_id_b FROM person_spouses WHERE person_id_a=:id UNION SELECT person_id_a FROM person_spouses WHERE person_id_b=:id)", id); err != nil {
+		return nil, errors.Wrapf(err, "failed to read spouses")
+	}
 	return &person, nil
 }
 
+func getRelatives(query string, id string) ([]*Person, error) {
+	var rows []personRow
+	if err := NamedSelect(&rows, query+" ORDER BY dob", map[string]interface{}{"id": id}); err != nil {
+		return nil, err
+	}
+	relatives := make([]*Person, len(rows))
+	for i, pr := range rows {
+		p := pr.Person()
+		relatives[i] = &p
+	}
+	return relatives, nil
+}
+
 //like upsert, returns existing person if found
-func AddPersonIfNotExist(p Person) (*Person, error) {
-	//todo: use common GetPerson with this key instead of ID
-	var existingPersonRow personRow
-	if err := NamedGet(
-		&existingPersonRow,
-		"SELECT id FROM persons WHERE name=:name AND surname=:surname AND dob=:dob AND gender=:gender", //check for duplicate on unique key
-		map[string]interface{}{
-			"name":    p.Name,
-			"surname": p.Surname,
-			"gender":  *p.Gender,
-			"dob":     *p.Dob,
-		},
-	); err != nil {
+func AddPersonIfNotExist(ctx context.Context, p Person) (*Person, error) {
+	id, err := findPerson(db, p)
+	if err != nil {
 		log.Debugf("did not get duplicate person, adding... %+v", err)
-		return AddPerson(p)
+		return AddPerson(ctx, p)
 	}
-	p.ID = existingPersonRow.ID
+	p.ID = id
 	log.Debugf("found existing person: %+v", p)
 	return &p, nil
 }
 
-func AddPerson(p Person) (*Person, error) {
+//findPerson returns the id of the person with the same unique key
+func findPerson(q sqlx.Queryer, p Person) (string, error) {
+	if p.Gender == nil || p.Dob == nil {
+		return "", errors.Errorf("missing gender or dob")
+	}
+	//todo: use common GetPerson with this key instead of ID
+	var id string
+	if err := sqlx.Get(
+		q,
+		&id,
+		"SELECT id FROM persons WHERE name=? AND surname=? AND dob=? AND gender=?", //check for duplicate on unique key
+		p.Name,
+		p.Surname,
+		*p.Dob,
+		*p.Gender,
+	); err != nil {
+		return "", errors.Wrapf(err, "person not found")
+	}
+	return id, nil
+}
+
+//personClaimed is true when the person has a user or is linked to family,
+//then nobody else may take the person as their own
+func personClaimed(q sqlx.Queryer, id string) (bool, error) {
+	var nr int
+	if err := sqlx.Get(
+		q,
+		&nr,
+		"SELECT (SELECT COUNT(*) FROM users WHERE person_id=?)"+
+			"+(SELECT COUNT(*) FROM person_parents WHERE person_id_of_parent=? OR person_id_of_child=?)"+
+			"+(SELECT COUNT(*) FROM person_spouses WHERE person_id_a=? OR person_id_b=?)",
+		id, id, id, id, id,
+	); err != nil {
+		return false, errors.Wrapf(err, "failed to check person")
+	}
+	return nr > 0, nil
+}
+
+func (p Person) Validate() error {
 	if p.Name == "" {
-		return nil, errors.Errorf("missing name")
+		return errors.Errorf("missing name")
 	}
 	if p.Surname == "" {
-		return nil, errors.Errorf("missing surname")
+		return errors.Errorf("missing surname")
 	}
 	if p.Email == nil || !ValidEmail(*p.Email) {
-		return nil, errors.Errorf("missing/invalid email")
+		return errors.Errorf("missing/invalid email")
 	}
 	if p.Phone == nil || *p.Phone == "" {
-		return nil, errors.Errorf("missing phone")
+		return errors.Errorf("missing phone")
 	}
 	if p.Dob == nil || time.Time(*p.Dob).Before(registerDobMin) || time.Time(*p.Dob).After(time.Now()) {
-		return nil, errors.Errorf("missing or invalid dob")
+		return errors.Errorf("missing or invalid dob")
 	}
 	if p.Gender == nil || (*p.Gender != SqlGenderMale && *p.Gender != SqlGenderFemale) {
-		return nil, errors.Errorf("missing or invalid gender")
+		return errors.Errorf("missing or invalid gender")
 	}
 	if len(p.Nationalities) < 1 {
-		return nil, errors.Errorf("missing nationalities")
+		return errors.Errorf("missing nationalities")
 	}
+	for _, n := range p.Nationalities {
+		if n.Country == nil || n.Country.ID == "" {
+			return errors.Errorf("missing nationality country")
+		}
+		//load the country from the db for its code and pattern
+		country, err := GetCountryByID(n.Country.ID)
+		if err != nil {
+			return errors.Errorf("unknown country(%s)", n.Country.ID)
+		}
+		if err := ValidateNationalID(*country, n.NationalID, p.Dob, p.Gender); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func AddPerson(ctx context.Context, p Person) (*Person, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	if err := addPerson(db, &p); err != nil {
+		return nil, err
+	}
+	audit(ctx, "", "persons", p.ID, "create", nil, p)
+	return &p, nil
+}
 
+//addPerson inserts a valid person with a new id, in a transaction or not
+func addPerson(e sqlx.Ext, p *Person) error {
 	p.ID = uuid.New().String()
-	if _, err := db.NamedExec(
+	if _, err := sqlx.NamedExec(
+		e,
 		"INSERT INTO `persons` SET id=:id,name=:name,surname=:surname,gender=:gender,dob=:dob,email=:email,phone=:phone",
 		map[string]interface{}{
 			"id":      p.ID,
@@ -197,11 +320,12 @@ func AddPerson(p Person) (*Person, error) {
 			"phone":   *p.Phone,
 		},
 	); err != nil {
-		return nil, errors.Wrapf(err, "failed to create person record")
+		return errors.Wrapf(err, "failed to create person record")
 	}
 
 	for _, n := range p.Nationalities {
-		if _, err := db.NamedExec(
+		if _, err := sqlx.NamedExec(
+			e,
 			"INSERT INTO person_nationalities SET person_id=:pid,country_id=:cid,national_id=:nid",
 			map[string]interface{}{
 				"pid": p.ID,
@@ -209,9 +333,8 @@ func AddPerson(p Person) (*Person, error) {
 				"nid": n.NationalID,
 			},
 		); err != nil {
-			return nil, errors.Wrapf(err, "failed to create nationality record")
+			return errors.Wrapf(err, "failed to create nationality record")
 		}
 	}
-
-	return &p, nil
+	return nil
 }
@@ -0,0 +1,219 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/jmoiron/sqlx"
+)
+
+//Plan limits the usage of an account, nil limits are unlimited
+type Plan struct {
+	ID                string `json:"id"`
+	Name              string `json:"name"`
+	MaxUsers          *int   `json:"max_users,omitempty" db:"max_users"`
+	MaxGroups         *int   `json:"max_groups,omitempty" db:"max_groups"`
+	MaxGroupMembers   *int   `json:"max_group_members,omitempty" db:"max_group_members" doc:"Max nr of members in each group"`
+	MaxMessagesPerDay *int   `json:"max_messages_per_day,omitempty" db:"max_messages_per_day" doc:"Max nr of messages sent by all users of the account in the last 24 hours"`
+}
+
+//unlimitedPlan applies to accounts without a plan, e.g. the system and public accounts
+var unlimitedPlan = Plan{Name: "unlimited"}
+
+//new accounts get this plan
+var defaultPlanName = strDefault(os.Getenv("ACCOUNT_DEFAULT_PLAN"), "free")
+
+//quotas named in QuotaExceededError
+const (
+	QuotaUsers          = "users"
+	QuotaGroups         = "groups"
+	QuotaGroupMembers   = "group_members"
+	QuotaMessagesPerDay = "messages_per_day"
+)
+
+const messagesQuotaPeriod = 24 * time.Hour
+
+//QuotaExceededError is returned when the account plan does not allow more
+type QuotaExceededError struct {
+	Quota string
+	Limit int
+	Plan  string
+}
+
+func (e QuotaExceededError) Error() string {
+	return fmt.Sprintf("quota exceeded: %s limit of %d reached on plan %s", e.Quota, e.Limit, e.Plan)
+}
+
+func GetPlans() ([]Plan, error) {
+	var plans []Plan
+	if err := NamedSelect(&plans, "SELECT * FROM plans ORDER BY name", map[string]interface{}{}); err != nil {
+		return nil, errors.Wrapf(err, "failed to get plans")
+	}
+	return plans, nil
+}
+
+func GetPlanByName(name string) (*Plan, error) {
+	var plan Plan
+	if err := NamedGet(&plan, "SELECT * FROM plans WHERE name=:name", map[string]interface{}{"name": name}); err != nil {
+		return nil, errors.Errorf("plan(%s) not found", name)
+	}
+	return &plan, nil
+}
+
+//GetAccountPlan returns the plan of the account, or the unlimited plan when the account has none
+func GetAccountPlan(q sqlx.Queryer, accountID string) (*Plan, error) {
+	var plans []Plan
+	if err := sqlx.Select(
+		q,
+		&plans,
+		"SELECT p.* FROM plans as p INNER JOIN accounts as a ON a.plan_id=p.id WHERE a.id=?",
+		accountID,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get account plan")
+	}
+	if len(plans) == 0 {
+		plan := unlimitedPlan
+		return &plan, nil
+	}
+	return &plans[0], nil
+}
+
+//Usage is the current consumption against the plan limit, Limit is omitted when unlimited
+type Usage struct {
+	Used  int  `json:"used"`
+	Limit *int `json:"limit,omitempty"`
+}
+
+type AccountUsage struct {
+	Plan            Plan  `json:"plan"`
+	Users           Usage `json:"users"`
+	Groups          Usage `json:"groups"`
+	MaxGroupMembers Usage `json:"max_group_members" doc:"Used is the nr of members in the largest group"`
+	MessagesLast24h Usage `json:"messages_last_24h"`
+}
+
+func GetAccountUsage(accountID string) (*AccountUsage, error) {
+	plan, err := GetAccountPlan(db, accountID)
+	if err != nil {
+		return nil, err
+	}
+	usage := AccountUsage{Plan: *plan}
+	if usage.Users.Used, err = countAccountUsers(db, accountID); err != nil {
+		return nil, err
+	}
+	if usage.Groups.Used, err = countAccountGroups(db, accountID); err != nil {
+		return nil, err
+	}
+	if err := sqlx.Get(
+		db,
+		&usage.MaxGroupMembers.Used,
+		"SELECT COALESCE(MAX(n),0) FROM (SELECT COUNT(*) as n FROM group_members as m INNER JOIN groups as g ON g.id=m.group_id WHERE g.account_id=? AND m.accepted=true GROUP BY m.group_id) as c",
+		accountID,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to count group members")
+	}
+	if usage.MessagesLast24h.Used, err = countAccountMessages(db, accountID); err != nil {
+		return nil, err
+	}
+	usage.Users.Limit = plan.MaxUsers
+	usage.Groups.Limit = plan.MaxGroups
+	usage.MaxGroupMembers.Limit = plan.MaxGroupMembers
+	usage.MessagesLast24h.Limit = plan.MaxMessagesPerDay
+	return &usage, nil
+} //GetAccountUsage()
+
+//checkQuota returns QuotaExceededError when used already reached the limit
+func checkQuota(plan Plan, quota string, limit *int, used int) error {
+	if limit == nil || used < *limit {
+		return nil
+	}
+	return QuotaExceededError{Quota: quota, Limit: *limit, Plan: plan.Name}
+}
+
+//checkUsersQuota checks that the account may add another user
+func checkUsersQuota(q sqlx.Queryer, accountID string) error {
+	plan, err := GetAccountPlan(q, accountID)
+	if err != nil || plan.MaxUsers == nil {
+		return err
+	}
+	used, err := countAccountUsers(q, accountID)
+	if err != nil {
+		return err
+	}
+	return checkQuota(*plan, QuotaUsers, plan.MaxUsers, used)
+}
+
+//checkGroupsQuota checks that the account may add another group
+func checkGroupsQuota(q sqlx.Queryer, accountID string) error {
+	plan, err := GetAccountPlan(q, accountID)
+	if err != nil || plan.MaxGroups == nil {
+		return err
+	}
+	used, err := countAccountGroups(q, accountID)
+	if err != nil {
+		return err
+	}
+	return checkQuota(*plan, QuotaGroups, plan.MaxGroups, used)
+}
+
+//checkGroupMembersQuota checks that the group may get another member,
+//only accepted members count, not pending or rejected applications
+func checkGroupMembersQuota(q sqlx.Queryer, accountID string, groupID string) error {
+	plan, err := GetAccountPlan(q, accountID)
+	if err != nil || plan.MaxGroupMembers == nil {
+		return err
+	}
+	var used int
+	if err := sqlx.Get(q, &used, "SELECT COUNT(*) FROM group_members WHERE group_id=? AND accepted=true", groupID); err != nil {
+		return errors.Wrapf(err, "failed to count group members")
+	}
+	return checkQuota(*plan, QuotaGroupMembers, plan.MaxGroupMembers, used)
+}
+
+//checkMessagesQuota checks that users of the account may send another message today
+func checkMessagesQuota(q sqlx.Queryer, accountID string) error {
+	plan, err := GetAccountPlan(q, accountID)
+	if err != nil || plan.MaxMessagesPerDay == nil {
+		return err
+	}
+	used, err := countAccountMessages(q, accountID)
+	if err != nil {
+		return err
+	}
+	return checkQuota(*plan, QuotaMessagesPerDay, plan.MaxMessagesPerDay, used)
+}
+
+//anonymised users do not count
+func countAccountUsers(q sqlx.Queryer, accountID string) (int, error) {
+	var n int
+	if err := sqlx.Get(q, &n, "SELECT COUNT(*) FROM users WHERE account_id=? AND username NOT LIKE 'deleted-%'", accountID); err != nil {
+		return 0, errors.Wrapf(err, "failed to count users")
+	}
+	return n, nil
+}
+
+//invitations to create a sub-group do not count until accepted
+func countAccountGroups(q sqlx.Queryer, accountID string) (int, error) {
+	var n int
+	if err := sqlx.Get(q, &n, "SELECT COUNT(*) FROM groups WHERE account_id=? AND invitation=false", accountID); err != nil {
+		return 0, errors.Wrapf(err, "failed to count groups")
+	}
+	return n, nil
+}
+
+//notifications do not count
+func countAccountMessages(q sqlx.Queryer, accountID string) (int, error) {
+	var n int
+	if err := sqlx.Get(
+		q,
+		&n,
+		"SELECT COUNT(*) FROM messages as m INNER JOIN users as u ON u.id=m.from_user_id WHERE u.account_id=? AND m.time_sent>? AND m.notification=false",
+		accountID,
+		SqlTime(time.Now().Add(-messagesQuotaPeriod)),
+	); err != nil {
+		return 0, errors.Wrapf(err, "failed to count messages")
+	}
+	return n, nil
+}
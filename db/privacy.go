@@ -0,0 +1,360 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+//PersonExport is everything stored about a person, for a subject access request (POPIA/GDPR)
+type PersonExport struct {
+	TimeExported  SqlTime           `json:"time_exported"`
+	Person        Person            `json:"person" doc:"Profile with parents, children and spouses"`
+	Nationalities []Nationality     `json:"nationalities"`
+	Addresses     []Address         `json:"addresses"`
+	Metas         Metas             `json:"metas"`
+	Users         []User            `json:"users" doc:"Users linked to the person"`
+	Memberships   []GroupMembership `json:"memberships"`
+	Messages      []Message         `json:"messages" doc:"Messages sent and received by the users"`
+	Erasures      []PersonErasure   `json:"erasures,omitempty"`
+	Changes       []AuditRecord     `json:"changes" doc:"Audit log of changes to the person"`
+}
+
+type GroupMembership struct {
+	GroupID     string  `json:"group_id" db:"group_id"`
+	GroupName   string  `json:"group_name" db:"group_name"`
+	AccountName string  `json:"account_name" db:"account_name"`
+	TimeCreated SqlTime `json:"time_created" db:"time_created"`
+	TimeUpdated SqlTime `json:"time_updated" db:"time_updated"`
+	Accepted    bool    `json:"accepted" db:"accepted"`
+	Rejected    *string `json:"rejected,omitempty" db:"rejected"`
+	FieldValues *string `json:"field_values,omitempty" db:"field_values" doc:"JSON values submitted with the application"`
+}
+
+//authorizePersonData allows the person, a parent of a dependant and sysadmin
+func authorizePersonData(user User, personID string) error {
+	if Authorize(user, PermSystemManage, "", "") == nil {
+		return nil
+	}
+	if _, err := ActFor(user, personID); err != nil {
+		return err
+	}
+	return nil
+}
+
+//ExportPerson returns all data linked to the person
+func ExportPerson(ctx context.Context, user User, personID string) (*PersonExport, error) {
+	if err := authorizePersonData(user, personID); err != nil {
+		return nil, err
+	}
+	person, err := GetPerson(personID)
+	if err != nil {
+		return nil, errors.Errorf("person(%s) not found", personID)
+	}
+	export := &PersonExport{
+		TimeExported: SqlTime(time.Now()),
+		Person:       *person,
+	}
+	args := map[string]interface{}{"id": personID}
+
+	var nationalities []struct {
+		CountryID  string `db:"country_id"`
+		NationalID string `db:"national_id"`
+	}
+	if err := NamedSelect(&nationalities, "SELECT country_id,national_id FROM person_nationalities WHERE person_id=:id", args); err != nil {
+		return nil, errors.Wrapf(err, "failed to get nationalities")
+	}
+	export.Nationalities = make([]Nationality, len(nationalities))
+	for i, n := range nationalities {
+		export.Nationalities[i].NationalID = n.NationalID
+		if export.Nationalities[i].Country, err = GetCountryByID(n.CountryID); err != nil {
+			return nil, err
+		}
+	}
+
+	if export.Addresses, err = getAddresses("persons", personID); err != nil {
+		return nil, err
+	}
+	if export.Metas, err = GetMetas("persons", personID); err != nil {
+		return nil, err
+	}
+
+	var userRows []userRow
+	if err := NamedSelect(&userRows, userRowQuery+" WHERE u.person_id=:id", args); err != nil {
+		return nil, errors.Wrapf(err, "failed to get users")
+	}
+	export.Users = make([]User, len(userRows))
+	for i, ur := range userRows {
+		export.Users[i] = ur.User()
+	}
+
+	if err := NamedSelect(
+		&export.Memberships,
+		"SELECT gm.group_id,g.name as group_name,a.name as account_name,gm.time_created,gm.time_updated,gm.accepted,gm.rejected,gm.field_values"+
+			" FROM group_members as gm JOIN groups as g ON g.id=gm.group_id JOIN accounts as a ON a.id=g.account_id"+
+			" WHERE gm.person_id=:id ORDER BY gm.time_created",
+		args,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get memberships")
+	}
+
+	var messageRows []MessageRow
+	if err := NamedSelect(
+		&messageRows,
+		"SELECT m.id,m.from_user_id,u1.username as from_username,m.to_user_id,u2.username as to_username,m.message,m.time_sent,m.time_read"+
+			" FROM `messages` as m JOIN users as u1 ON m.from_user_id=u1.id JOIN users as u2 ON m.to_user_id=u2.id"+
+			" WHERE u1.person_id=:id OR u2.person_id=:id ORDER BY m.time_sent",
+		args,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get messages")
+	}
+	export.Messages = make([]Message, len(messageRows))
+	for i, mr := range messageRows {
+		export.Messages[i] = mr.Message()
+	}
+
+	if export.Erasures, err = getPersonErasures("person_id", personID); err != nil {
+		return nil, err
+	}
+	table := "persons"
+	if export.Changes, err = GetAudit(AuditFilter{Table: &table, ID: &personID}, 1000); err != nil {
+		return nil, err
+	}
+	audit(ctx, "", "persons", personID, "export", nil, nil)
+	return export, nil
+} //ExportPerson()
+
+type PersonErasureStatus string
+
+const (
+	PersonErasureRequested PersonErasureStatus = "requested"
+	PersonErasureCompleted PersonErasureStatus = "completed"
+	PersonErasureRejected  PersonErasureStatus = "rejected"
+)
+
+//PersonErasure is a request to erase a person (right to erasure), processed by sysadmin
+type PersonErasure struct {
+	ID                string              `json:"id" db:"id"`
+	PersonID          string              `json:"person_id" db:"person_id"`
+	Reason            string              `json:"reason,omitempty" db:"reason"`
+	RequestedByUserID string              `json:"requested_by_user_id" db:"requested_by_user_id"`
+	TimeRequested     SqlTime             `json:"time_requested" db:"time_requested"`
+	Status            PersonErasureStatus `json:"status" db:"status"`
+	ProcessedByUserID *string             `json:"processed_by_user_id,omitempty" db:"processed_by_user_id"`
+	TimeProcessed     *SqlTime            `json:"time_processed,omitempty" db:"time_processed"`
+	Note              *string             `json:"note,omitempty" db:"note" doc:"Why the request was rejected, or remarks on completion"`
+}
+
+const personErasureQuery = "SELECT id,person_id,reason,requested_by_user_id,time_requested,status,processed_by_user_id,time_processed,note FROM person_erasures"
+
+func getPersonErasures(column string, value string) ([]PersonErasure, error) {
+	list := []PersonErasure{}
+	if err := NamedSelect(
+		&list,
+		personErasureQuery+" WHERE "+column+"=:value ORDER BY time_requested",
+		map[string]interface{}{"value": value},
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get erasure requests")
+	}
+	return list, nil
+}
+
+func getPersonErasure(id string) (*PersonErasure, error) {
+	var pe PersonErasure
+	if err := NamedGet(&pe, personErasureQuery+" WHERE id=:id", map[string]interface{}{"id": id}); err != nil {
+		return nil, errors.Errorf("erasure request(%s) not found", id)
+	}
+	return &pe, nil
+}
+
+//GetPersonErasures lists erasure requests with the status (sysadmin only)
+func GetPersonErasures(user User, status PersonErasureStatus) ([]PersonErasure, error) {
+	if err := Authorize(user, PermSystemManage, "", ""); err != nil {
+		return nil, errors.Wrapf(err, "only sysadmin can list erasure requests")
+	}
+	return getPersonErasures("status", string(status))
+}
+
+//RequestPersonErasure records who asked to erase the person and when,
+//the person is only erased once sysadmin completes the request
+func RequestPersonErasure(ctx context.Context, user User, personID string, reason string) (*PersonErasure, error) {
+	if err := authorizePersonData(user, personID); err != nil {
+		return nil, err
+	}
+	if _, err := GetPerson(personID); err != nil {
+		return nil, errors.Errorf("person(%s) not found", personID)
+	}
+	var nr int
+	if err := db.Get(&nr, "SELECT COUNT(*) FROM person_erasures WHERE person_id=? AND status=?", personID, PersonErasureRequested); err != nil {
+		return nil, errors.Wrapf(err, "failed to check erasure requests")
+	}
+	if nr > 0 {
+		return nil, errors.Errorf("person(%s) already has a pending erasure request", personID)
+	}
+	id := uuid.New().String()
+	if _, err := db.NamedExec(
+		"INSERT INTO person_erasures SET id=:id,person_id=:person_id,reason=:reason,requested_by_user_id=:user_id,time_requested=:time_requested,status=:status",
+		map[string]interface{}{
+			"id":             id,
+			"person_id":      personID,
+			"reason":         reason,
+			"user_id":        user.ID,
+			"time_requested": SqlTime(time.Now()),
+			"status":         PersonErasureRequested,
+		},
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to request erasure")
+	}
+	pe, err := getPersonErasure(id)
+	if err != nil {
+		return nil, err
+	}
+	audit(ctx, "", "person_erasures", id, "create", nil, pe)
+	return pe, nil
+}
+
+//RejectPersonErasure closes the request without erasing, e.g. when the data must be kept by law (sysadmin only)
+func RejectPersonErasure(ctx context.Context, user User, id string, note string) (*PersonErasure, error) {
+	if err := Authorize(user, PermSystemManage, "", ""); err != nil {
+		return nil, errors.Wrapf(err, "only sysadmin can process erasure requests")
+	}
+	if note == "" {
+		return nil, errors.Errorf("missing note with reason for rejecting")
+	}
+	before, err := getPendingPersonErasure(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := setPersonErasureStatus(db, id, user, PersonErasureRejected, note); err != nil {
+		return nil, err
+	}
+	after, err := getPersonErasure(id)
+	if err != nil {
+		return nil, err
+	}
+	audit(ctx, "", "person_erasures", id, "reject", before, after)
+	return after, nil
+}
+
+func getPendingPersonErasure(id string) (*PersonErasure, error) {
+	pe, err := getPersonErasure(id)
+	if err != nil {
+		return nil, err
+	}
+	if pe.Status != PersonErasureRequested {
+		return nil, errors.Errorf("erasure request(%s) is already %s", id, pe.Status)
+	}
+	return pe, nil
+}
+
+func setPersonErasureStatus(e sqlx.Ext, id string, user User, status PersonErasureStatus, note string) error {
+	values := map[string]interface{}{
+		"id":             id,
+		"status":         status,
+		"user_id":        user.ID,
+		"time_processed": SqlTime(time.Now()),
+		"note":           nil,
+	}
+	if note != "" {
+		values["note"] = note
+	}
+	if _, err := sqlx.NamedExec(
+		e,
+		"UPDATE person_erasures SET status=:status,processed_by_user_id=:user_id,time_processed=:time_processed,note=:note WHERE id=:id",
+		values,
+	); err != nil {
+		return errors.Wrapf(err, "failed to update erasure request")
+	}
+	return nil
+}
+
+//personErasureSteps anonymise a person in place, so that group memberships and other records
+//that refer to the person remain valid, while everything that identifies the person is removed
+var personErasureSteps = []string{
+	//keep who changed what and when, but not the personal values: audit values of the person and
+	//the person's users, and of everything that refers to them (addresses, family, consents, memberships)
+	"UPDATE `log` SET `before`=NULL,`after`=NULL WHERE (`table`='persons' AND id=:id)" +
+		" OR (`table`='addresses' AND id IN (SELECT id FROM addresses WHERE table_name='persons' AND table_id=:id))" +
+		" OR `before` LIKE CONCAT('%',:id,'%') OR `after` LIKE CONCAT('%',:id,'%')",
+	"UPDATE `log` as l SET l.`before`=NULL,l.`after`=NULL WHERE EXISTS (SELECT 1 FROM users as u WHERE u.person_id=:id" +
+		" AND ((l.`table`='users' AND l.id=u.id) OR l.`before` LIKE CONCAT('%',u.id,'%') OR l.`after` LIKE CONCAT('%',u.id,'%')))",
+	"UPDATE `log` SET username=CONCAT('deleted-',user_id) WHERE user_id IN (SELECT id FROM users WHERE person_id=:id)",
+	"DELETE FROM person_nationalities WHERE person_id=:id",
+	"DELETE FROM person_parents WHERE person_id_of_parent=:id OR person_id_of_child=:id",
+	"DELETE FROM person_spouses WHERE person_id_a=:id OR person_id_b=:id",
+	"DELETE FROM family_requests WHERE person_id=:id OR requested_by_person_id=:id",
+	"DELETE FROM addresses WHERE table_name='persons' AND table_id=:id",
+	"DELETE FROM metas WHERE table_name='persons' AND table_id=:id",
+	"UPDATE group_members SET field_values=NULL WHERE person_id=:id",
+	"UPDATE persons SET name='erased',surname=:id,dob=NULL,gender=NULL,email=NULL,phone=NULL WHERE id=:id",
+	//keep the messages for the other party, but not what the person wrote
+	"UPDATE messages SET message='' WHERE from_user_id IN (SELECT id FROM users WHERE person_id=:id)",
+}
+
+//CompletePersonErasure anonymises the person and the person's users (sysadmin only),
+//the erasure request remains as the record of who asked and when
+func CompletePersonErasure(ctx context.Context, user User, id string, note string) (*PersonErasure, error) {
+	if err := Authorize(user, PermSystemManage, "", ""); err != nil {
+		return nil, errors.Wrapf(err, "only sysadmin can process erasure requests")
+	}
+	before, err := getPendingPersonErasure(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var userIDs []string
+	if err := db.Select(&userIDs, "SELECT id FROM users WHERE person_id=?", before.PersonID); err != nil {
+		return nil, errors.Wrapf(err, "failed to get users of person")
+	}
+	users := []*User{}
+	for _, userID := range userIDs {
+		u, err := GetUser("", userID)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	//log is updated before the users are anonymised
+	for _, query := range personErasureSteps {
+		if _, err := tx.NamedExec(query, map[string]interface{}{"id": before.PersonID}); err != nil {
+			return nil, errors.Wrapf(err, "failed to erase person")
+		}
+	}
+	for _, u := range users {
+		if err := anonymiseUser(tx, u.ID); err != nil {
+			return nil, err
+		}
+		//an account may not be left without admin
+		if u.activeAdmin() {
+			if err := checkActiveAdmins(tx, u.Account.ID); err != nil {
+				return nil, errors.Wrapf(err, "assign another admin before erasing the person")
+			}
+		}
+	}
+	if err := setPersonErasureStatus(tx, id, user, PersonErasureCompleted, note); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to erase person")
+	}
+
+	after, err := getPersonErasure(id)
+	if err != nil {
+		return nil, err
+	}
+	audit(ctx, "", "person_erasures", id, "complete", before, after)
+	audit(ctx, "", "persons", before.PersonID, "erase", nil, nil)
+	for _, u := range users {
+		audit(ctx, u.Account.ID, "users", u.ID, "anonymise", nil, nil)
+	}
+	return after, nil
+} //CompletePersonErasure()
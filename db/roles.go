@@ -0,0 +1,257 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-msvc/errors"
+)
+
+//Role is a named set of permissions, assigned to a user for the whole account or for one group
+type Role string
+
+const (
+	RoleSysadmin     Role = "sysadmin"
+	RoleAccountAdmin Role = "account-admin"
+	RoleGroupManager Role = "group-manager"
+	RoleTreasurer    Role = "treasurer"
+	RoleMember       Role = "member"
+	RoleViewer       Role = "viewer"
+)
+
+type Permission string
+
+const (
+	PermSystemManage  Permission = "system:manage"  //all accounts, persons and client IP lockouts
+	PermAccountManage Permission = "account:manage" //account settings, API keys, identity providers and lockouts
+	PermUsersRead     Permission = "users:read"     //list account users
+	PermUsersManage   Permission = "users:manage"   //add users, roles, sessions and unlock
+	PermGroupsRead    Permission = "groups:read"    //view groups and their fields
+	PermGroupsManage  Permission = "groups:manage"  //create, update and delete groups and their fields
+	PermMembersRead   Permission = "members:read"   //view group members
+	PermMembersManage Permission = "members:manage" //add and remove group members
+	PermFinanceRead   Permission = "finance:read"   //view payments and wallets
+	PermFinanceManage Permission = "finance:manage" //manage payments and wallets
+	PermMessagesSend  Permission = "messages:send"  //send messages
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleSysadmin: {
+		PermSystemManage, PermAccountManage, PermUsersRead, PermUsersManage, PermGroupsRead, PermGroupsManage,
+		PermMembersRead, PermMembersManage, PermFinanceRead, PermFinanceManage, PermMessagesSend,
+	},
+	RoleAccountAdmin: {
+		PermAccountManage, PermUsersRead, PermUsersManage, PermGroupsRead, PermGroupsManage,
+		PermMembersRead, PermMembersManage, PermFinanceRead, PermFinanceManage, PermMessagesSend,
+	},
+	RoleGroupManager: {PermUsersRead, PermGroupsRead, PermGroupsManage, PermMembersRead, PermMembersManage, PermMessagesSend},
+	RoleTreasurer:    {PermUsersRead, PermGroupsRead, PermMembersRead, PermFinanceRead, PermFinanceManage},
+	RoleMember:       {PermUsersRead, PermGroupsRead, PermMembersRead, PermMessagesSend},
+	RoleViewer:       {PermUsersRead, PermGroupsRead, PermMembersRead},
+}
+
+func (r Role) Validate() error {
+	if _, ok := rolePermissions[r]; !ok {
+		return errors.Errorf("unknown role \"%s\"", r)
+	}
+	return nil
+}
+
+//Has returns true if the role includes the permission
+func (r Role) Has(perm Permission) bool {
+	for _, p := range rolePermissions[r] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+//RoleAssignment gives a user a role in the account, or only in one group of the account
+type RoleAssignment struct {
+	Role      Role    `json:"role" db:"role"`
+	AccountID string  `json:"account_id" db:"account_id"`
+	GroupID   *string `json:"group_id,omitempty" db:"group_id" doc:"Only in this group, or nil for the whole account"`
+}
+
+//roles returns the assigned roles plus the roles implied by the admin flags:
+//admin of the system account is sysadmin, other admins are account-admin,
+//and users without an account wide role are members of their account
+func (u User) roles() []RoleAssignment {
+	list := append([]RoleAssignment{}, u.Roles...)
+	if u.Account == nil {
+		return list
+	}
+	implied := RoleMember
+	switch {
+	case u.Admin && u.Account.Admin:
+		implied = RoleSysadmin
+	case u.Admin:
+		implied = RoleAccountAdmin
+	default:
+		for _, ra := range u.Roles {
+			if ra.GroupID == nil {
+				return list
+			}
+		}
+	}
+	return append(list, RoleAssignment{Role: implied, AccountID: u.Account.ID})
+}
+
+//Authorize is the single authorization check for handlers and db functions
+//it returns nil when the user has the permission in the account, and when groupID is not "",
+//roles assigned in that group also count
+//sysadmin has all permissions in all accounts
+func Authorize(user User, perm Permission, accountID string, groupID string) error {
+	for _, ra := range user.roles() {
+		if !ra.Role.Has(perm) {
+			continue
+		}
+		if ra.Role == RoleSysadmin {
+			return nil
+		}
+		if ra.AccountID != accountID {
+			continue
+		}
+		if ra.GroupID == nil || (groupID != "" && *ra.GroupID == groupID) {
+			return nil
+		}
+	}
+	return errors.Errorf("user(%s) does not have permission %s", user.Username, perm)
+} //Authorize()
+
+//usersWithPermission returns the active users of the account who have the permission in the account,
+//or in the group when groupID is not "", from their admin flags or assigned roles
+func usersWithPermission(perm Permission, accountID string, groupID string) ([]User, error) {
+	var ids []string
+	if err := db.Select(
+		&ids,
+		"SELECT id FROM users WHERE account_id=? AND active=true AND (admin=true OR id IN (SELECT user_id FROM user_roles WHERE account_id=?))",
+		accountID, accountID,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get users of account(%s)", accountID)
+	}
+	users := []User{}
+	for _, id := range ids {
+		u, err := GetUser(accountID, id)
+		if err != nil {
+			return nil, err
+		}
+		if u.Expiry != nil && u.Expiry.Before(time.Now()) {
+			continue
+		}
+		if Authorize(*u, perm, accountID, groupID) == nil {
+			users = append(users, *u)
+		}
+	}
+	return users, nil
+} //usersWithPermission()
+
+func getUserRoles(userID string) ([]RoleAssignment, error) {
+	var list []RoleAssignment
+	if err := NamedSelect(
+		&list,
+		"SELECT role,account_id,group_id FROM user_roles WHERE user_id=:user_id ORDER BY role",
+		map[string]interface{}{
+			"user_id": userID,
+		},
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get user roles")
+	}
+	return list, nil
+}
+
+//AddUserRole assigns a role to a user of the account, optionally only in one group of the account
+func AddUserRole(ctx context.Context, by User, user User, ra RoleAssignment) error {
+	if err := ra.Role.Validate(); err != nil {
+		return err
+	}
+	if user.Account == nil {
+		return errors.Errorf("user(%s) does not belong to an account", user.Username)
+	}
+	if err := Authorize(by, PermUsersManage, user.Account.ID, ""); err != nil {
+		return err
+	}
+	if ra.Role == RoleSysadmin && (!user.Account.Admin || Authorize(by, PermSystemManage, "", "") != nil) {
+		return errors.Errorf("only sysadmin can make users of the system account sysadmin")
+	}
+	ra.AccountID = user.Account.ID
+	if ra.GroupID != nil {
+		if *ra.GroupID == "" {
+			ra.GroupID = nil
+		} else if g, err := GetGroup(*ra.GroupID); err != nil || g.Account.ID != user.Account.ID {
+			return errors.Errorf("group(%s) not found in account", *ra.GroupID)
+		}
+	}
+	var existing int
+	if err := NamedGet(
+		&existing,
+		"SELECT COUNT(*) FROM user_roles WHERE user_id=:user_id AND role=:role AND group_id<=>:group_id",
+		map[string]interface{}{
+			"user_id":  user.ID,
+			"role":     ra.Role,
+			"group_id": ra.GroupID,
+		},
+	); err != nil {
+		return errors.Wrapf(err, "failed to check user roles")
+	}
+	if existing > 0 {
+		return nil
+	}
+	if _, err := db.NamedExec(
+		"INSERT INTO user_roles SET user_id=:user_id,account_id=:account_id,group_id=:group_id,role=:role,time_created=now()",
+		map[string]interface{}{
+			"user_id":    user.ID,
+			"account_id": ra.AccountID,
+			"group_id":   ra.GroupID,
+			"role":       ra.Role,
+		},
+	); err != nil {
+		return errors.Wrapf(err, "failed to add user role")
+	}
+	audit(ctx, user.Account.ID, "users", user.ID, "add_role", nil, ra)
+	return nil
+} //AddUserRole()
+
+//DelUserRole removes a role from the user, groupID is "" for the account wide role
+func DelUserRole(ctx context.Context, by User, user User, role Role, groupID string) error {
+	if user.Account == nil {
+		return errors.Errorf("user(%s) does not belong to an account", user.Username)
+	}
+	if err := Authorize(by, PermUsersManage, user.Account.ID, ""); err != nil {
+		return err
+	}
+	var gid *string
+	if groupID != "" {
+		gid = &groupID
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	result, err := tx.NamedExec(
+		"DELETE FROM user_roles WHERE user_id=:user_id AND role=:role AND group_id<=>:group_id",
+		map[string]interface{}{
+			"user_id":  user.ID,
+			"role":     role,
+			"group_id": gid,
+		},
+	)
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete user role")
+	}
+	if nr, _ := result.RowsAffected(); nr != 1 {
+		return errors.Errorf("user(%s) does not have role %s", user.Username, role)
+	}
+	if user.activeAdmin() {
+		if err := checkActiveAdmins(tx, user.Account.ID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrapf(err, "failed to delete user role")
+	}
+	audit(ctx, user.Account.ID, "users", user.ID, "del_role", RoleAssignment{Role: role, AccountID: user.Account.ID, GroupID: gid}, nil)
+	return nil
+} //DelUserRole()
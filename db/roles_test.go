@@ -0,0 +1,100 @@
+package db_test
+
+import (
+	"testing"
+
+	"bitbucket.org/vservices/hotseat/db"
+)
+
+func TestRolePermissions(t *testing.T) {
+	all := []db.Permission{
+		db.PermSystemManage, db.PermAccountManage, db.PermUsersRead, db.PermUsersManage, db.PermGroupsRead, db.PermGroupsManage,
+		db.PermMembersRead, db.PermMembersManage, db.PermFinanceRead, db.PermFinanceManage, db.PermMessagesSend,
+	}
+	matrix := map[db.Role][]db.Permission{
+		db.RoleSysadmin: all,
+		db.RoleAccountAdmin: {
+			db.PermAccountManage, db.PermUsersRead, db.PermUsersManage, db.PermGroupsRead, db.PermGroupsManage,
+			db.PermMembersRead, db.PermMembersManage, db.PermFinanceRead, db.PermFinanceManage, db.PermMessagesSend,
+		},
+		db.RoleGroupManager: {db.PermUsersRead, db.PermGroupsRead, db.PermGroupsManage, db.PermMembersRead, db.PermMembersManage, db.PermMessagesSend},
+		db.RoleTreasurer:    {db.PermUsersRead, db.PermGroupsRead, db.PermMembersRead, db.PermFinanceRead, db.PermFinanceManage},
+		db.RoleMember:       {db.PermUsersRead, db.PermGroupsRead, db.PermMembersRead, db.PermMessagesSend},
+		db.RoleViewer:       {db.PermUsersRead, db.PermGroupsRead, db.PermMembersRead},
+	}
+	for role, perms := range matrix {
+		if err := role.Validate(); err != nil {
+			t.Fatalf("role %s: %+v", role, err)
+		}
+		expected := map[db.Permission]bool{}
+		for _, p := range perms {
+			expected[p] = true
+		}
+		for _, p := range all {
+			if role.Has(p) != expected[p] {
+				t.Errorf("role %s has %s = %v, expected %v", role, p, role.Has(p), expected[p])
+			}
+		}
+	}
+	if err := db.Role("superuser").Validate(); err == nil {
+		t.Fatalf("unknown role accepted")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	sysAccount := &db.Account{ID: "sys", Admin: true}
+	account := &db.Account{ID: "a1"}
+	groupID := "g1"
+	sysadmin := db.User{Username: "sysadmin", Account: sysAccount, Admin: true}
+	accountAdmin := db.User{Username: "admin", Account: account, Admin: true}
+	member := db.User{Username: "member", Account: account}
+	viewer := db.User{Username: "viewer", Account: account, Roles: []db.RoleAssignment{
+		{Role: db.RoleViewer, AccountID: "a1"},
+	}}
+	manager := db.User{Username: "manager", Account: account, Roles: []db.RoleAssignment{
+		{Role: db.RoleGroupManager, AccountID: "a1", GroupID: &groupID},
+	}}
+	treasurer := db.User{Username: "treasurer", Account: account, Roles: []db.RoleAssignment{
+		{Role: db.RoleTreasurer, AccountID: "a1"},
+	}}
+	public := db.User{Username: "public"}
+
+	tests := []struct {
+		user      db.User
+		perm      db.Permission
+		accountID string
+		groupID   string
+		allowed   bool
+	}{
+		{sysadmin, db.PermSystemManage, "", "", true},
+		{sysadmin, db.PermGroupsManage, "a1", "", true},
+		{accountAdmin, db.PermSystemManage, "", "", false},
+		{accountAdmin, db.PermGroupsManage, "a1", "", true},
+		{accountAdmin, db.PermGroupsManage, "a1", "g1", true},
+		{accountAdmin, db.PermGroupsManage, "a2", "", false},
+		{accountAdmin, db.PermUsersManage, "a1", "", true},
+		{member, db.PermGroupsRead, "a1", "", true},
+		{member, db.PermGroupsManage, "a1", "", false},
+		{member, db.PermGroupsRead, "a2", "", false},
+		{member, db.PermMessagesSend, "a1", "", true},
+		{viewer, db.PermGroupsRead, "a1", "", true},
+		{viewer, db.PermMessagesSend, "a1", "", false}, //explicit account role replaces implied member
+		{manager, db.PermGroupsManage, "a1", "g1", true},
+		{manager, db.PermGroupsManage, "a1", "g2", false},
+		{manager, db.PermGroupsManage, "a1", "", false},
+		{manager, db.PermMessagesSend, "a1", "", true}, //still implied member of the account
+		{manager, db.PermUsersManage, "a1", "g1", false},
+		{treasurer, db.PermFinanceManage, "a1", "", true},
+		{treasurer, db.PermFinanceManage, "a1", "g1", true},
+		{treasurer, db.PermGroupsManage, "a1", "", false},
+		{member, db.PermFinanceRead, "a1", "", false},
+		{public, db.PermGroupsRead, "a1", "", false},
+	}
+	for i, test := range tests {
+		err := db.Authorize(test.user, test.perm, test.accountID, test.groupID)
+		if (err == nil) != test.allowed {
+			t.Errorf("test[%d]: %s %s in account(%s) group(%s): allowed=%v, expected %v",
+				i, test.user.Username, test.perm, test.accountID, test.groupID, err == nil, test.allowed)
+		}
+	}
+}
@@ -1,8 +1,306 @@
 package db
 
+import (
+	"os"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/google/uuid"
+)
+
 type Session struct {
-	Token       string   `json:"token"`
-	User        User     `json:"user"`
-	TimeCreated *SqlTime `json:"time_created,omitempty"`
-	TimeUpdated *SqlTime `json:"time_updates,omitempty"`
+	ID           string       `json:"id,omitempty" doc:"Public ID of the session used to list and revoke sessions, unlike the secret token"`
+	Token        string       `json:"token"`
+	User         User         `json:"user"`
+	Scope        SessionScope `json:"scope,omitempty" doc:"Empty for a normal session, else the session may only be used for the named purpose"`
+	UserAgent    string       `json:"user_agent,omitempty"`
+	RemoteAddr   string       `json:"remote_addr,omitempty"`
+	TimeCreated  *SqlTime     `json:"time_created,omitempty"`
+	TimeUpdated  *SqlTime     `json:"time_updates,omitempty"`
+	ApiKey       *ApiKey      `json:"api_key,omitempty" doc:"Set when authenticated with an API key instead of a user login"`
+	Impersonator *User        `json:"impersonator,omitempty" doc:"Set when a sysadmin is acting as the user, User is the impersonated user"`
+}
+
+//SessionScope restricts what a session may be used for
+type SessionScope string
+
+const (
+	SessionScopeFull           SessionScope = ""
+	SessionScopeChangePassword SessionScope = "change_password" //user must change temporary password before getting a full session
+	SessionScopeMFARequired    SessionScope = "mfa_required"    //user must enter MFA code to get a full session
+	SessionScopeMFAEnrol       SessionScope = "mfa_enrol"       //account requires MFA and user must enrol before getting a full session
+)
+
+var (
+	sessionIdleTimeout time.Duration //session ends when not used for this long
+	sessionMaxAge      time.Duration //session ends this long after login even when used
+)
+
+func init() {
+	sessionIdleTimeout = time.Duration(intDefault(os.Getenv("SESSION_IDLE_MINUTES"), 60)) * time.Minute
+	sessionMaxAge = time.Duration(intDefault(os.Getenv("SESSION_MAX_HOURS"), 12)) * time.Hour
+}
+
+//newSession creates a session for a user who passed all login checks
+func newSession(info userRow, scope SessionScope, userAgent string, remoteAddr string) (*Session, error) {
+	return createSession(info, scope, userAgent, remoteAddr, nil)
+}
+
+//createSession creates a session for the user, optionally impersonated by a sysadmin
+func createSession(info userRow, scope SessionScope, userAgent string, remoteAddr string, impersonator *User) (*Session, error) {
+	//housekeeping: remove expired sessions of this user
+	if err := delExpiredSessions(info.UserID); err != nil {
+		log.Errorf("failed to delete expired sessions of user(%s): %+v", info.UserID, err)
+	}
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+	roles, err := getUserRoles(info.UserID)
+	if err != nil {
+		return nil, err
+	}
+	s := Session{
+		ID:           uuid.New().String(),
+		Token:        uuid.New().String(),
+		User:         info.User(),
+		Scope:        scope,
+		UserAgent:    userAgent,
+		RemoteAddr:   remoteAddr,
+		Impersonator: impersonator,
+	}
+	var impersonatorID *string
+	if impersonator != nil {
+		impersonatorID = &impersonator.ID
+	}
+	if _, err := db.NamedExec(
+		"INSERT INTO `sessions` set id=:id,`token`=:token,account_id=:account_id,user_id=:user_id,scope=:scope,user_agent=:user_agent,remote_addr=:remote_addr,impersonator_user_id=:impersonator_user_id",
+		map[string]interface{}{
+			"id":                   s.ID,
+			"token":                s.Token,
+			"account_id":           info.AccountID,
+			"user_id":              info.UserID,
+			"scope":                s.Scope,
+			"user_agent":           s.UserAgent,
+			"remote_addr":          s.RemoteAddr,
+			"impersonator_user_id": impersonatorID,
+		},
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to create session")
+	}
+	s.User.Roles = roles
+	return &s, nil
+} //createSession()
+
+func Logout(token string) error {
+	if _, err := db.NamedExec(
+		"DELETE FROM sessions WHERE token=:token",
+		map[string]interface{}{
+			"token": token,
+		},
+	); err != nil {
+		return errors.Wrapf(err, "failed to delete session")
+	}
+	return nil
 }
+
+func GetSession(token string) (*Session, error) {
+	if token == "" {
+		return nil, errors.Errorf("missing token")
+	}
+	var info struct {
+		ID               string       `db:"id"`
+		StartTime        *SqlTime     `db:"time_created"`
+		IdleSeconds      int64        `db:"idle_seconds"`
+		AgeSeconds       int64        `db:"age_seconds"`
+		Scope            SessionScope `db:"scope"`
+		UserAgent        string       `db:"user_agent"`
+		RemoteAddr       string       `db:"remote_addr"`
+		UserID           string       `db:"user_id"`
+		Username         string       `db:"username"`
+		UserActive       bool         `db:"user_active"`
+		UserAdmin        bool         `db:"user_admin"`
+		UserExpiry       *SqlTime     `db:"user_expiry"`
+		AccountID        string       `db:"account_id"`
+		AccountName      string       `db:"account_name"`
+		AccountActive    bool         `db:"account_active"`
+		AccountAdmin     bool         `db:"account_admin"`
+		AccountExpiry    *SqlTime     `db:"account_expiry"`
+		AccountMFA       bool         `db:"account_mfa_required"`
+		ImpersonatorID   *string      `db:"impersonator_user_id"`
+		ImpersonatorName *string      `db:"impersonator_username"`
+	}
+	//session age is calculated by the db because the timestamps are in db time
+	if err := NamedGet(
+		&info,
+		"select s.id,s.time_created,"+
+			"TIMESTAMPDIFF(SECOND,s.time_updated,now()) as idle_seconds,TIMESTAMPDIFF(SECOND,s.time_created,now()) as age_seconds,"+
+			"s.scope,s.user_agent,s.remote_addr,s.user_id,u.username,u.active as user_active,u.admin as user_admin,u.expiry as user_expiry,"+
+			"a.id as account_id,a.name as account_name,a.active as account_active,a.admin as account_admin,"+
+			"a.expiry as account_expiry,a.mfa_required as account_mfa_required,s.impersonator_user_id,iu.username as impersonator_username"+
+			" from sessions as s"+
+			" LEFT JOIN users as u on u.id = s.user_id"+
+			" LEFT JOIN users as iu on iu.id = s.impersonator_user_id"+
+			" LEFT JOIN accounts as a on a.id = s.account_id"+
+			" WHERE s.token=:token",
+		map[string]interface{}{
+			"token": token,
+		},
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get users")
+	}
+	log.Debugf("Read: %+v", info)
+
+	maxAge := sessionMaxAge
+	if info.Scope == SessionScopeMFARequired {
+		maxAge = mfaLoginMaxAge
+	}
+	if info.ImpersonatorID != nil && impersonationMaxAge < maxAge {
+		maxAge = impersonationMaxAge
+	}
+	if time.Duration(info.IdleSeconds)*time.Second > sessionIdleTimeout ||
+		time.Duration(info.AgeSeconds)*time.Second > maxAge {
+		if err := Logout(token); err != nil {
+			log.Errorf("failed to delete expired session: %+v", err)
+		}
+		return nil, errors.Errorf("session expired")
+	}
+	//user or account may have been suspended or expired since login
+	if !info.UserActive || !info.AccountActive ||
+		(info.UserExpiry != nil && time.Time(*info.UserExpiry).Before(time.Now())) ||
+		(info.AccountExpiry != nil && time.Time(*info.AccountExpiry).Before(time.Now())) {
+		if err := Logout(token); err != nil {
+			log.Errorf("failed to delete session of suspended user: %+v", err)
+		}
+		return nil, errors.Errorf("user or account suspended or expired")
+	}
+
+	roles, err := getUserRoles(info.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	var impersonator *User
+	if info.ImpersonatorID != nil {
+		impersonator = &User{ID: *info.ImpersonatorID}
+		if info.ImpersonatorName != nil {
+			impersonator.Username = *info.ImpersonatorName
+		}
+	}
+
+	now := SqlTime(time.Now())
+	if _, err := db.NamedExec(
+		"UPDATE sessions SET time_updated=now() WHERE token=:token",
+		map[string]interface{}{
+			"token": token,
+		},
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to update session")
+	}
+	return &Session{
+		ID:          info.ID,
+		Token:       token,
+		Scope:       info.Scope,
+		UserAgent:   info.UserAgent,
+		RemoteAddr:  info.RemoteAddr,
+		TimeCreated: info.StartTime,
+		TimeUpdated: &now,
+		User: User{
+			ID:       info.UserID,
+			Username: info.Username,
+			Account: &Account{
+				ID:          info.AccountID,
+				Name:        info.AccountName,
+				Active:      info.AccountActive,
+				Admin:       info.AccountAdmin,
+				Expiry:      (*time.Time)(info.AccountExpiry),
+				MFARequired: info.AccountMFA,
+			},
+			Admin:  info.UserAdmin,
+			Active: info.UserActive,
+			Expiry: (*time.Time)(info.UserExpiry),
+			Roles:  roles,
+		},
+		Impersonator: impersonator,
+	}, nil
+} //GetSession()
+
+//UserSession is a session as listed to its user, without the secret token
+type UserSession struct {
+	ID          string       `json:"id" db:"id"`
+	Scope       SessionScope `json:"scope,omitempty" db:"scope"`
+	UserAgent   string       `json:"user_agent" db:"user_agent"`
+	RemoteAddr  string       `json:"remote_addr" db:"remote_addr"`
+	TimeCreated SqlTime      `json:"time_created" db:"time_created"`
+	TimeUpdated SqlTime      `json:"time_updated" db:"time_updated"`
+	Current     bool         `json:"current,omitempty" db:"-"`
+}
+
+//GetUserSessions lists the unexpired sessions of a user
+//currentSessionID is marked as current in the list
+func GetUserSessions(userID string, currentSessionID string) ([]UserSession, error) {
+	if err := delExpiredSessions(userID); err != nil {
+		return nil, errors.Wrapf(err, "failed to delete expired sessions")
+	}
+	list := []UserSession{}
+	if err := NamedSelect(
+		&list,
+		"SELECT id,scope,user_agent,remote_addr,time_created,time_updated FROM sessions WHERE user_id=:user_id ORDER BY time_updated DESC",
+		map[string]interface{}{
+			"user_id": userID,
+		},
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get sessions")
+	}
+	for i := range list {
+		list[i].Current = list[i].ID == currentSessionID
+	}
+	return list, nil
+} //GetUserSessions()
+
+//DelUserSession revokes one session of the user
+func DelUserSession(userID string, sessionID string) error {
+	result, err := db.NamedExec(
+		"DELETE FROM sessions WHERE user_id=:user_id AND id=:id",
+		map[string]interface{}{
+			"user_id": userID,
+			"id":      sessionID,
+		},
+	)
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete session")
+	}
+	if nr, _ := result.RowsAffected(); nr != 1 {
+		return errors.Errorf("session(%s) not found", sessionID)
+	}
+	return nil
+} //DelUserSession()
+
+//DelUserSessions revokes all sessions of the user, except the session with exceptSessionID if not ""
+func DelUserSessions(userID string, exceptSessionID string) (int64, error) {
+	result, err := db.NamedExec(
+		"DELETE FROM sessions WHERE user_id=:user_id AND id<>:except_id",
+		map[string]interface{}{
+			"user_id":   userID,
+			"except_id": exceptSessionID,
+		},
+	)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to delete sessions")
+	}
+	nr, _ := result.RowsAffected()
+	return nr, nil
+} //DelUserSessions()
+
+func delExpiredSessions(userID string) error {
+	if _, err := db.NamedExec(
+		"DELETE FROM sessions WHERE user_id=:user_id AND (time_updated<now()-INTERVAL :idle SECOND OR time_created<now()-INTERVAL :age SECOND)",
+		map[string]interface{}{
+			"user_id": userID,
+			"idle":    int64(sessionIdleTimeout / time.Second),
+			"age":     int64(sessionMaxAge / time.Second),
+		},
+	); err != nil {
+		return errors.Wrapf(err, "failed to delete expired sessions")
+	}
+	return nil
+} //delExpiredSessions()
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-msvc/errors"
+)
+
+//RFC 6238 TOTP with the parameters that authenticator apps expect by default
+const (
+	totpDigits = 6
+	totpPeriod = 30 * time.Second
+	totpSkew   = 1 //nr of periods before/after current time also accepted for clock drift
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+//TOTPCode returns the RFC 6238 code (HMAC-SHA1) of the secret at time t
+func TOTPCode(secret []byte, t time.Time, period time.Duration, digits int) string {
+	counter := uint64(t.Unix() / int64(period/time.Second))
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	//dynamic truncation from RFC 4226
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, bin%mod)
+} //TOTPCode()
+
+//ValidTOTP checks a code entered by the user against the base32 encoded secret
+func ValidTOTP(secretBase32 string, code string, t time.Time) bool {
+	secret, err := totpEncoding.DecodeString(strings.ToUpper(secretBase32))
+	if err != nil {
+		return false
+	}
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return false
+	}
+	for i := -totpSkew; i <= totpSkew; i++ {
+		expected := TOTPCode(secret, t.Add(time.Duration(i)*totpPeriod), totpPeriod, totpDigits)
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return true
+		}
+	}
+	return false
+} //ValidTOTP()
+
+//newTOTPSecret returns a random 160-bit secret encoded as base32
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	if _, err := cryptorand.Read(b); err != nil {
+		panic(errors.Wrapf(err, "failed to read random bytes"))
+	}
+	return totpEncoding.EncodeToString(b)
+}
+
+//TOTPProvisioningURI is the otpauth:// URI shown as QR code to add the secret to an authenticator app
+func TOTPProvisioningURI(issuer string, username string, secretBase32 string) string {
+	label := url.PathEscape(issuer + ":" + username)
+	params := url.Values{}
+	params.Set("secret", secretBase32)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprintf("%d", totpDigits))
+	params.Set("period", fmt.Sprintf("%d", int(totpPeriod/time.Second)))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
@@ -0,0 +1,50 @@
+package db_test
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+
+	"bitbucket.org/vservices/hotseat/db"
+)
+
+func TestTOTPCode(t *testing.T) {
+	//test vectors from RFC 6238 appendix B (SHA1)
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for i, test := range tests {
+		code := db.TOTPCode(secret, time.Unix(test.unix, 0), 30*time.Second, 8)
+		if code != test.code {
+			t.Errorf("[%d] time %d: code %s != %s", i, test.unix, code, test.code)
+		}
+	}
+}
+
+func TestValidTOTP(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	secretBase32 := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+	now := time.Unix(1234567890, 0)
+	code := db.TOTPCode(secret, now, 30*time.Second, 6)
+	if !db.ValidTOTP(secretBase32, code, now) {
+		t.Fatalf("current code %s not valid", code)
+	}
+	if !db.ValidTOTP(secretBase32, code, now.Add(30*time.Second)) {
+		t.Fatalf("code %s not valid in next period", code)
+	}
+	if db.ValidTOTP(secretBase32, code, now.Add(2*time.Minute)) {
+		t.Fatalf("code %s still valid after 2 minutes", code)
+	}
+	if other := db.TOTPCode(secret, now.Add(time.Hour), 30*time.Second, 6); other != code && db.ValidTOTP(secretBase32, other, now) {
+		t.Fatalf("code %s from another time accepted", other)
+	}
+}
@@ -0,0 +1,276 @@
+package db
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/go-msvc/errors"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+//UserInvitationNotifier must deliver the invitation token to the invited user, e.g. by email
+//the default only logs that the invitation was issued, never the token, which activates the user
+var UserInvitationNotifier = func(user User, invitedBy User, token string, expiry time.Time) error {
+	log.Infof("user(%s) invited by %s to account %s, expires %s (no notifier to deliver it)", user.Username, invitedBy.Username, user.Account.Name, expiry.Format("2006-01-02 15:04:05"))
+	return nil
+}
+
+type UserInvitation struct {
+	ID              string   `json:"id"`
+	AccountID       string   `json:"account_id" db:"account_id"`
+	UserID          string   `json:"user_id" db:"user_id" doc:"Pending user, inactive until the invitation is accepted"`
+	Username        string   `json:"username" db:"username"`
+	InvitedByUserID string   `json:"invited_by_user_id" db:"invited_by_user_id"`
+	TimeCreated     SqlTime  `json:"time_created" db:"time_created"`
+	TimeSent        SqlTime  `json:"time_sent" db:"time_sent" doc:"Last time the invitation was sent"`
+	Expiry          SqlTime  `json:"expiry" db:"expiry"`
+	TimeAccepted    *SqlTime `json:"time_accepted,omitempty" db:"time_accepted"`
+}
+
+const userInvitationQuery = "SELECT i.id,i.account_id,i.user_id,u.username,i.invited_by_user_id,i.time_created,i.time_sent,i.expiry,i.time_accepted" +
+	" FROM user_invitations as i INNER JOIN users as u ON u.id=i.user_id"
+
+type NewUserInvitation struct {
+	Email string `json:"email" doc:"Becomes the username of the invited user"`
+}
+
+//InviteUser creates a pending (inactive) user in the account of the admin and sends an invitation token
+//the user only becomes active after accepting the invitation with their own password
+func InviteUser(ctx context.Context, by User, req NewUserInvitation) (*UserInvitation, error) {
+	if by.Account == nil {
+		return nil, errors.Errorf("not an account user")
+	}
+	if err := Authorize(by, PermUsersManage, by.Account.ID, ""); err != nil {
+		return nil, err
+	}
+	if !ValidEmail(req.Email) {
+		return nil, errors.Errorf("email:\"%s\" is not a valid email address", req.Email)
+	}
+
+	//the random password is never shown, the user sets a password when accepting
+	user, err := AddUser(ctx, NewUser{
+		Account:  by.Account,
+		Username: req.Email,
+		Password: newRandomToken(),
+		Admin:    false,
+		Active:   false,
+		Expiry:   nil,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := addUserInvitation(db, by, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	return sendUserInvitation(ctx, by, id, "create")
+} //InviteUser()
+
+//addUserInvitation creates the invitation without a valid token, sendUserInvitation() issues the token
+func addUserInvitation(e sqlx.Ext, by User, userID string) (string, error) {
+	id := uuid.New().String()
+	if _, err := sqlx.NamedExec(
+		e,
+		"INSERT INTO `user_invitations` SET id=:id,account_id=:account_id,user_id=:user_id,invited_by_user_id=:by,time_created=now(),time_sent=now(),expiry=now(),token_hash=''",
+		map[string]interface{}{
+			"id":         id,
+			"account_id": by.Account.ID,
+			"user_id":    userID,
+			"by":         by.ID,
+		},
+	); err != nil {
+		return "", errors.Wrapf(err, "failed to create invitation")
+	}
+	return id, nil
+}
+
+//GetUserInvitations lists invitations in the account that were not yet accepted
+func GetUserInvitations(accountID string, limit int) ([]UserInvitation, error) {
+	var invitations []UserInvitation
+	if err := NamedSelect(
+		&invitations,
+		userInvitationQuery+" WHERE i.account_id=:account_id AND i.time_accepted IS NULL ORDER BY i.time_sent DESC LIMIT :limit",
+		map[string]interface{}{
+			"account_id": accountID,
+			"limit":      limit,
+		},
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to get invitations")
+	}
+	return invitations, nil
+}
+
+func getUserInvitation(accountID string, id string) (*UserInvitation, error) {
+	var invitation UserInvitation
+	if err := NamedGet(
+		&invitation,
+		userInvitationQuery+" WHERE i.account_id=:account_id AND i.id=:id",
+		map[string]interface{}{
+			"account_id": accountID,
+			"id":         id,
+		},
+	); err != nil {
+		return nil, errors.Errorf("invitation(%s) not found", id)
+	}
+	return &invitation, nil
+}
+
+//ResendUserInvitation sends a new token with a new expiry, the previous token is no longer valid
+func ResendUserInvitation(ctx context.Context, by User, id string) (*UserInvitation, error) {
+	if err := Authorize(by, PermUsersManage, by.Account.ID, ""); err != nil {
+		return nil, err
+	}
+	invitation, err := getUserInvitation(by.Account.ID, id)
+	if err != nil {
+		return nil, err
+	}
+	if invitation.TimeAccepted != nil {
+		return nil, errors.Errorf("invitation already accepted")
+	}
+	return sendUserInvitation(ctx, by, id, "resend")
+}
+
+//RevokeUserInvitation deletes the invitation and the pending user
+func RevokeUserInvitation(ctx context.Context, by User, id string) error {
+	if err := Authorize(by, PermUsersManage, by.Account.ID, ""); err != nil {
+		return err
+	}
+	invitation, err := getUserInvitation(by.Account.ID, id)
+	if err != nil {
+		return err
+	}
+	if invitation.TimeAccepted != nil {
+		return errors.Errorf("invitation already accepted, delete the user instead")
+	}
+	if _, err := DelUser(ctx, by, invitation.UserID, false); err != nil {
+		return errors.Wrapf(err, "failed to delete invited user")
+	}
+	audit(ctx, invitation.AccountID, "user_invitations", invitation.ID, "revoke", invitation, nil)
+	return nil
+}
+
+//sendUserInvitation replaces the token and expiry and notifies the invited user
+func sendUserInvitation(ctx context.Context, by User, id string, change string) (*UserInvitation, error) {
+	token := newRandomToken()
+	expiry := time.Now().Add(time.Duration(intDefault(os.Getenv("USER_INVITATION_DAYS"), 7)) * 24 * time.Hour)
+	if _, err := db.NamedExec(
+		"UPDATE `user_invitations` SET token_hash=:token_hash,time_sent=now(),expiry=:expiry WHERE id=:id",
+		map[string]interface{}{
+			"id":         id,
+			"token_hash": hashToken(token),
+			"expiry":     SqlTime(expiry),
+		},
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to update invitation")
+	}
+	invitation, err := getUserInvitation(by.Account.ID, id)
+	if err != nil {
+		return nil, err
+	}
+	user, err := GetUser(by.Account.ID, invitation.UserID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get invited user")
+	}
+	if err := UserInvitationNotifier(*user, by, token, expiry); err != nil {
+		return nil, errors.Wrapf(err, "failed to send invitation")
+	}
+	audit(ctx, invitation.AccountID, "user_invitations", invitation.ID, change, nil, invitation)
+	return invitation, nil
+}
+
+type AcceptUserInvitationRequest struct {
+	Token    string  `json:"token" doc:"Token sent to the invited user"`
+	Password string  `json:"password" doc:"New password selected by the user"`
+	Person   *Person `json:"person,omitempty" doc:"Optional personal profile, linked to an existing person with the same name, surname, dob and gender unless that person has a user or family, else created"`
+}
+
+//AcceptUserInvitation activates the invited user with their own password and optional person profile
+func AcceptUserInvitation(ctx context.Context, req AcceptUserInvitationRequest) (*User, error) {
+	if req.Token == "" {
+		return nil, errors.Errorf("missing token")
+	}
+	if req.Password == "" {
+		return nil, errors.Errorf("missing password")
+	}
+	if err := CheckPasswordStrength(req.Password, 8); err != nil {
+		return nil, errors.Wrapf(err, "password not strong enough")
+	}
+	var invitation UserInvitation
+	if err := NamedGet(
+		&invitation,
+		userInvitationQuery+" WHERE i.token_hash=:token_hash AND i.time_accepted IS NULL AND i.expiry>:now",
+		map[string]interface{}{
+			"token_hash": hashToken(req.Token),
+			"now":        SqlTime(time.Now()),
+		},
+	); err != nil {
+		return nil, errors.Errorf("invalid or expired token")
+	}
+
+	var person *Person
+	if req.Person != nil {
+		req.Person.Email = &invitation.Username
+		//an existing person who has a user or family is not given to whoever claims the same details
+		if id, err := findPerson(db, *req.Person); err == nil {
+			claimed, err := personClaimed(db, id)
+			if err != nil {
+				return nil, err
+			}
+			if claimed {
+				return nil, errors.Errorf("%s %s is already registered, login as that user or ask family to add you", req.Person.Name, req.Person.Surname)
+			}
+		}
+		var err error
+		if person, err = AddPersonIfNotExist(ctx, *req.Person); err != nil {
+			return nil, errors.Wrapf(err, "invalid person")
+		}
+	}
+
+	//accept, set the password and activate together, else a failure spends the token
+	//and leaves the user inactive
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	result, err := tx.NamedExec(
+		"UPDATE `user_invitations` SET time_accepted=now() WHERE id=:id AND time_accepted IS NULL",
+		map[string]interface{}{
+			"id": invitation.ID,
+		},
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to accept invitation")
+	}
+	if nr, _ := result.RowsAffected(); nr != 1 {
+		return nil, errors.Errorf("invalid or expired token")
+	}
+	if err := setPassword(tx, invitation.UserID, req.Password); err != nil {
+		return nil, errors.Wrapf(err, "failed to set password")
+	}
+	args := map[string]interface{}{
+		"id":        invitation.UserID,
+		"person_id": nil,
+	}
+	if person != nil {
+		args["person_id"] = person.ID
+	}
+	if _, err := tx.NamedExec(
+		"UPDATE users SET active=true,must_change_password=false,person_id=COALESCE(:person_id,person_id) WHERE id=:id",
+		args,
+	); err != nil {
+		return nil, errors.Wrapf(err, "failed to activate user")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to accept invitation")
+	}
+	user, err := GetUser(invitation.AccountID, invitation.UserID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get user")
+	}
+	audit(ctx, invitation.AccountID, "users", user.ID, "accept_invitation", invitation, user)
+	return user, nil
+} //AcceptUserInvitation()
@@ -1,22 +1,25 @@
 package db
 
 import (
-	"crypto/sha1"
-	"fmt"
+	"context"
+	"crypto/subtle"
+	"strings"
 	"time"
 
 	"github.com/go-msvc/errors"
 	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
 )
 
 type User struct {
-	ID       string     `json:"id"`
-	Account  *Account   `json:"account,omitempty" doc:"Account is nil for non-account users registering on the system"`
-	Username string     `json:"username"`
-	Admin    bool       `json:"admin,omitempty"`
-	Active   bool       `json:"active"`
-	Expiry   *time.Time `json:"expiry,omitempty"`
-	Person   *Person    `json:"person,omitempty" doc:"Person linked to this user account"`
+	ID       string           `json:"id"`
+	Account  *Account         `json:"account,omitempty" doc:"Account is nil for non-account users registering on the system"`
+	Username string           `json:"username"`
+	Admin    bool             `json:"admin,omitempty"`
+	Active   bool             `json:"active"`
+	Expiry   *time.Time       `json:"expiry,omitempty"`
+	Person   *Person          `json:"person,omitempty" doc:"Person linked to this user account"`
+	Roles    []RoleAssignment `json:"roles,omitempty" doc:"Assigned roles, in addition to those implied by the admin flags"`
 }
 
 type userRow struct {
@@ -31,7 +34,10 @@ type userRow struct {
 	AccountActive bool     `db:"account_active"`
 	AccountAdmin  bool     `db:"account_admin"`
 	AccountExpiry *SqlTime `db:"account_expiry"`
+	AccountMFA    bool     `db:"account_mfa_required"`
 	PersonID      *string  `db:"person_id"`
+	MustChangePwd bool     `db:"must_change_password"`
+	TOTPEnabled   bool     `db:"totp_enabled"`
 }
 
 func (ur userRow) User() User {
@@ -46,11 +52,12 @@ func (ur userRow) User() User {
 	}
 	if ur.AccountID != "" {
 		u.Account = &Account{
-			ID:     ur.AccountID,
-			Name:   ur.AccountName,
-			Active: ur.AccountActive,
-			Admin:  ur.AccountAdmin,
-			Expiry: (*time.Time)(ur.AccountExpiry),
+			ID:          ur.AccountID,
+			Name:        ur.AccountName,
+			Active:      ur.AccountActive,
+			Admin:       ur.AccountAdmin,
+			Expiry:      (*time.Time)(ur.AccountExpiry),
+			MFARequired: ur.AccountMFA,
 		}
 	}
 	return u
@@ -58,7 +65,7 @@ func (ur userRow) User() User {
 
 const userRowQuery = "select u.id as user_id,u.username,u.passhash,u.active as user_active,u.admin as user_admin,u.expiry as user_expiry," +
 	"a.id as account_id,a.name as account_name,a.active as account_active,a.admin as account_admin," +
-	"a.expiry as account_expiry,u.person_id" +
+	"a.expiry as account_expiry,a.mfa_required as account_mfa_required,u.person_id,u.must_change_password,u.totp_enabled" +
 	" from users as u" +
 	" LEFT JOIN accounts as a on a.id = u.account_id"
 
@@ -132,6 +139,11 @@ func GetUser(accountID string, userID string) (*User, error) {
 		return nil, errors.Wrapf(err, "failed to get user")
 	}
 	u := userRow.User()
+	roles, err := getUserRoles(u.ID)
+	if err != nil {
+		return nil, err
+	}
+	u.Roles = roles
 
 	if userRow.PersonID != nil {
 		person, err := GetPerson(*userRow.PersonID)
@@ -145,17 +157,27 @@ func GetUser(accountID string, userID string) (*User, error) {
 } //GetUser()
 
 type NewUser struct {
-	Account  *Account   `json:"-"` //from session, nil for public user registration
-	Username string     `json:"username"`
-	Password string     `json:"password"`
-	Admin    bool       `json:"admin"`
-	Active   bool       `json:"active"`
-	Expiry   *time.Time `json:"expiry"`
-	Person   *Person    `json:"person"`
+	Account            *Account   `json:"-"` //from session, nil for public user registration
+	Username           string     `json:"username"`
+	Password           string     `json:"password"`
+	Admin              bool       `json:"admin"`
+	Active             bool       `json:"active"`
+	Expiry             *time.Time `json:"expiry"`
+	Person             *Person    `json:"person"`
+	MustChangePassword bool       `json:"-"` //set when someone else chose the password, e.g. account admin
 }
 
-func AddUser(nu NewUser) (*User, error) {
+func AddUser(ctx context.Context, nu NewUser) (*User, error) {
+	u, err := addUser(db, nu)
+	if err != nil {
+		return nil, err
+	}
+	audit(ctx, u.Account.ID, "users", u.ID, "create", nil, u)
+	return u, nil
+}
 
+//addUser inserts the user, in a transaction or not
+func addUser(e sqlx.Ext, nu NewUser) (*User, error) {
 	if nu.Account == nil || nu.Account.ID == "" {
 		return nil, errors.Errorf("missing account_id")
 	}
@@ -165,6 +187,9 @@ func AddUser(nu NewUser) (*User, error) {
 	if nu.Password == "" {
 		return nil, errors.Errorf("missing password")
 	}
+	if err := checkUsersQuota(e, nu.Account.ID); err != nil {
+		return nil, err
+	}
 	u := User{
 		ID:       uuid.New().String(),
 		Account:  nu.Account,
@@ -174,21 +199,27 @@ func AddUser(nu NewUser) (*User, error) {
 		Expiry:   nu.Expiry,
 		Person:   nu.Person,
 	}
+	passhash, err := hashPassword(nu.Password)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to hash password")
+	}
 	personValues := map[string]interface{}{
-		"id":         u.ID,
-		"account_id": u.Account.ID,
-		"username":   u.Username,
-		"passhash":   passwordHash(u, nu.Password),
-		"admin":      u.Admin,
-		"active":     u.Active,
-		"expiry":     u.Expiry,
-		"person_id":  nil,
+		"id":          u.ID,
+		"account_id":  u.Account.ID,
+		"username":    u.Username,
+		"passhash":    passhash,
+		"admin":       u.Admin,
+		"active":      u.Active,
+		"expiry":      u.Expiry,
+		"person_id":   nil,
+		"must_change": nu.MustChangePassword,
 	}
 	if u.Person != nil && u.Person.ID != "" {
 		personValues["person_id"] = u.Person.ID
 	}
-	if _, err := db.NamedExec(
-		"insert into users set id=:id,account_id=:account_id,username=:username,passhash=:passhash,admin=:admin,active=:active,expiry=:expiry,person_id=:person_id",
+	if _, err := sqlx.NamedExec(
+		e,
+		"insert into users set id=:id,account_id=:account_id,username=:username,passhash=:passhash,admin=:admin,active=:active,expiry=:expiry,person_id=:person_id,must_change_password=:must_change",
 		personValues,
 	); err != nil {
 		return nil, errors.Wrapf(err, "failed to insert user")
@@ -196,15 +227,234 @@ func AddUser(nu NewUser) (*User, error) {
 	return &u, nil
 }
 
-func passwordHash(u User, password string) string {
-	h := sha1.New()
-	s := u.ID
-	s += u.Account.ID
-	s += password
-	h.Write([]byte(s))
-	return fmt.Sprintf("%x", h.Sum(nil))
+type UpdUserRequest struct {
+	Active   *bool   `json:"active,omitempty" doc:"false to suspend the user, true to reactivate"`
+	Expiry   *string `json:"expiry,omitempty" doc:"RFC3339 time when the user can no longer login, or \"\" to remove the expiry"`
+	Admin    *bool   `json:"admin,omitempty" doc:"Grant or revoke account admin"`
+	PersonID *string `json:"person_id,omitempty" doc:"Link the user to this person, or \"\" to unlink"`
+}
+
+//UpdUser changes the user's status, expiry, admin rights or linked person
+//suspending a user, or setting an expiry, ends the user's live sessions
+//the account is never left without an active admin
+func UpdUser(ctx context.Context, by User, userID string, req UpdUserRequest) (*User, error) {
+	before, err := GetUser("", userID)
+	if err != nil {
+		return nil, errors.Errorf("user(%s) not found", userID)
+	}
+	if before.Account == nil {
+		return nil, errors.Errorf("user(%s) not found", userID)
+	}
+	if err := Authorize(by, PermUsersManage, before.Account.ID, ""); err != nil {
+		return nil, err
+	}
+
+	sets := []string{}
+	args := map[string]interface{}{"id": userID}
+	if req.Active != nil {
+		sets = append(sets, "active=:active")
+		args["active"] = *req.Active
+	}
+	if req.Expiry != nil {
+		sets = append(sets, "expiry=:expiry")
+		args["expiry"] = nil
+		if *req.Expiry != "" {
+			t, err := time.Parse(time.RFC3339, *req.Expiry)
+			if err != nil {
+				return nil, errors.Errorf("expiry:\"%s\" is not an RFC3339 time", *req.Expiry)
+			}
+			args["expiry"] = SqlTime(t)
+		}
+	}
+	if req.Admin != nil {
+		if *req.Admin && before.Account.Admin {
+			//admins of the system account are sysadmins
+			if err := Authorize(by, PermSystemManage, "", ""); err != nil {
+				return nil, errors.Wrapf(err, "only sysadmin can grant sysadmin")
+			}
+		}
+		sets = append(sets, "admin=:admin")
+		args["admin"] = *req.Admin
+	}
+	if req.PersonID != nil {
+		sets = append(sets, "person_id=:person_id")
+		args["person_id"] = nil
+		if *req.PersonID != "" {
+			if _, err := GetPerson(*req.PersonID); err != nil {
+				return nil, errors.Errorf("person(%s) not found", *req.PersonID)
+			}
+			args["person_id"] = *req.PersonID
+		}
+	}
+	if len(sets) == 0 {
+		return before, nil
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	if _, err := tx.NamedExec("UPDATE users SET "+strings.Join(sets, ",")+" WHERE id=:id", args); err != nil {
+		return nil, errors.Wrapf(err, "failed to update user")
+	}
+	if before.activeAdmin() {
+		if err := checkActiveAdmins(tx, before.Account.ID); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrapf(err, "failed to update user")
+	}
+
+	//sessions do not outlive the user's permission to login
+	if (req.Active != nil && !*req.Active) || (req.Expiry != nil && *req.Expiry != "") {
+		if _, err := DelUserSessions(userID, ""); err != nil {
+			log.Errorf("failed to end sessions of user(%s): %+v", userID, err)
+		}
+	}
+
+	after, err := GetUser("", userID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get updated user")
+	}
+	audit(ctx, before.Account.ID, "users", userID, "update", before, after)
+	return after, nil
+} //UpdUser()
+
+//DelUser deletes the user and ends the user's sessions
+//a user with messages or API keys, or when anonymise is true, is anonymised instead of deleted,
+//so messages stay intact while the user can no longer login and is not linked to a person
+//returns true if the user was anonymised
+func DelUser(ctx context.Context, by User, userID string, anonymise bool) (bool, error) {
+	user, err := GetUser("", userID)
+	if err != nil || user.Account == nil {
+		return false, errors.Errorf("user(%s) not found", userID)
+	}
+	if err := Authorize(by, PermUsersManage, user.Account.ID, ""); err != nil {
+		return false, err
+	}
+	if !anonymise {
+		var nr int
+		if err := db.Get(
+			&nr,
+			"SELECT (SELECT COUNT(*) FROM messages WHERE from_user_id=? OR to_user_id=?)+(SELECT COUNT(*) FROM api_keys WHERE created_by_user_id=?)",
+			userID, userID, userID,
+		); err != nil {
+			return false, errors.Wrapf(err, "failed to count user messages")
+		}
+		anonymise = nr > 0
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to start transaction")
+	}
+	defer tx.Rollback()
+	if anonymise {
+		if err := anonymiseUser(tx, userID); err != nil {
+			return false, err
+		}
+	} else {
+		if err := delUserCredentials(tx, userID); err != nil {
+			return false, err
+		}
+		if _, err := tx.Exec("DELETE FROM users WHERE id=?", userID); err != nil {
+			return false, errors.Wrapf(err, "failed to delete user")
+		}
+	}
+	if user.activeAdmin() {
+		if err := checkActiveAdmins(tx, user.Account.ID); err != nil {
+			return false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, errors.Wrapf(err, "failed to delete user")
+	}
+
+	if anonymise {
+		audit(ctx, user.Account.ID, "users", userID, "anonymise", user, nil)
+	} else {
+		audit(ctx, user.Account.ID, "users", userID, "delete", user, nil)
+	}
+	return anonymise, nil
+} //DelUser()
+
+//delUserCredentials deletes what the user can login or act with
+func delUserCredentials(e sqlx.Ext, userID string) error {
+	for _, query := range []string{
+		"DELETE FROM sessions WHERE user_id=:id OR impersonator_user_id=:id",
+		"DELETE FROM user_recovery_codes WHERE user_id=:id",
+		"DELETE FROM password_resets WHERE user_id=:id",
+		"DELETE FROM user_identities WHERE user_id=:id",
+		"DELETE FROM user_roles WHERE user_id=:id",
+		"DELETE FROM user_invitations WHERE user_id=:id",
+	} {
+		if _, err := sqlx.NamedExec(e, query, map[string]interface{}{"id": userID}); err != nil {
+			return errors.Wrapf(err, "failed to delete user credentials")
+		}
+	}
+	return nil
+}
+
+//anonymiseUser keeps the user record for the messages it sent or received,
+//but removes its credentials, name and person
+func anonymiseUser(e sqlx.Ext, userID string) error {
+	if err := delUserCredentials(e, userID); err != nil {
+		return err
+	}
+	if _, err := sqlx.NamedExec(
+		e,
+		"UPDATE users SET username=:username,passhash='',admin=false,active=false,expiry=now(),person_id=NULL,"+
+			"must_change_password=false,totp_secret=NULL,totp_enabled=false WHERE id=:id",
+		map[string]interface{}{
+			"id":       userID,
+			"username": "deleted-" + userID,
+		},
+	); err != nil {
+		return errors.Wrapf(err, "failed to anonymise user")
+	}
+	return nil
+}
+
+//activeAdmin is true for a user who can login and is admin of the account,
+//with the admin flag or the account wide account-admin role
+func (u User) activeAdmin() bool {
+	if !u.Active || (u.Expiry != nil && u.Expiry.Before(time.Now())) {
+		return false
+	}
+	if u.Admin {
+		return true
+	}
+	for _, ra := range u.Roles {
+		if ra.Role == RoleAccountAdmin && ra.GroupID == nil {
+			return true
+		}
+	}
+	return false
 }
 
+//checkActiveAdmins fails when the account has no active admin,
+//it is called after changing an active admin, before committing the change
+func checkActiveAdmins(q sqlx.Queryer, accountID string) error {
+	var nr int
+	if err := sqlx.Get(
+		q,
+		&nr,
+		"SELECT COUNT(*) FROM users as u"+
+			" WHERE u.account_id=? AND u.active AND (u.expiry IS NULL OR u.expiry>now())"+
+			" AND (u.admin OR EXISTS(SELECT 1 FROM user_roles as r WHERE r.user_id=u.id AND r.role=? AND r.group_id IS NULL))",
+		accountID,
+		RoleAccountAdmin,
+	); err != nil {
+		return errors.Wrapf(err, "failed to count account admins")
+	}
+	if nr == 0 {
+		return errors.Errorf("account must have at least one active admin")
+	}
+	return nil
+} //checkActiveAdmins()
+
 type RegisterRequest struct {
 	Email      string    `json:"email" doc:"Email is required to contact the user and to login."`
 	Phone      string    `json:"phone" doc:"Phone number where person may be contacted."`
@@ -212,13 +462,16 @@ type RegisterRequest struct {
 	Surname    string    `json:"surname" doc:"Surname of the person registering as a user."`
 	Dob        SqlDate   `json:"dob" doc:"Date of birth is required"`
 	Gender     SqlGender `json:"gender" doc:"Gender male|female is required"`
-	CountryID  string    `json:"country_id" doc:"Nationality of the person registering is indicated by a country_id"`
+	CountryID  string    `json:"country_id" doc:"Nationality of the person registering is indicated by a country_id, ISO code (e.g. ZA or ZAF) or name"`
 	NationalID string    `json:"national_id" doc:"National ID number in the above country."`
+	//minors
+	GuardianEmail string `json:"guardian_email,omitempty" doc:"Required when younger than CONSENT_AGE: email of a registered parent or guardian who must approve before activation."`
 }
 
 type RegisterResponse struct {
-	Email string `json:"email" doc:"Use this to activate the account"`
-	Token string `json:"token" doc:"Use this to activate the account"`
+	Email   string   `json:"email" doc:"Use this to activate the account"`
+	Token   string   `json:"token" doc:"Use this to activate the account"`
+	Consent *Consent `json:"consent,omitempty" doc:"Consent request sent to the guardian of a minor, activation fails until approved"`
 }
 
 var registerDobMin time.Time
@@ -257,21 +510,25 @@ func (req RegisterRequest) Validate() error {
 }
 
 //called to register new user from web site
-func Register(req RegisterRequest) (*RegisterResponse, error) {
+func Register(ctx context.Context, req RegisterRequest) (*RegisterResponse, error) {
 	if err := req.Validate(); err != nil {
 		return nil, errors.Wrapf(err, "invalid request")
 	}
-	country, err := GetCountryByID(req.CountryID)
+	country, err := FindCountry(req.CountryID)
 	if err != nil {
-		log.Errorf("GetCountryByID failed: %+v", err)
-		country, err = GetCountryByName(req.CountryID)
-		if err != nil {
-			log.Errorf("GetCountryByName failed: %+v", err)
-			return nil, errors.Errorf("unknown country(%s)", req.CountryID)
+		return nil, err
+	}
+	if err := ValidateNationalID(*country, req.NationalID, &req.Dob, &req.Gender); err != nil {
+		return nil, err
+	}
+	var guardian *Person
+	if (Person{Dob: &req.Dob}).needsConsent() {
+		if guardian, err = registeredGuardian(req.GuardianEmail); err != nil {
+			return nil, errors.Wrapf(err, "younger than %d needs guardian_email", consentAge)
 		}
 	}
 
-	person, err := AddPersonIfNotExist(Person{
+	person, err := AddPersonIfNotExist(ctx, Person{
 		Name:    req.Name,
 		Surname: req.Surname,
 		Email:   &req.Email,
@@ -287,33 +544,73 @@ func Register(req RegisterRequest) (*RegisterResponse, error) {
 		return nil, errors.Wrapf(err, "failed to create personal info record")
 	}
 
-	newPassword := newRandomPassword(10)
-	user, err := AddUser(NewUser{
+	//the activation token is stored like a password and replaced by the user's
+	//own password when the account is activated
+	activationToken := newRandomToken()
+	user, err := AddUser(ctx, NewUser{
 		Account:  publicAccount,
 		Username: req.Email,
-		Password: newPassword,
+		Password: activationToken,
 		Admin:    false,
 		Active:   false, //need to activate using current password and new password
 		Expiry:   nil,
 		Person:   person,
+		//the token is only good for activation, never for a normal login
+		MustChangePassword: true,
 	})
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to create user account")
 	}
-
-	return &RegisterResponse{
+	res := &RegisterResponse{
 		Email: req.Email,
-		Token: passwordHash(*user, newPassword),
-	}, nil
+		Token: activationToken,
+	}
+	if guardian != nil {
+		//an existing person with parents is not given to the named guardian, the parents must consent
+		guardianID := &guardian.ID
+		parents, err := parentIDs(db, person.ID)
+		if err != nil {
+			return nil, err
+		}
+		if len(parents) > 0 {
+			guardianID = nil
+		}
+		err = requireConsent(ctx, *user, *person, ConsentActionRegister, nil, guardianID)
+		if consentErr, ok := err.(ConsentRequiredError); ok {
+			res.Consent = &consentErr.Consent
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+//registeredGuardian returns the adult person of an active user with the email as username
+func registeredGuardian(email string) (*Person, error) {
+	if email == "" {
+		return nil, errors.Errorf("missing guardian_email")
+	}
+	var personID *string
+	if err := db.Get(&personID, "SELECT person_id FROM users WHERE username=? AND active=true", email); err != nil || personID == nil {
+		return nil, errors.Errorf("guardian_email:\"%s\" is not a registered user with a person profile", email)
+	}
+	guardian, err := GetPerson(*personID)
+	if err != nil {
+		return nil, err
+	}
+	if guardian.age(time.Now()) < familyAdultAge {
+		return nil, errors.Errorf("guardian must be at least %d years old", familyAdultAge)
+	}
+	return guardian, nil
 }
 
 type ActivateRequest struct {
 	Email       string `json:"email" doc:"This is the email used to register"`
-	Token       string `json:"token" doc:"This is the token returned from register response"` //==random password given to inactive user account
+	Token       string `json:"token" doc:"This is the token returned from register response"` //==random token stored as password of inactive user account
 	NewPassword string `json:"new_password" doc:"New password selected by the user"`
 }
 
-func ActivateUser(req ActivateRequest) (*User, error) {
+func ActivateUser(ctx context.Context, req ActivateRequest) (*User, error) {
 	//todo: check strength of new password
 	log.Debugf("activate %+v", req)
 	if req.NewPassword == "" {
@@ -324,37 +621,49 @@ func ActivateUser(req ActivateRequest) (*User, error) {
 	}
 
 	var userRow userRow
-	if err := NamedGet(&userRow, userRowQuery+" where u.username=:email and u.passhash=:token and u.active=false", map[string]interface{}{
+	if err := NamedGet(&userRow, userRowQuery+" where u.username=:email and u.active=false", map[string]interface{}{
 		"email": req.Email,
-		"token": req.Token,
 	}); err != nil {
 		return nil, errors.Wrapf(err, "user not found")
 	}
 	log.Debugf("activate userRow: %+v", userRow)
+	if ok, _ := checkPassword(userRow.PassHash, userRow.UserID, userRow.AccountID, req.Token); !ok {
+		//tokens issued before versioned passwords were the stored sha1 passhash itself
+		if !legacyPasshash(userRow.PassHash) || subtle.ConstantTimeCompare([]byte(userRow.PassHash), []byte(req.Token)) != 1 {
+			return nil, errors.Errorf("user not found")
+		}
+	}
+
+	if err := checkRegisterConsent(userRow.PersonID); err != nil {
+		return nil, err
+	}
 
 	user := userRow.User()
 	log.Debugf("activate user: %+v", user)
 
 	//activate the user and set new password
-	if _, err := db.NamedExec("update users set active=true,passhash=:passhash where id=:id", map[string]interface{}{
-		"passhash": passwordHash(user, req.NewPassword),
+	passhash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to hash new_password")
+	}
+	if _, err := db.NamedExec("update users set active=true,must_change_password=false,passhash=:passhash where id=:id", map[string]interface{}{
+		"passhash": passhash,
 		"id":       user.ID,
 	}); err != nil {
 		return nil, errors.Wrapf(err, "failed to activate user account")
 	}
 	log.Debugf("user(%s) activated", user.ID)
+	before := user
 	user.Active = true
+	audit(ctx, user.Account.ID, "users", user.ID, "activate", before, user)
 	return &user, nil
 }
 
-//AddFamilyMember is called by a logged in parent to add a child or spouse or own parent
-func AddFamilyMember() error {
-	return errors.Errorf("NYI")
-}
-
 type LoginRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	UserAgent  string `json:"-"` //from HTTP request, to let users recognise their sessions
+	RemoteAddr string `json:"-"` //from HTTP request
 }
 
 func Login(req LoginRequest) (*Session, error) {
@@ -365,6 +674,14 @@ func Login(req LoginRequest) (*Session, error) {
 		return nil, errors.Errorf("missing password")
 	}
 
+	//throttled attempts are refused before checking the password
+	if err := checkLoginThrottle(throttleIP, clientIP(req.RemoteAddr)); err != nil {
+		return nil, err
+	}
+	if err := checkLoginThrottle(throttleUsername, req.Username); err != nil {
+		return nil, err
+	}
+
 	var info userRow
 	if err := NamedGet(
 		&info,
@@ -374,161 +691,157 @@ func Login(req LoginRequest) (*Session, error) {
 			"username": req.Username,
 		},
 	); err != nil {
+		loginFailed(req, nil)
 		return nil, errors.Wrapf(err, "failed to prepare")
 	}
 	log.Debugf("Read: %+v", info)
-	passHash := passwordHash(User{ID: info.UserID, Account: &Account{ID: info.AccountID}}, req.Password)
-	if info.PassHash != passHash {
-		log.Debugf("Login user(%s).password(%s): %s != %s", req.Username, req.Password, info.PassHash, passHash)
+	ok, rehash := checkPassword(info.PassHash, info.UserID, info.AccountID, req.Password)
+	if !ok {
+		log.Debugf("Login user(%s): wrong password", req.Username)
+		loginFailed(req, &info)
 		return nil, errors.Errorf("wrong password")
 	}
-	if info.AccountExpiry != nil && time.Time(*info.AccountExpiry).Before(time.Now()) {
-		return nil, errors.Errorf("account %s expired", info.AccountName)
-	}
-	if !info.AccountActive {
-		return nil, errors.Errorf("account suspended")
-	}
-	if info.UserExpiry != nil && time.Time(*info.UserExpiry).Before(time.Now()) {
-		return nil, errors.Errorf("user(%s) login expired", req.Username)
-	}
-	if !info.UserActive {
-		return nil, errors.Errorf("user(%s) suspended", req.Username)
+	if err := checkLoginAllowed(info); err != nil {
+		return nil, err
 	}
-	//delete existing session
-	if _, err := db.NamedExec("DELETE FROM `sessions` where user_id=:user_id", map[string]interface{}{"user_id": info.UserID}); err != nil {
-		return nil, errors.Wrapf(err, "failed to delete existing user session")
+	if rehash {
+		//upgrade outdated passhash while we have the plain password
+		if err := setPassword(db, info.UserID, req.Password); err != nil {
+			log.Errorf("failed to rehash user(%s) password: %+v", info.UserID, err)
+		}
 	}
-	//create new session
-	token := uuid.New().String()
-	if _, err := db.NamedExec(
-		"INSERT INTO `sessions` set `token`=:token,account_id=:account_id,user_id=:user_id",
-		map[string]interface{}{
-			"token":      token,
-			"account_id": info.AccountID,
-			"user_id":    info.UserID,
-		},
-	); err != nil {
-		return nil, errors.Wrapf(err, "failed to create session")
+	//failures are only forgotten after the second factor, else wrong codes are never counted
+	scope := loginScope(info)
+	if scope != SessionScopeMFARequired {
+		loginSucceeded(req.Username)
 	}
-	return &Session{
-		Token: token,
-		User:  info.User(),
-	}, nil
+	return newSession(info, scope, req.UserAgent, req.RemoteAddr)
 }
 
-func Logout(token string) error {
-	if _, err := db.NamedExec(
-		"DELETE FROM sessions WHERE token=:token",
-		map[string]interface{}{
-			"token": token,
-		},
-	); err != nil {
-		return errors.Wrapf(err, "failed to delete session")
+//loginScope is the scope of a new session after authentication:
+//a temporary password chosen by someone else only allows the user to change it,
+//and when MFA is enabled or mandatory, the session is only good for the next step
+func loginScope(info userRow) SessionScope {
+	switch {
+	case info.MustChangePwd:
+		return SessionScopeChangePassword
+	case info.TOTPEnabled:
+		return SessionScopeMFARequired
+	}
+	user := info.User()
+	roles, err := getUserRoles(info.UserID)
+	if err != nil {
+		//cannot tell if the user is admin by role, so do not skip MFA enrolment
+		log.Errorf("failed to get roles of user(%s): %+v", info.UserID, err)
+		return SessionScopeMFAEnrol
 	}
-	return nil
+	user.Roles = roles
+	if mfaMandatory(user) {
+		return SessionScopeMFAEnrol
+	}
+	return SessionScopeFull
 }
 
-func GetSession(token string) (*Session, error) {
-	if token == "" {
-		return nil, errors.Errorf("missing token")
-	}
-	var info struct {
-		StartTime     *SqlTime `db:"time_created"`
-		UserID        string   `db:"user_id"`
-		Username      string   `db:"username"`
-		UserActive    bool     `db:"user_active"`
-		UserAdmin     bool     `db:"user_admin"`
-		UserExpiry    *SqlTime `db:"user_expiry"`
-		AccountID     string   `db:"account_id"`
-		AccountName   string   `db:"account_name"`
-		AccountActive bool     `db:"account_active"`
-		AccountAdmin  bool     `db:"account_admin"`
-		AccountExpiry *SqlTime `db:"account_expiry"`
+//checkLoginAllowed checks that the user and account may login (after authentication)
+func checkLoginAllowed(info userRow) error {
+	if info.AccountExpiry != nil && time.Time(*info.AccountExpiry).Before(time.Now()) {
+		return errors.Errorf("account %s expired", info.AccountName)
 	}
-	if err := NamedGet(
-		&info,
-		"select s.time_created,s.user_id,u.username,u.active as user_active,u.admin as user_admin,u.expiry as user_expiry,"+
-			"a.id as account_id,a.name as account_name,a.active as account_active,a.admin as account_admin,"+
-			"a.expiry as account_expiry"+
-			" from sessions as s"+
-			" LEFT JOIN users as u on u.id = s.user_id"+
-			" LEFT JOIN accounts as a on a.id = s.account_id"+
-			" WHERE s.token=:token",
-		map[string]interface{}{
-			"token": token,
-		},
-	); err != nil {
-		return nil, errors.Wrapf(err, "failed to get users")
+	if !info.AccountActive {
+		return errors.Errorf("account suspended")
 	}
-	log.Debugf("Read: %+v", info)
-
-	now := SqlTime(time.Now())
-	if _, err := db.NamedExec(
-		"UPDATE sessions SET time_updated=:now WHERE token=:token",
-		map[string]interface{}{
-			"now":   now,
-			"token": token,
-		},
-	); err != nil {
-		return nil, errors.Wrapf(err, "failed to update session")
-	}
-	return &Session{
-		Token:       token,
-		TimeCreated: info.StartTime,
-		TimeUpdated: &now,
-		User: User{
-			ID:       info.UserID,
-			Username: info.Username,
-			Account: &Account{
-				ID:     info.AccountID,
-				Name:   info.AccountName,
-				Active: info.AccountActive,
-				Admin:  info.AccountAdmin,
-				Expiry: (*time.Time)(info.AccountExpiry),
-			},
-			Admin:  info.UserAdmin,
-			Active: info.UserActive,
-			Expiry: (*time.Time)(info.UserExpiry),
-		},
-	}, nil
+	if info.UserExpiry != nil && time.Time(*info.UserExpiry).Before(time.Now()) {
+		return errors.Errorf("user(%s) login expired", info.Username)
+	}
+	if !info.UserActive {
+		return errors.Errorf("user(%s) suspended", info.Username)
+	}
+	return nil
 }
 
-func ChangePassword(userID string, newPassword string) error {
-	//todo: make sure allowed to change
+type ChangePasswordRequest struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
 
-	if newPassword == "" {
-		return errors.Errorf("missing new password")
-	}
+//ChangePassword changes the password of the user, which must be the logged in user,
+//after verifying the old password
+func ChangePassword(ctx context.Context, userID string, req ChangePasswordRequest) error {
 	if userID == "" {
 		return errors.Errorf("missing user.id")
 	}
+	if req.OldPassword == "" {
+		return errors.Errorf("missing old_password")
+	}
+	if req.NewPassword == "" {
+		return errors.Errorf("missing new_password")
+	}
+	if err := CheckPasswordStrength(req.NewPassword, 8); err != nil {
+		return errors.Wrapf(err, "new password not strong enough")
+	}
 
-	//read account id from user table - needed for password hashing
 	var row struct {
 		AccountID string `db:"account_id"`
+		PassHash  string `db:"passhash"`
 	}
 	if err := NamedGet(
 		&row,
-		"SELECT account_id FROM users where id=:user_id",
+		"SELECT account_id,passhash FROM users where id=:user_id",
 		map[string]interface{}{
 			"user_id": userID,
 		},
 	); err != nil {
 		return errors.Wrapf(err, "cannot read user record")
 	}
+	if ok, _ := checkPassword(row.PassHash, userID, row.AccountID, req.OldPassword); !ok {
+		return errors.Errorf("wrong old_password")
+	}
+	newPassword := req.NewPassword
+	if err := setPassword(db, userID, newPassword); err != nil {
+		return errors.Wrapf(err, "failed to change user(%s).password", userID)
+	}
+	audit(ctx, row.AccountID, "users", userID, "change_password", nil, nil)
 
-	passhash := passwordHash(
-		User{ID: userID, Account: &Account{ID: row.AccountID}},
-		newPassword,
-	)
+	//a strong password chosen by the user replaces any temporary password,
+	//and the restricted session used to change it must not become a full session
 	if _, err := db.NamedExec(
+		"UPDATE users SET must_change_password=false WHERE id=:user_id",
+		map[string]interface{}{
+			"user_id": userID,
+		},
+	); err != nil {
+		return errors.Wrapf(err, "failed to clear must_change_password")
+	}
+	if _, err := db.NamedExec(
+		"DELETE FROM sessions WHERE user_id=:user_id AND scope=:scope",
+		map[string]interface{}{
+			"user_id": userID,
+			"scope":   SessionScopeChangePassword,
+		},
+	); err != nil {
+		return errors.Wrapf(err, "failed to delete restricted sessions")
+	}
+	return nil
+}
+
+func setPassword(e sqlx.Ext, userID string, password string) error {
+	passhash, err := hashPassword(password)
+	if err != nil {
+		return errors.Wrapf(err, "failed to hash password")
+	}
+	result, err := sqlx.NamedExec(
+		e,
 		"UPDATE users SET passhash=:passhash WHERE id=:user_id",
 		map[string]interface{}{
 			"user_id":  userID,
 			"passhash": passhash,
 		},
-	); err != nil {
-		return errors.Wrapf(err, "failed to change user(%s).password(%s)", userID, newPassword)
+	)
+	if err != nil {
+		return errors.Wrapf(err, "failed to update passhash")
+	}
+	if nr, _ := result.RowsAffected(); nr != 1 {
+		return errors.Errorf("user(%s) not found", userID)
 	}
 	return nil
 }
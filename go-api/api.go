@@ -2,6 +2,8 @@ package api
 
 import (
 	"net/http"
+	"sort"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
@@ -21,9 +23,22 @@ type api struct {
 }
 
 func (api api) Serve() {
+	//register paths with fewer variables first, so that e.g. /account/usage
+	//is matched before /account/{account_id}
+	paths := make([]string, 0, len(api.r))
+	for path := range api.r {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		ni, nj := strings.Count(paths[i], "{"), strings.Count(paths[j], "{")
+		if ni != nj {
+			return ni < nj
+		}
+		return paths[i] < paths[j]
+	})
 	r := mux.NewRouter()
-	for path, methods := range api.r {
-		for method, handler := range methods {
+	for _, path := range paths {
+		for method, handler := range api.r[path] {
 			r.HandleFunc(path, handler).Methods(method)
 		}
 	}
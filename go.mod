@@ -10,6 +10,7 @@ require (
 	github.com/gorilla/mux v1.8.0
 	github.com/jmoiron/sqlx v1.3.4
 	github.com/stewelarend/logger v0.0.4
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
 )
 
 require github.com/go-msvc/logger v0.0.0-20210121062433-1f3922644bec // indirect
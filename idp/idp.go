@@ -0,0 +1,25 @@
+//Package idp defines external identity providers that can authenticate users
+//on behalf of an account, e.g. a school using its own OpenID Connect server
+package idp
+
+import "context"
+
+//Identity is the user as asserted by the external identity provider
+type Identity struct {
+	Subject       string `json:"sub" doc:"Unique and stable ID of the user at the provider"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified,omitempty"`
+	Name          string `json:"name,omitempty"`
+	Surname       string `json:"surname,omitempty"`
+}
+
+//Provider authenticates users with a browser redirect to the provider,
+//which then redirects back with a code to exchange for the user's identity
+type Provider interface {
+	//AuthURL is where the user must be redirected to login
+	//state and nonce must be random values remembered until the callback
+	AuthURL(state string, nonce string) string
+
+	//Exchange the code from the callback for the verified identity of the user
+	Exchange(ctx context.Context, code string, nonce string) (*Identity, error)
+}
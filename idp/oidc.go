@@ -0,0 +1,310 @@
+package idp
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-msvc/errors"
+)
+
+//OIDCConfig configures an OpenID Connect provider using the authorization code flow
+type OIDCConfig struct {
+	Issuer       string   `json:"issuer" doc:"Issuer https URL on a public host, used to discover the provider endpoints"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url" doc:"Callback URL registered with the provider"`
+	Scopes       []string `json:"scopes,omitempty" doc:"Defaults to openid email profile"`
+}
+
+func (c *OIDCConfig) Validate() error {
+	if c.Issuer == "" {
+		return errors.Errorf("missing issuer")
+	}
+	if c.ClientID == "" {
+		return errors.Errorf("missing client_id")
+	}
+	if c.RedirectURL == "" {
+		return errors.Errorf("missing redirect_url")
+	}
+	if len(c.Scopes) == 0 {
+		c.Scopes = []string{"openid", "email", "profile"}
+	}
+	return nil
+}
+
+type oidcProvider struct {
+	config   OIDCConfig
+	client   *http.Client
+	metadata oidcMetadata
+}
+
+//subset of the discovery document used by this provider
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+//clock skew allowed when checking token times
+const oidcLeeway = time.Minute
+
+//NewOIDC discovers the provider endpoints from the issuer
+func NewOIDC(ctx context.Context, config OIDCConfig) (Provider, error) {
+	return NewOIDCWithClient(ctx, config, &http.Client{Timeout: 10 * time.Second})
+}
+
+//NewOIDCWithClient is NewOIDC using the client for all requests to the provider,
+//e.g. to restrict which addresses may be called
+func NewOIDCWithClient(ctx context.Context, config OIDCConfig, client *http.Client) (Provider, error) {
+	if err := config.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid OIDC config")
+	}
+	p := &oidcProvider{
+		config: config,
+		client: client,
+	}
+	if err := p.getJSON(ctx, strings.TrimSuffix(config.Issuer, "/")+"/.well-known/openid-configuration", &p.metadata); err != nil {
+		return nil, errors.Wrapf(err, "failed to discover OIDC provider")
+	}
+	if p.metadata.Issuer != config.Issuer {
+		return nil, errors.Errorf("discovered issuer \"%s\" != configured \"%s\"", p.metadata.Issuer, config.Issuer)
+	}
+	if p.metadata.AuthorizationEndpoint == "" || p.metadata.TokenEndpoint == "" || p.metadata.JwksURI == "" {
+		return nil, errors.Errorf("incomplete OIDC discovery document")
+	}
+	return p, nil
+}
+
+func (p *oidcProvider) AuthURL(state string, nonce string) string {
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.config.ClientID)
+	params.Set("redirect_uri", p.config.RedirectURL)
+	params.Set("scope", strings.Join(p.config.Scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	sep := "?"
+	if strings.Contains(p.metadata.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return p.metadata.AuthorizationEndpoint + sep + params.Encode()
+}
+
+func (p *oidcProvider) Exchange(ctx context.Context, code string, nonce string) (*Identity, error) {
+	if code == "" {
+		return nil, errors.Errorf("missing code")
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("client_id", p.config.ClientID)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create token request")
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	httpReq.Header.Set("Accept", "application/json")
+	httpReq.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	httpRes, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, errors.Wrapf(err, "token request failed")
+	}
+	defer httpRes.Body.Close()
+	if httpRes.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("token request failed: %s", httpRes.Status)
+	}
+	var tokenRes struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(httpRes.Body).Decode(&tokenRes); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode token response")
+	}
+	if tokenRes.IDToken == "" {
+		return nil, errors.Errorf("token response without id_token")
+	}
+
+	claims, err := p.verifyIDToken(ctx, tokenRes.IDToken)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid id_token")
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.Errorf("id_token nonce mismatch")
+	}
+	if claims.Subject == "" {
+		return nil, errors.Errorf("id_token without sub")
+	}
+	return &Identity{
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: bool(claims.EmailVerified),
+		Name:          claims.GivenName,
+		Surname:       claims.FamilyName,
+	}, nil
+}
+
+type idTokenClaims struct {
+	Issuer        string       `json:"iss"`
+	Subject       string       `json:"sub"`
+	Audience      audience     `json:"aud"`
+	Expiry        int64        `json:"exp"`
+	IssuedAt      int64        `json:"iat"`
+	Nonce         string       `json:"nonce"`
+	Email         string       `json:"email"`
+	EmailVerified flexibleBool `json:"email_verified"`
+	GivenName     string       `json:"given_name"`
+	FamilyName    string       `json:"family_name"`
+}
+
+//aud may be a string or a list of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(v []byte) error {
+	var s string
+	if err := json.Unmarshal(v, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var l []string
+	if err := json.Unmarshal(v, &l); err != nil {
+		return errors.Errorf("aud is not string or list of strings")
+	}
+	*a = audience(l)
+	return nil
+}
+
+//some providers send email_verified as "true"
+type flexibleBool bool
+
+func (b *flexibleBool) UnmarshalJSON(v []byte) error {
+	s := strings.Trim(string(v), "\"")
+	*b = flexibleBool(s == "true")
+	return nil
+}
+
+func (p *oidcProvider) verifyIDToken(ctx context.Context, token string) (*idTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.Errorf("not a JWT")
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid header encoding")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, errors.Wrapf(err, "invalid header")
+	}
+	if header.Alg != "RS256" {
+		return nil, errors.Errorf("unsupported alg \"%s\"", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid signature encoding")
+	}
+
+	key, err := p.publicKey(ctx, header.Kid)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get signing key")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errors.Errorf("bad signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid payload encoding")
+	}
+	var claims idTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.Wrapf(err, "invalid claims")
+	}
+	if claims.Issuer != p.config.Issuer {
+		return nil, errors.Errorf("iss \"%s\" != \"%s\"", claims.Issuer, p.config.Issuer)
+	}
+	audOk := false
+	for _, a := range claims.Audience {
+		if a == p.config.ClientID {
+			audOk = true
+		}
+	}
+	if !audOk {
+		return nil, errors.Errorf("aud does not include client_id")
+	}
+	now := time.Now()
+	if time.Unix(claims.Expiry, 0).Add(oidcLeeway).Before(now) {
+		return nil, errors.Errorf("expired")
+	}
+	if claims.IssuedAt != 0 && time.Unix(claims.IssuedAt, 0).Add(-oidcLeeway).After(now) {
+		return nil, errors.Errorf("issued in the future")
+	}
+	return &claims, nil
+}
+
+//publicKey gets the RSA key with kid from the provider's JWKS
+//(kid may be empty when the provider has only one key)
+func (p *oidcProvider) publicKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.metadata.JwksURI, &jwks); err != nil {
+		return nil, errors.Wrapf(err, "failed to get JWKS")
+	}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (kid != "" && k.Kid != kid) {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid key modulus")
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid key exponent")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	}
+	return nil, errors.Errorf("key \"%s\" not found", kid)
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, url string, resPtr interface{}) error {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create request")
+	}
+	httpReq.Header.Set("Accept", "application/json")
+	httpRes, err := p.client.Do(httpReq)
+	if err != nil {
+		return errors.Wrapf(err, "GET %s failed", url)
+	}
+	defer httpRes.Body.Close()
+	if httpRes.StatusCode != http.StatusOK {
+		return errors.Errorf("GET %s: %s", url, httpRes.Status)
+	}
+	if err := json.NewDecoder(httpRes.Body).Decode(resPtr); err != nil {
+		return errors.Wrapf(err, "failed to decode %s", url)
+	}
+	return nil
+}
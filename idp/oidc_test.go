@@ -0,0 +1,177 @@
+package idp_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"bitbucket.org/vservices/hotseat/idp"
+)
+
+//mockOIDC is a minimal OpenID Connect server that issues an id_token for every code
+type mockOIDC struct {
+	server     *httptest.Server
+	key        *rsa.PrivateKey        //key published in JWKS
+	signingKey *rsa.PrivateKey        //key used to sign id_tokens, normally the same key
+	claims     map[string]interface{} //claims of the next id_token
+}
+
+func newMockOIDC(t *testing.T) *mockOIDC {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %+v", err)
+	}
+	m := &mockOIDC{key: key, signingKey: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(httpRes http.ResponseWriter, httpReq *http.Request) {
+		json.NewEncoder(httpRes).Encode(map[string]interface{}{
+			"issuer":                 m.server.URL,
+			"authorization_endpoint": m.server.URL + "/authorize",
+			"token_endpoint":         m.server.URL + "/token",
+			"jwks_uri":               m.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(httpRes http.ResponseWriter, httpReq *http.Request) {
+		json.NewEncoder(httpRes).Encode(map[string]interface{}{
+			"keys": []map[string]interface{}{{
+				"kty": "RSA",
+				"kid": "k1",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(httpRes http.ResponseWriter, httpReq *http.Request) {
+		clientID, clientSecret, _ := httpReq.BasicAuth()
+		if clientID != "hotseat" || clientSecret != "secret" || httpReq.FormValue("code") != "good-code" {
+			http.Error(httpRes, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(httpRes).Encode(map[string]interface{}{
+			"access_token": "at",
+			"token_type":   "Bearer",
+			"id_token":     m.sign(t, m.claims),
+		})
+	})
+	m.server = httptest.NewServer(mux)
+	return m
+}
+
+func (m *mockOIDC) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]interface{}{"alg": "RS256", "kid": "k1", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, m.signingKey, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("failed to sign: %+v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (m *mockOIDC) validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":            m.server.URL,
+		"aud":            "hotseat",
+		"sub":            "user-123",
+		"exp":            time.Now().Add(time.Minute).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          "n1",
+		"email":          "jan@school.example",
+		"email_verified": true,
+		"given_name":     "Jan",
+		"family_name":    "Semmelink",
+	}
+}
+
+func TestOIDC(t *testing.T) {
+	m := newMockOIDC(t)
+	defer m.server.Close()
+
+	p, err := idp.NewOIDC(context.Background(), idp.OIDCConfig{
+		Issuer:       m.server.URL,
+		ClientID:     "hotseat",
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost:3000/callback",
+	})
+	if err != nil {
+		t.Fatalf("failed to create provider: %+v", err)
+	}
+
+	authURL, err := url.Parse(p.AuthURL("s1", "n1"))
+	if err != nil {
+		t.Fatalf("invalid auth url: %+v", err)
+	}
+	if !strings.HasPrefix(authURL.String(), m.server.URL+"/authorize?") ||
+		authURL.Query().Get("state") != "s1" ||
+		authURL.Query().Get("nonce") != "n1" ||
+		authURL.Query().Get("client_id") != "hotseat" {
+		t.Fatalf("wrong auth url: %s", authURL)
+	}
+
+	m.claims = m.validClaims()
+	identity, err := p.Exchange(context.Background(), "good-code", "n1")
+	if err != nil {
+		t.Fatalf("exchange failed: %+v", err)
+	}
+	if identity.Subject != "user-123" || identity.Email != "jan@school.example" || !identity.EmailVerified || identity.Name != "Jan" || identity.Surname != "Semmelink" {
+		t.Fatalf("wrong identity: %+v", identity)
+	}
+
+	if _, err := p.Exchange(context.Background(), "bad-code", "n1"); err == nil {
+		t.Fatalf("exchange succeeded with bad code")
+	}
+	if _, err := p.Exchange(context.Background(), "good-code", "other-nonce"); err == nil {
+		t.Fatalf("exchange succeeded with wrong nonce")
+	}
+
+	invalidClaims := map[string]func(c map[string]interface{}){
+		"expired":      func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"other issuer": func(c map[string]interface{}) { c["iss"] = "https://evil.example" },
+		"other client": func(c map[string]interface{}) { c["aud"] = []string{"other"} },
+		"no subject":   func(c map[string]interface{}) { delete(c, "sub") },
+	}
+	for name, change := range invalidClaims {
+		m.claims = m.validClaims()
+		change(m.claims)
+		if _, err := p.Exchange(context.Background(), "good-code", "n1"); err == nil {
+			t.Errorf("exchange succeeded with %s", name)
+		}
+	}
+}
+
+func TestOIDCBadSignature(t *testing.T) {
+	m := newMockOIDC(t)
+	defer m.server.Close()
+	p, err := idp.NewOIDC(context.Background(), idp.OIDCConfig{
+		Issuer:       m.server.URL,
+		ClientID:     "hotseat",
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost:3000/callback",
+	})
+	if err != nil {
+		t.Fatalf("failed to create provider: %+v", err)
+	}
+
+	//sign with another key than the one published in JWKS
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %+v", err)
+	}
+	m.signingKey = otherKey
+	m.claims = m.validClaims()
+	if _, err := p.Exchange(context.Background(), "good-code", "n1"); err == nil {
+		t.Fatalf("exchange succeeded with bad signature")
+	}
+}
@@ -4,13 +4,16 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"bitbucket.org/vservices/hotseat/db"
 	api "bitbucket.org/vservices/hotseat/go-api"
 	"github.com/go-msvc/errors"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/stewelarend/logger"
 )
@@ -18,6 +21,10 @@ import (
 var log = logger.New().WithLevel(logger.LevelDebug)
 
 func main() {
+	if _, err := db.SeedISO3166(); err != nil {
+		log.Errorf("failed to load ISO 3166 countries: %+v", err)
+	}
+	go purgeDeletedAccounts()
 	api.New(
 		map[string]map[string]api.Handler{
 			"/register": {
@@ -26,23 +33,110 @@ func main() {
 			"/activate": {
 				"POST": activate,
 			},
+			"/invitation/accept": {
+				"POST": acceptInvitation, //invited user sets own password
+			},
 			"/login": {
 				"POST": login, //not authed else cannot login
 			},
+			"/login/callback": {
+				"GET": loginCallback, //redirect from external identity provider
+			},
+			"/login/{account_id}/{idp_name}": {
+				"GET": loginExternal, //redirect to the account's external identity provider
+			},
+			"/login/mfa": {
+				"POST": auth(loginMFA, db.SessionScopeMFARequired, "Complete login with the MFA code using the token of the mfa_required session."),
+			},
 			"/logout": {
-				"POST": auth(logout),
+				"POST": auth(logout, db.SessionScopeChangePassword, db.SessionScopeMFARequired, db.SessionScopeMFAEnrol),
+			},
+			"/user/mfa/totp": {
+				"POST":   auth(enrolTOTP, db.SessionScopeMFAEnrol, notImpersonated, "Generate TOTP secret and recovery codes. Enabled only after confirm."),
+				"DELETE": auth(disableTOTP, notImpersonated, "Disable TOTP with a current code."),
+			},
+			"/user/mfa/totp/confirm": {
+				"POST": auth(confirmTOTP, db.SessionScopeMFAEnrol, notImpersonated, "Enable TOTP with the first code from the authenticator app."),
+			},
+			"/sessions": {
+				"GET":    auth(getSessions, "List your own sessions."),
+				"DELETE": auth(delSessions, "Revoke all your sessions except the current one."),
+			},
+			"/sessions/{session_id}": {
+				"DELETE": auth(delSession, "Revoke one of your own sessions."),
+			},
+			"/apikeys": {
+				"GET":  auth(getApiKeys, "List API keys of your account."),
+				"POST": auth(addApiKey, notImpersonated, "Account admin create an API key. The key value is only returned once."),
+			},
+			"/apikeys/{apikey_id}": {
+				"DELETE": auth(delApiKey, "Account admin revoke an API key."),
+			},
+			"/idps": {
+				"GET":  auth(getIdentityProviders, "List external identity providers of your account. Secrets are not returned."),
+				"POST": auth(addIdentityProvider, "Account admin configure an external identity provider, e.g. type oidc."),
+			},
+			"/idps/{idp_id}": {
+				"DELETE": auth(delIdentityProvider, "Account admin remove an external identity provider."),
+			},
+			"/user/identities/{idp_name}": {
+				"POST": auth(linkIdentity, notImpersonated, "Get the URL to login at an external identity provider of your account, which links that identity to your user."),
 			},
 			"/users": {
-				"GET":  auth(getUsers),
+				"GET":  auth(getUsers, db.ApiKeyScopeUsersRead),
 				"POST": auth(addUser), //add account user - must be done by account admin
 			},
+			"/users/invitations": {
+				"GET":  auth(getUserInvitations, "List invitations that were not yet accepted."),
+				"POST": auth(inviteUser, "Invite a user by email. The user is created inactive until accepting with own password at POST /invitation/accept."),
+			},
+			"/users/invitations/{invitation_id}": {
+				"DELETE": auth(revokeUserInvitation, "Revoke the invitation and delete the pending user."),
+			},
+			"/users/invitations/{invitation_id}/resend": {
+				"POST": auth(resendUserInvitation, "Send a new token with a new expiry."),
+			},
 			"/user/{user_id}": {
-				"GET":    auth(getUser),
-				"PUT":    auth(updUser),
-				"DELETE": auth(delUser),
+				"GET":    auth(getUser, db.ApiKeyScopeUsersRead),
+				"PUT":    auth(updUser, "Account admin suspend or reactivate a user, set expiry, grant or revoke admin, or link a person."),
+				"DELETE": auth(delUser, "Account admin delete a user. Users with messages are anonymised, or use ?anonymise=true."),
+			},
+			"/password/forgot": {
+				"POST": forgotPassword,
+			},
+			"/password/reset": {
+				"POST": resetPassword,
+			},
+			"/user/{user_id}/sessions": {
+				"DELETE": auth(delUserSessions, "Account admin revoke all sessions of a user."),
+			},
+			"/user/{user_id}/roles": {
+				"GET":  auth(getUserRoles, "List roles assigned to a user, in addition to those implied by the admin flags."),
+				"POST": auth(addUserRole, "Assign a role to a user for the account, or for one group with group_id."),
+			},
+			"/user/{user_id}/roles/{role}": {
+				"DELETE": auth(delUserRole, "Remove a role from a user. Use ?group_id=<id> for a group role."),
+			},
+			"/user/{user_id}/impersonate": {
+				"POST": auth(impersonateUser, notImpersonated, "Sysadmin get a time limited session to act as the user. All requests in the session are logged."),
+			},
+			"/audit": {
+				"GET": auth(getAudit, "Account admin list changes made in the account. Filter with table, id, user_id, request_id, from and to. Sysadmin can filter on account_id."),
+			},
+			"/impersonations": {
+				"GET": auth(getImpersonations, notImpersonated, "Sysadmin list requests made while impersonating users. Use ?user_id=<id> for one user."),
+			},
+			"/user/{user_id}/unlock": {
+				"POST": auth(unlockUser, "Account admin allow a user locked out by failed logins to login again."),
+			},
+			"/lockouts": {
+				"GET": auth(getLockouts, "Account admin list lockouts of account users caused by failed logins. Sysadmin sees all, incl. client IP lockouts."),
+			},
+			"/lockouts/ip/{ip}": {
+				"DELETE": auth(unlockIP, "Sysadmin allow logins again from a client IP locked out by failed logins."),
 			},
 			"/user/{user_id}/password": {
-				"PUT": auth(updUserPassword),
+				"PUT": auth(updUserPassword, db.SessionScopeChangePassword, notImpersonated),
 			},
 			"/messages": {
 				"POST": auth(sendMessage),
@@ -60,42 +154,215 @@ func main() {
 			"/account": {
 				"GET": auth(getAccount),
 			},
+			"/account/usage": {
+				"GET": auth(getAccountUsage, "Current usage of your account against the limits of its plan."),
+			},
+			"/plans": {
+				"GET": auth(getPlans),
+			},
+			"/account/mfa": {
+				"PUT": auth(updAccountMFA, "Account admin make MFA mandatory for admin users of the account."),
+			},
 			"/account/{account_id}": {
 				"GET":    auth(getAccount),
-				"PUT":    auth(updAccount),
-				"DELETE": auth(delAccount),
+				"PUT":    auth(updAccount, "Sysadmin rename, suspend, set expiry or change the plan of an account."),
+				"DELETE": auth(delAccount, "Sysadmin delete account with all its contents. Use ?dry_run=true to see what will be deleted. The account can be restored until purged after the grace period."),
+			},
+			"/account/{account_id}/restore": {
+				"POST": auth(restoreAccount, "Sysadmin restore a deleted account before it is purged."),
 			},
 			"/groups": {
-				"GET":  auth(getGroups, "Get list of groups owned by your account as well as groups that your account are allowed to create a sub-group in, even if you already did so."),
-				"POST": auth(addGroup, "Create a new group that belongs to the account. Only account admin can create a group."),
+				"GET":  auth(getGroups, db.ApiKeyScopeGroupsRead, "Get list of groups owned by your account as well as groups that your account are allowed to create a sub-group in, even if you already did so."),
+				"POST": auth(addGroup, db.ApiKeyScopeGroupsWrite, "Create a new group that belongs to the account. Only account admin can create a group."),
+			},
+			"/groups/invitations": {
+				"GET": auth(getGroupInvitations, db.ApiKeyScopeGroupsRead, "Account admin list invitations from other accounts to create a sub-group in one of their groups."),
+			},
+			"/group/{group_id}/accept": {
+				"POST": auth(acceptGroupInvitation, db.ApiKeyScopeGroupsWrite, "Account admin accept a sub-group invitation with name, description and data. The group then counts for the plan."),
+			},
+			"/group/{group_id}/decline": {
+				"POST": auth(declineGroupInvitation, db.ApiKeyScopeGroupsWrite, "Account admin decline a sub-group invitation, which deletes it."),
 			},
 			"/group/{group_id}": {
-				"GET":    auth(getGroup),
-				"PUT":    auth(updGroup),
-				"DELETE": auth(delGroup),
+				"GET":    auth(getGroup, db.ApiKeyScopeGroupsRead),
+				"PUT":    auth(updGroup, db.ApiKeyScopeGroupsWrite),
+				"DELETE": auth(delGroup, db.ApiKeyScopeGroupsWrite),
 			},
 			"/group/{group_id}/fields": {
-				"GET":    auth(getGroupFields),
-				"PUT":    auth(updGroupFields),
-				"DELETE": auth(delGroupFields),
+				"GET":    auth(getGroupFields, db.ApiKeyScopeGroupsRead),
+				"PUT":    auth(updGroupFields, db.ApiKeyScopeGroupsWrite),
+				"DELETE": auth(delGroupFields, db.ApiKeyScopeGroupsWrite),
+			},
+			"/family": {
+				"GET":  auth(getFamily, "Your household: your person with parents, spouses, children and the dependants you may act for."),
+				"POST": auth(addFamilyMember, "Add a child, spouse or parent to your person profile. An existing person is only linked after the person, a parent or a group admin approves (202)."),
+			},
+			"/family/requests": {
+				"GET": auth(getFamilyRequests, "Requests to add you, your children or members of your groups to another family. Use ?status=approved|declined, default pending."),
+			},
+			"/family/request/{request_id}/approve": {
+				"POST": auth(decideFamilyRequest(true), notImpersonated, "Approve a request to add you, your child or a member of your group to another family."),
+			},
+			"/family/request/{request_id}/decline": {
+				"POST": auth(decideFamilyRequest(false), notImpersonated, "Decline a request to add you, your child or a member of your group to another family."),
+			},
+			"/consents": {
+				"GET": auth(getConsents, "Guardian inbox of consent requests from your children, or those who named you when registering. Use ?status=approved|declined, default pending."),
+			},
+			"/consent/{consent_id}/approve": {
+				"POST": auth(decideConsent(true), notImpersonated, "Guardian approve a minor's request to register, join a group or send messages."),
+			},
+			"/consent/{consent_id}/decline": {
+				"POST": auth(decideConsent(false), notImpersonated, "Guardian decline a minor's request, with an optional note."),
+			},
+			"/group/{group_id}/join": {
+				"POST": auth(joinGroup, "Request membership for yourself or a dependant (person_id). Pending until accepted. Minors joining by themselves first need guardian consent (202)."),
+			},
+			"/group/{group_id}/applications": {
+				"GET":  auth(getGroupApplications, db.ApiKeyScopeMembersRead, "Review queue of applications to join the group. Use ?status=accepted|rejected, default pending."),
+				"POST": auth(applyToGroup, "Apply for yourself or a dependant (person_id) with values for all fields of the group and its parent groups. Group admins are notified."),
+			},
+			"/group/{group_id}/application/{person_id}/accept": {
+				"POST": auth(reviewGroupApplication(true), db.ApiKeyScopeMembersWrite, "Accept a pending application with an optional reason. The applicant is notified."),
+			},
+			"/group/{group_id}/application/{person_id}/reject": {
+				"POST": auth(reviewGroupApplication(false), db.ApiKeyScopeMembersWrite, "Reject a pending application with a reason. The applicant is notified."),
 			},
 			"/persons": {
-				"GET": auth(getPersons),
+				"GET": auth(getPersons, db.ApiKeyScopeMembersRead, "Search persons in a group you can read (group_id), sysadmin can search all persons."),
+			},
+			"/countries": {
+				"GET":  getCountries, //use ?name=<part of name> to filter
+				"POST": auth(addCountry, "Sysadmin add a country with optional ISO codes and national ID regex pattern."),
+			},
+			"/countries/iso3166": {
+				"POST": auth(loadISO3166, "Sysadmin add the ISO 3166 countries and regions that are missing. Existing ones are kept."),
+			},
+			"/country/{country_id}": {
+				"GET":    getCountry,
+				"PUT":    auth(updCountry, "Sysadmin rename a country or change its ISO codes or national ID regex pattern."),
+				"DELETE": auth(delCountry, "Sysadmin delete a country with its regions, if not used by persons or addresses."),
+			},
+			"/countries/{country_id}/regions": {
+				"GET":  getCountryRegions, //use ?name=<part of name> to filter
+				"POST": auth(addRegion, "Sysadmin add a region with a code unique in the country."),
+			},
+			"/region/{region_id}": {
+				"GET":    getRegion,
+				"PUT":    auth(updRegion, "Sysadmin rename a region or change its code."),
+				"DELETE": auth(delRegion, "Sysadmin delete a region that is not used in addresses."),
+			},
+			"/person/{person_id}/export": {
+				"GET": auth(exportPerson, notImpersonated, "Everything stored about your own person or a dependant (POPIA/GDPR subject access)."),
+			},
+			"/person/{person_id}/erasure": {
+				"POST": auth(requestPersonErasure, notImpersonated, "Ask to erase your own person or a dependant. Sysadmin completes or rejects the request."),
+			},
+			"/erasures": {
+				"GET": auth(getPersonErasures, "Sysadmin list erasure requests. Use ?status=completed|rejected, default requested."),
+			},
+			"/erasure/{erasure_id}/complete": {
+				"POST": auth(completePersonErasure, notImpersonated, "Sysadmin anonymise the person and its users. Memberships and messages are kept."),
+			},
+			"/erasure/{erasure_id}/reject": {
+				"POST": auth(rejectPersonErasure, notImpersonated, "Sysadmin reject an erasure request with a note why the data must be kept."),
+			},
+			"/person/{person_id}/addresses": {
+				"GET":  auth(getAddresses("persons", "person_id"), "Addresses of your own person or a dependant."),
+				"POST": auth(addAddress("persons", "person_id"), "Add an address with a unique label. region_id must be in country_id."),
+			},
+			"/person/{person_id}/address/{address_id}": {
+				"PUT":    auth(updAddress("persons", "person_id")),
+				"DELETE": auth(delAddress("persons", "person_id")),
+			},
+			"/group/{group_id}/addresses": {
+				"GET":  auth(getAddresses("groups", "group_id"), db.ApiKeyScopeGroupsRead),
+				"POST": auth(addAddress("groups", "group_id"), db.ApiKeyScopeGroupsWrite, "Add an address with a unique label. region_id must be in country_id."),
+			},
+			"/group/{group_id}/address/{address_id}": {
+				"PUT":    auth(updAddress("groups", "group_id"), db.ApiKeyScopeGroupsWrite),
+				"DELETE": auth(delAddress("groups", "group_id"), db.ApiKeyScopeGroupsWrite),
+			},
+			"/event/{event_id}/addresses": {
+				"GET":  auth(getAddresses("events", "event_id"), db.ApiKeyScopeGroupsRead),
+				"POST": auth(addAddress("events", "event_id"), db.ApiKeyScopeGroupsWrite, "Add an address with a unique label. region_id must be in country_id."),
+			},
+			"/event/{event_id}/address/{address_id}": {
+				"PUT":    auth(updAddress("events", "event_id"), db.ApiKeyScopeGroupsWrite),
+				"DELETE": auth(delAddress("events", "event_id"), db.ApiKeyScopeGroupsWrite),
+			},
+			"/persons/import": {
+				"POST": auth(importPersons, db.ApiKeyScopeMembersWrite, "Import persons from CSV, optionally inviting users (not with an API key) and adding them to a group. Previews unless commit=true."),
 			},
 		},
 	).Serve()
 }
 
+//purgeDeletedAccounts periodically purges accounts that were deleted longer than the grace period ago
+func purgeDeletedAccounts() {
+	for {
+		if err := db.PurgeDeletedAccounts(context.Background()); err != nil {
+			log.Errorf("failed to purge deleted accounts: %+v", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+//authOption changes what auth() allows
+type authOption string
+
+//notImpersonated forbids the handler for a sysadmin impersonating a user
+const notImpersonated authOption = "not_impersonated"
+
+//auth wraps a handler that requires a session or an API key
+//args are doc strings, the restricted session scopes (db.SessionScope) also allowed to call the handler,
+//the API key scope (db.ApiKeyScope) required to call the handler with an API key, and authOption values
+//handlers without an API key scope cannot be called with an API key
+//the handler gets the db.Session in the context, which has the impersonating sysadmin in Impersonator,
+//and all requests under impersonation are logged
 func auth(f api.ContextHandler, args ...interface{}) api.Handler {
+	allowedScopes := map[db.SessionScope]bool{db.SessionScopeFull: true}
+	var apiKeyScope *db.ApiKeyScope
+	allowImpersonation := true
+	for _, arg := range args {
+		if arg == notImpersonated {
+			allowImpersonation = false
+		}
+		if scope, ok := arg.(db.SessionScope); ok {
+			allowedScopes[scope] = true
+		}
+		if scope, ok := arg.(db.ApiKeyScope); ok {
+			apiKeyScope = &scope
+		}
+	}
 	return func(httpRes http.ResponseWriter, httpReq *http.Request) {
-		token := httpReq.Header.Get("X-Auth-Token")
-		session, err := db.GetSession(token)
+		var session *db.Session
+		var err error
+		if key := httpReq.Header.Get("X-Api-Key"); key != "" {
+			session, err = db.GetApiKeySession(key)
+			if err == nil && (apiKeyScope == nil || !session.ApiKey.HasScope(*apiKeyScope)) {
+				http.Error(httpRes, "forbidden: API key does not have the required scope", http.StatusForbidden)
+				return
+			}
+		} else {
+			session, err = db.GetSession(httpReq.Header.Get("X-Auth-Token"))
+		}
 		if err != nil {
 			log.Errorf("%+v", err)
 			http.Error(httpRes, fmt.Sprintf("unauthorized: %s", err), http.StatusUnauthorized)
 			return
 		}
-		ctx := context.Background()
+		if !allowedScopes[session.Scope] {
+			http.Error(httpRes, fmt.Sprintf("forbidden: session is restricted to %s", session.Scope), http.StatusForbidden)
+			return
+		}
+		if session.Impersonator != nil && !allowImpersonation {
+			logImpersonated(*session, httpReq, http.StatusForbidden)
+			http.Error(httpRes, "forbidden: not allowed while impersonating a user", http.StatusForbidden)
+			return
+		}
+		ctx := requestContext(httpRes, httpReq)
 		ctx = context.WithValue(ctx, db.Session{}, *session)
 		log.Debugf("HTTP %s %s %+v",
 			httpReq.Method,
@@ -104,6 +371,7 @@ func auth(f api.ContextHandler, args ...interface{}) api.Handler {
 
 		status, res := f(ctx, httpRes, httpReq)
 		log.Debugf("status=%d, res=(%T)%+v", status, res, res)
+		logImpersonated(*session, httpReq, status)
 
 		//error response
 		if res != nil {
@@ -124,6 +392,23 @@ func auth(f api.ContextHandler, args ...interface{}) api.Handler {
 	}
 } //auth()
 
+//requestContext returns a context with the request ID, from the X-Request-Id header
+//or a new ID, which is returned in the response header and recorded in the audit log
+func requestContext(httpRes http.ResponseWriter, httpReq *http.Request) context.Context {
+	requestID := httpReq.Header.Get("X-Request-Id")
+	if requestID == "" || len(requestID) > 64 {
+		requestID = uuid.New().String()
+	}
+	httpRes.Header().Set("X-Request-Id", requestID)
+	return db.WithRequestID(context.Background(), requestID)
+}
+
+func logImpersonated(session db.Session, httpReq *http.Request, status int) {
+	if err := db.AddImpersonationLog(session, httpReq.Method, httpReq.URL.Path, status); err != nil {
+		log.Errorf("%+v", err)
+	}
+}
+
 func register(httpRes http.ResponseWriter, httpReq *http.Request) {
 	var registerRequest db.RegisterRequest
 	if err := json.NewDecoder(httpReq.Body).Decode(&registerRequest); err != nil {
@@ -131,7 +416,7 @@ func register(httpRes http.ResponseWriter, httpReq *http.Request) {
 		return
 	}
 
-	session, err := db.Register(registerRequest)
+	session, err := db.Register(requestContext(httpRes, httpReq), registerRequest)
 	if err != nil {
 		http.Error(httpRes, err.Error(), http.StatusInternalServerError)
 		return
@@ -148,7 +433,7 @@ func activate(httpRes http.ResponseWriter, httpReq *http.Request) {
 		return
 	}
 
-	session, err := db.ActivateUser(activateRequest)
+	session, err := db.ActivateUser(requestContext(httpRes, httpReq), activateRequest)
 	if err != nil {
 		http.Error(httpRes, err.Error(), http.StatusInternalServerError)
 		return
@@ -157,14 +442,36 @@ func activate(httpRes http.ResponseWriter, httpReq *http.Request) {
 	json.NewEncoder(httpRes).Encode(*session)
 }
 
+func acceptInvitation(httpRes http.ResponseWriter, httpReq *http.Request) {
+	var req db.AcceptUserInvitationRequest
+	if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil {
+		http.Error(httpRes, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, err := db.AcceptUserInvitation(requestContext(httpRes, httpReq), req)
+	if err != nil {
+		http.Error(httpRes, err.Error(), http.StatusBadRequest)
+		return
+	}
+	httpRes.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(httpRes).Encode(*user)
+}
+
 func login(httpRes http.ResponseWriter, httpReq *http.Request) {
 	var loginRequest db.LoginRequest
 	if err := json.NewDecoder(httpReq.Body).Decode(&loginRequest); err != nil {
 		http.Error(httpRes, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	loginRequest.UserAgent = httpReq.UserAgent()
+	loginRequest.RemoteAddr = httpReq.RemoteAddr
 
 	session, err := db.Login(loginRequest)
+	if throttled, ok := err.(db.LoginThrottledError); ok {
+		httpRes.Header().Set("Retry-After", strconv.Itoa(int(throttled.Wait.Seconds())+1))
+		http.Error(httpRes, throttled.Error(), http.StatusTooManyRequests)
+		return
+	}
 	if err != nil {
 		http.Error(httpRes, err.Error(), http.StatusInternalServerError)
 		return
@@ -173,6 +480,124 @@ func login(httpRes http.ResponseWriter, httpReq *http.Request) {
 	json.NewEncoder(httpRes).Encode(*session)
 }
 
+//GET /login/{account_id}/{idp_name} redirects to login at the external provider
+func loginExternal(httpRes http.ResponseWriter, httpReq *http.Request) {
+	vars := mux.Vars(httpReq)
+	authURL, err := db.StartExternalLogin(vars["account_id"], vars["idp_name"])
+	if err != nil {
+		http.Error(httpRes, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Redirect(httpRes, httpReq, authURL, http.StatusFound)
+}
+
+//GET /login/callback?state=<state>&code=<code>
+func loginCallback(httpRes http.ResponseWriter, httpReq *http.Request) {
+	if errMsg := httpReq.URL.Query().Get("error"); errMsg != "" {
+		http.Error(httpRes, "external login failed: "+errMsg, http.StatusUnauthorized)
+		return
+	}
+	session, err := db.CompleteExternalLogin(db.ExternalLoginRequest{
+		State:      httpReq.URL.Query().Get("state"),
+		Code:       httpReq.URL.Query().Get("code"),
+		UserAgent:  httpReq.UserAgent(),
+		RemoteAddr: httpReq.RemoteAddr,
+	})
+	if err != nil {
+		http.Error(httpRes, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	httpRes.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(httpRes).Encode(*session)
+}
+
+func loginMFA(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	var req db.MFACodeRequest
+	if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
+	}
+	fullSession, err := db.CompleteMFALogin(session, req)
+	if throttled, ok := err.(db.LoginThrottledError); ok {
+		httpRes.Header().Set("Retry-After", strconv.Itoa(int(throttled.Wait.Seconds())+1))
+		return http.StatusTooManyRequests, throttled
+	}
+	if err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "MFA failed")
+	}
+	return http.StatusOK, fullSession
+}
+
+func enrolTOTP(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	enrolment, err := db.EnrolTOTP(session.User)
+	if err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to enrol")
+	}
+	return http.StatusOK, enrolment
+}
+
+func confirmTOTP(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	var req db.MFACodeRequest
+	if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
+	}
+	if err := db.ConfirmTOTP(session, req); err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to confirm")
+	}
+	return http.StatusNoContent, nil
+}
+
+func disableTOTP(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	var req db.MFACodeRequest
+	if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
+	}
+	if err := db.DisableTOTP(session.User, req); err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to disable")
+	}
+	return http.StatusNoContent, nil
+}
+
+func getAccountUsage(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	if err := db.Authorize(session.User, db.PermAccountManage, session.User.Account.ID, ""); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "only account admin can view usage")
+	}
+	usage, err := db.GetAccountUsage(session.User.Account.ID)
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrapf(err, "failed to get usage")
+	}
+	return http.StatusOK, usage
+}
+
+func getPlans(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	plans, err := db.GetPlans()
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrapf(err, "failed to get plans")
+	}
+	return http.StatusOK, plans
+}
+
+func updAccountMFA(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	if err := db.Authorize(session.User, db.PermAccountManage, session.User.Account.ID, ""); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "only account admin can change MFA requirements")
+	}
+	var req struct {
+		Required bool `json:"required"`
+	}
+	if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
+	}
+	if err := db.SetAccountMFARequired(ctx, session.User.Account.ID, req.Required); err != nil {
+		return http.StatusInternalServerError, errors.Wrapf(err, "failed to update account")
+	}
+	return http.StatusNoContent, nil
+}
+
 func logout(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
 	session := ctx.Value(db.Session{}).(db.Session)
 	if err := db.Logout(session.Token); err != nil {
@@ -181,15 +606,306 @@ func logout(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Requ
 	return http.StatusOK, nil
 }
 
+func getSessions(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	sessions, err := db.GetUserSessions(session.User.ID, session.ID)
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrapf(err, "failed to get sessions")
+	}
+	return http.StatusOK, sessions
+}
+
+func delSessions(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	if _, err := db.DelUserSessions(session.User.ID, session.ID); err != nil {
+		return http.StatusInternalServerError, errors.Wrapf(err, "failed to delete sessions")
+	}
+	return http.StatusNoContent, nil
+}
+
+func delSession(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	if err := db.DelUserSession(session.User.ID, mux.Vars(httpReq)["session_id"]); err != nil {
+		return http.StatusNotFound, errors.Wrapf(err, "failed to delete session")
+	}
+	return http.StatusNoContent, nil
+}
+
+func delUserSessions(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	user, err := userToManage(session.User, mux.Vars(httpReq)["user_id"])
+	if err != nil {
+		return http.StatusNotFound, errors.Wrapf(err, "cannot revoke user sessions")
+	}
+	nr, err := db.DelUserSessions(user.ID, "")
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrapf(err, "failed to delete sessions")
+	}
+	return http.StatusOK, struct {
+		Deleted int64 `json:"deleted"`
+	}{
+		Deleted: nr,
+	}
+}
+
+func unlockUser(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	user, err := userToManage(session.User, mux.Vars(httpReq)["user_id"])
+	if err != nil {
+		return http.StatusNotFound, errors.Wrapf(err, "cannot unlock users")
+	}
+	if err := db.UnlockUser(session.User, *user); err != nil {
+		return http.StatusInternalServerError, errors.Wrapf(err, "failed to unlock user")
+	}
+	return http.StatusNoContent, nil
+}
+
+func getLockouts(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	//sysadmin sees lockouts of all accounts
+	var accountID string
+	if db.Authorize(session.User, db.PermSystemManage, "", "") != nil {
+		if err := db.Authorize(session.User, db.PermAccountManage, session.User.Account.ID, ""); err != nil {
+			return http.StatusUnauthorized, errors.Wrapf(err, "only account admin can list lockouts")
+		}
+		accountID = session.User.Account.ID
+	}
+	lockouts, err := db.GetLoginLockouts(accountID, urlParamInt(httpReq, "limit", 1, 1000, 100))
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrapf(err, "failed to get lockouts")
+	}
+	return http.StatusOK, lockouts
+}
+
+func unlockIP(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	if err := db.Authorize(session.User, db.PermSystemManage, "", ""); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "only sysadmin can unlock client IPs")
+	}
+	if err := db.UnlockIP(session.User, mux.Vars(httpReq)["ip"]); err != nil {
+		return http.StatusNotFound, errors.Wrapf(err, "failed to unlock ip")
+	}
+	return http.StatusNoContent, nil
+}
+
+//userToManage gets a user that the session user may manage:
+//sysadmin can manage any user, others need users:manage in the user's account
+func userToManage(by db.User, userID string) (*db.User, error) {
+	user, err := db.GetUser("", userID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "user not found")
+	}
+	if user.Account == nil {
+		return nil, errors.Errorf("user not found")
+	}
+	if err := db.Authorize(by, db.PermUsersManage, user.Account.ID, ""); err != nil {
+		return nil, errors.Errorf("user not found")
+	}
+	return user, nil
+}
+
+func impersonateUser(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	impersonatedSession, err := db.Impersonate(session, mux.Vars(httpReq)["user_id"])
+	if err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "cannot impersonate")
+	}
+	return http.StatusOK, impersonatedSession
+}
+
+func getAudit(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	filter := db.AuditFilter{}
+	if db.Authorize(session.User, db.PermSystemManage, "", "") == nil {
+		if aid := httpReq.URL.Query().Get("account_id"); aid != "" {
+			filter.AccountID = &aid
+		}
+	} else {
+		if err := db.Authorize(session.User, db.PermAccountManage, session.User.Account.ID, ""); err != nil {
+			return http.StatusUnauthorized, errors.Wrapf(err, "only account admin can list changes")
+		}
+		filter.AccountID = &session.User.Account.ID
+	}
+	for param, value := range map[string]**string{
+		"table":      &filter.Table,
+		"id":         &filter.ID,
+		"user_id":    &filter.UserID,
+		"request_id": &filter.RequestID,
+	} {
+		if v := httpReq.URL.Query().Get(param); v != "" {
+			*value = &v
+		}
+	}
+	for param, value := range map[string]**time.Time{
+		"from": &filter.From,
+		"to":   &filter.To,
+	} {
+		if v := httpReq.URL.Query().Get(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				if t, err = time.ParseInLocation("2006-01-02", v, time.Local); err != nil {
+					return http.StatusBadRequest, errors.Errorf("%s=\"%s\" is not a date or RFC3339 time", param, v)
+				}
+			}
+			*value = &t
+		}
+	}
+	list, err := db.GetAudit(filter, urlParamInt(httpReq, "limit", 1, 1000, 100))
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrapf(err, "failed to get audit records")
+	}
+	return http.StatusOK, list
+}
+
+func getImpersonations(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	if err := db.Authorize(session.User, db.PermSystemManage, "", ""); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "only sysadmin can list impersonations")
+	}
+	list, err := db.GetImpersonationLog(httpReq.URL.Query().Get("user_id"), urlParamInt(httpReq, "limit", 1, 1000, 100))
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrapf(err, "failed to get impersonation log")
+	}
+	return http.StatusOK, list
+}
+
+func getUserRoles(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	user, err := userToManage(session.User, mux.Vars(httpReq)["user_id"])
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	return http.StatusOK, user.Roles
+}
+
+func addUserRole(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	user, err := userToManage(session.User, mux.Vars(httpReq)["user_id"])
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	var ra db.RoleAssignment
+	if err := json.NewDecoder(httpReq.Body).Decode(&ra); err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
+	}
+	if err := db.AddUserRole(ctx, session.User, *user, ra); err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to add role")
+	}
+	return http.StatusNoContent, nil
+}
+
+func delUserRole(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	user, err := userToManage(session.User, mux.Vars(httpReq)["user_id"])
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	if err := db.DelUserRole(ctx, session.User, *user, db.Role(mux.Vars(httpReq)["role"]), httpReq.URL.Query().Get("group_id")); err != nil {
+		return http.StatusNotFound, errors.Wrapf(err, "failed to delete role")
+	}
+	return http.StatusNoContent, nil
+}
+
+func getApiKeys(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	if err := db.Authorize(session.User, db.PermAccountManage, session.User.Account.ID, ""); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "only account admin can list API keys")
+	}
+	keys, err := db.GetApiKeys(session.User.Account.ID)
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrapf(err, "failed to get API keys")
+	}
+	return http.StatusOK, keys
+}
+
+func addApiKey(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	var newKey db.NewApiKey
+	if err := json.NewDecoder(httpReq.Body).Decode(&newKey); err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
+	}
+	key, secret, err := db.AddApiKey(session.User, newKey)
+	if err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to add API key")
+	}
+	return http.StatusOK, struct {
+		db.ApiKey
+		Key string `json:"key"`
+	}{
+		ApiKey: *key,
+		Key:    secret,
+	}
+}
+
+func delApiKey(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	if err := db.Authorize(session.User, db.PermAccountManage, session.User.Account.ID, ""); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "only account admin can revoke API keys")
+	}
+	if err := db.RevokeApiKey(session.User.Account.ID, mux.Vars(httpReq)["apikey_id"]); err != nil {
+		return http.StatusNotFound, errors.Wrapf(err, "failed to revoke API key")
+	}
+	return http.StatusNoContent, nil
+}
+
+func getIdentityProviders(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	providers, err := db.GetIdentityProviders(session.User.Account.ID)
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrapf(err, "failed to get identity providers")
+	}
+	return http.StatusOK, providers
+}
+
+func addIdentityProvider(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	var newProvider db.NewIdentityProvider
+	if err := json.NewDecoder(httpReq.Body).Decode(&newProvider); err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
+	}
+	provider, err := db.AddIdentityProvider(session.User, newProvider)
+	if err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to add identity provider")
+	}
+	return http.StatusOK, provider
+}
+
+func delIdentityProvider(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	if err := db.Authorize(session.User, db.PermAccountManage, session.User.Account.ID, ""); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "only account admin can remove identity providers")
+	}
+	if err := db.DelIdentityProvider(session.User.Account.ID, mux.Vars(httpReq)["idp_id"]); err != nil {
+		return http.StatusNotFound, errors.Wrapf(err, "failed to remove identity provider")
+	}
+	return http.StatusNoContent, nil
+}
+
+func linkIdentity(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	authURL, err := db.LinkExternalIdentity(session.User, mux.Vars(httpReq)["idp_name"])
+	if err != nil {
+		return http.StatusNotFound, errors.Wrapf(err, "failed to link external identity")
+	}
+	return http.StatusOK, struct {
+		URL string `json:"url" doc:"Open in the browser to login at the provider"`
+	}{
+		URL: authURL,
+	}
+}
+
 func getUsers(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
 	session := ctx.Value(db.Session{}).(db.Session)
 	filter := map[string]interface{}{}
-	if session.User.Account.Admin {
+	if db.Authorize(session.User, db.PermSystemManage, "", "") == nil {
 		//only filter on account_id if specified in params
 		if param_account_id := httpReq.URL.Query().Get("account_id"); param_account_id != "" {
 			filter["account_id"] = param_account_id
 		}
 	} else {
+		if err := db.Authorize(session.User, db.PermUsersRead, session.User.Account.ID, ""); err != nil {
+			return http.StatusUnauthorized, errors.Wrapf(err, "cannot list users")
+		}
 		filter["account_id"] = session.User.Account.ID
 	}
 	users, err := db.GetUsers(
@@ -209,8 +925,8 @@ func addUser(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Req
 	if session.User.Account.Admin {
 		return http.StatusUnauthorized, errors.Errorf("system admin cannot create account users")
 	}
-	if !session.User.Admin {
-		return http.StatusUnauthorized, errors.Errorf("you are not account admin and therefore cannot add users to this account")
+	if err := db.Authorize(session.User, db.PermUsersManage, session.User.Account.ID, ""); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "you cannot add users to this account")
 	}
 	var newUser db.NewUser
 	if err := json.NewDecoder(httpReq.Body).Decode(&newUser); err != nil {
@@ -218,6 +934,7 @@ func addUser(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Req
 	}
 
 	addedUser, err := db.AddUser(
+		ctx,
 		db.NewUser{
 			Account:  session.User.Account,
 			Username: newUser.Username,
@@ -225,18 +942,74 @@ func addUser(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Req
 			Admin:    false,
 			Active:   true,
 			Expiry:   nil,
+			//admin chose the password, so user must change it on first login
+			MustChangePassword: true,
 		},
 	)
+	if quota, ok := err.(db.QuotaExceededError); ok {
+		return http.StatusForbidden, quota
+	}
 	if err != nil {
 		return http.StatusInternalServerError, errors.Wrapf(err, "failed to add user")
 	}
 	return http.StatusOK, addedUser
 }
 
+func getUserInvitations(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	if err := db.Authorize(session.User, db.PermUsersManage, session.User.Account.ID, ""); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "only account admin can list invitations")
+	}
+	invitations, err := db.GetUserInvitations(session.User.Account.ID, urlParamInt(httpReq, "limit", 1, 100, 10))
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrapf(err, "failed to get invitations")
+	}
+	return http.StatusOK, invitations
+}
+
+func inviteUser(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	if err := db.Authorize(session.User, db.PermUsersManage, session.User.Account.ID, ""); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "only account admin can invite users")
+	}
+	var req db.NewUserInvitation
+	if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
+	}
+	invitation, err := db.InviteUser(ctx, session.User, req)
+	if quota, ok := err.(db.QuotaExceededError); ok {
+		return http.StatusForbidden, quota
+	}
+	if err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to invite user")
+	}
+	return http.StatusOK, invitation
+}
+
+func resendUserInvitation(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	invitation, err := db.ResendUserInvitation(ctx, session.User, mux.Vars(httpReq)["invitation_id"])
+	if err != nil {
+		return http.StatusNotFound, errors.Wrapf(err, "failed to resend invitation")
+	}
+	return http.StatusOK, invitation
+}
+
+func revokeUserInvitation(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	if err := db.RevokeUserInvitation(ctx, session.User, mux.Vars(httpReq)["invitation_id"]); err != nil {
+		return http.StatusNotFound, errors.Wrapf(err, "failed to revoke invitation")
+	}
+	return http.StatusNoContent, nil
+}
+
 func getUser(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
 	session := ctx.Value(db.Session{}).(db.Session)
 	var accountID string
-	if !session.User.Account.Admin {
+	if db.Authorize(session.User, db.PermSystemManage, "", "") != nil {
+		if err := db.Authorize(session.User, db.PermUsersRead, session.User.Account.ID, ""); err != nil {
+			return http.StatusUnauthorized, errors.Wrapf(err, "cannot get users")
+		}
 		accountID = session.User.Account.ID
 	}
 	vars := mux.Vars(httpReq)
@@ -248,27 +1021,76 @@ func getUser(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Req
 }
 
 func updUser(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
-	//session := ctx.Value(db.Session{}).(db.Session)
-	return http.StatusInternalServerError, errors.Errorf("NYI")
+	session := ctx.Value(db.Session{}).(db.Session)
+	var req db.UpdUserRequest
+	if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
+	}
+	user, err := db.UpdUser(ctx, session.User, mux.Vars(httpReq)["user_id"], req)
+	if err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to update user")
+	}
+	return http.StatusOK, user
 }
 
+//DELETE /user/{user_id}?anonymise=true
 func delUser(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
-	//session := ctx.Value(db.Session{}).(db.Session)
-	return http.StatusInternalServerError, errors.Errorf("NYI")
+	session := ctx.Value(db.Session{}).(db.Session)
+	anonymised, err := db.DelUser(ctx, session.User, mux.Vars(httpReq)["user_id"], getBoolParam(httpReq.URL.Query().Get("anonymise"), false))
+	if err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to delete user")
+	}
+	return http.StatusOK, struct {
+		Anonymised bool `json:"anonymised" doc:"User was anonymised instead of deleted, to keep messages intact"`
+	}{
+		Anonymised: anonymised,
+	}
 }
 
 func updUserPassword(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
-	//session := ctx.Value(db.Session{}).(db.Session)
+	session := ctx.Value(db.Session{}).(db.Session)
 	pathVars := mux.Vars(httpReq)
 	userID := pathVars["user_id"]
-	newPassword := httpReq.URL.Query().Get("new_password")
-	log.Debugf("Change(%s,%s)", userID, newPassword)
-	if err := db.ChangePassword(userID, newPassword); err != nil {
-		return http.StatusInternalServerError, errors.Wrapf(err, "failed to change password")
+	if userID != session.User.ID {
+		return http.StatusForbidden, errors.Errorf("you can only change your own password")
+	}
+	var req db.ChangePasswordRequest
+	if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
+	}
+	log.Debugf("Change(%s)", userID)
+	if err := db.ChangePassword(ctx, userID, req); err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to change password")
 	}
 	return http.StatusOK, nil
 }
 
+//POST /password/forgot always succeeds so that callers cannot tell which usernames exist
+func forgotPassword(httpRes http.ResponseWriter, httpReq *http.Request) {
+	var req db.ForgotPasswordRequest
+	if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil {
+		http.Error(httpRes, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := db.ForgotPassword(req); err != nil {
+		log.Errorf("forgot password failed: %+v", err)
+	}
+	httpRes.WriteHeader(http.StatusAccepted)
+}
+
+func resetPassword(httpRes http.ResponseWriter, httpReq *http.Request) {
+	var req db.ResetPasswordRequest
+	if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil {
+		http.Error(httpRes, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := db.ResetPassword(requestContext(httpRes, httpReq), req); err != nil {
+		http.Error(httpRes, err.Error(), http.StatusBadRequest)
+		return
+	}
+	httpRes.WriteHeader(http.StatusNoContent)
+}
+
 func sendMessage(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
 	session := ctx.Value(db.Session{}).(db.Session)
 
@@ -293,6 +1115,12 @@ func sendMessage(ctx context.Context, httpRes http.ResponseWriter, httpReq *http
 		toUser,
 		body.Message,
 	)
+	if quota, ok := err.(db.QuotaExceededError); ok {
+		return http.StatusForbidden, quota
+	}
+	if consent, ok := err.(db.ConsentRequiredError); ok {
+		return http.StatusAccepted, consent.Consent
+	}
 	if err != nil {
 		return http.StatusInternalServerError, errors.Wrapf(err, "failed to send")
 	}
@@ -331,7 +1159,7 @@ func getAccounts(ctx context.Context, httpRes http.ResponseWriter, httpReq *http
 		filter.Name = &n
 		log.Debugf("filter.Name=%s", *filter.Name)
 	}
-	if !session.User.Account.Admin {
+	if db.Authorize(session.User, db.PermSystemManage, "", "") != nil {
 		filter.ID = &session.User.Account.ID //if not sys admin: can only see own account
 		falseValue := false
 		filter.Admin = &falseValue //not for others to see system account
@@ -349,18 +1177,17 @@ func getAccounts(ctx context.Context, httpRes http.ResponseWriter, httpReq *http
 }
 
 //add a new account which returns the account admin user with the account details and the admin
-//user password which should be changed on first login
-//(todo: password must be marked as expired in user account to force reset before login)
+//user's temporary password which only allows the admin to login and change it
 func addAccount(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
 	session := ctx.Value(db.Session{}).(db.Session)
-	if !session.User.Admin || !session.User.Account.Admin {
-		return http.StatusUnauthorized, errors.Errorf("accounts can only be created by system admin users")
+	if err := db.Authorize(session.User, db.PermSystemManage, "", ""); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "accounts can only be created by system admin users")
 	}
 	var newAccount db.NewAccount
 	if err := json.NewDecoder(httpReq.Body).Decode(&newAccount); err != nil {
 		return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
 	}
-	accountAdminUser, adminPassword, err := db.AddAccount(newAccount)
+	accountAdminUser, adminPassword, err := db.AddAccount(ctx, newAccount)
 	if err != nil {
 		return http.StatusInternalServerError, errors.Wrapf(err, "failed to add account")
 	}
@@ -386,8 +1213,8 @@ func getAccount(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.
 		accountID = session.User.Account.ID //default to own account if not specified
 	}
 
-	if !session.User.Account.Admin {
-		if accountID != session.User.Account.ID {
+	if accountID != session.User.Account.ID {
+		if err := db.Authorize(session.User, db.PermSystemManage, "", ""); err != nil {
 			return http.StatusUnauthorized, errors.Errorf("not your account")
 		}
 	}
@@ -402,18 +1229,50 @@ func getAccount(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.
 }
 
 func updAccount(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
-	return http.StatusInternalServerError, errors.Errorf("NYI")
+	session := ctx.Value(db.Session{}).(db.Session)
+	if err := db.Authorize(session.User, db.PermSystemManage, "", ""); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "only sysadmin can update accounts")
+	}
+	var req db.UpdAccountRequest
+	if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
+	}
+	account, err := db.UpdAccount(ctx, session.User, mux.Vars(httpReq)["account_id"], req)
+	if err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to update account")
+	}
+	return http.StatusOK, account
 }
 
 func delAccount(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
-	return http.StatusInternalServerError, errors.Errorf("NYI")
+	session := ctx.Value(db.Session{}).(db.Session)
+	if err := db.Authorize(session.User, db.PermSystemManage, "", ""); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "only sysadmin can delete accounts")
+	}
+	deletion, err := db.DelAccount(ctx, session.User, mux.Vars(httpReq)["account_id"], httpReq.URL.Query().Get("dry_run") == "true")
+	if err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to delete account")
+	}
+	return http.StatusOK, deletion
+}
+
+func restoreAccount(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	if err := db.Authorize(session.User, db.PermSystemManage, "", ""); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "only sysadmin can restore accounts")
+	}
+	account, err := db.RestoreAccount(ctx, session.User, mux.Vars(httpReq)["account_id"])
+	if err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to restore account")
+	}
+	return http.StatusOK, account
 }
 
 func getGroups(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
 	session := ctx.Value(db.Session{}).(db.Session)
 	filter := db.GroupsFilter{}
 
-	if session.User.Account.Admin {
+	if db.Authorize(session.User, db.PermSystemManage, "", "") == nil {
 		//sysadmin
 		if aid := httpReq.URL.Query().Get("account_id"); aid != "" {
 			filter.AccountID = &aid
@@ -421,6 +1280,11 @@ func getGroups(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.R
 	} else {
 		//not sysadmin: see only own account
 		filter.AccountID = &session.User.Account.ID
+		//invitations to create sub-groups are only for those who can accept them
+		if db.Authorize(session.User, db.PermGroupsManage, session.User.Account.ID, "") != nil {
+			invitation := false
+			filter.Invitation = &invitation
+		}
 	}
 
 	if n := httpReq.URL.Query().Get("name"); n != "" {
@@ -440,37 +1304,80 @@ func getGroups(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.R
 func addGroup(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
 	session := ctx.Value(db.Session{}).(db.Session)
 
-	//todo: check if account is allowed to create more groups (limit nr of groups)
-	if !session.User.Admin {
-		return http.StatusUnauthorized, errors.Errorf("only account admin user can create groups")
-	}
-
 	var newGroup db.NewGroup
 	if err := json.NewDecoder(httpReq.Body).Decode(&newGroup); err != nil {
 		return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
 	}
-	g, err := db.AddGroup(session.User, newGroup)
+	parentGroupID := ""
+	if newGroup.ParentGroupID != nil {
+		parentGroupID = *newGroup.ParentGroupID
+	}
+	if err := db.Authorize(session.User, db.PermGroupsManage, session.User.Account.ID, parentGroupID); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "you cannot create groups")
+	}
+	g, err := db.AddGroup(ctx, session.User, newGroup)
+	if quota, ok := err.(db.QuotaExceededError); ok {
+		return http.StatusForbidden, quota
+	}
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrapf(err, "failed to add group")
+	}
+	return http.StatusOK, g
+}
+
+func getGroup(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	groupID := strings.TrimSpace(mux.Vars(httpReq)["group_id"])
+	if groupID == "" {
+		return http.StatusBadRequest, errors.Errorf("expecting /group/<group_id> in URL")
+	}
+
+	log.Debugf("getGroup(%s)", groupID)
+	g, err := db.GetGroup(groupID)
+	if err != nil {
+		log.Errorf("getGroup(%s): %+v", groupID, err)
+		return http.StatusNotFound, errors.Wrapf(err, "group not found")
+	}
+	if g.Invitation != nil && *g.Invitation &&
+		db.Authorize(session.User, db.PermGroupsManage, g.Account.ID, "") != nil &&
+		(g.Parent == nil || db.Authorize(session.User, db.PermGroupsManage, g.Parent.Account.ID, g.Parent.ID) != nil) {
+		return http.StatusNotFound, errors.Errorf("group not found")
+	}
+	return http.StatusOK, g
+} //getGroup()
+
+func getGroupInvitations(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	invitations, err := db.GetGroupInvitations(session.User)
+	if err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "cannot get group invitations")
+	}
+	return http.StatusOK, invitations
+}
+
+func acceptGroupInvitation(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	var req db.AcceptGroupInvitationRequest
+	if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
+	}
+	g, err := db.AcceptGroupInvitation(ctx, session.User, mux.Vars(httpReq)["group_id"], req)
+	if quota, ok := err.(db.QuotaExceededError); ok {
+		return http.StatusForbidden, quota
+	}
 	if err != nil {
-		return http.StatusInternalServerError, errors.Wrapf(err, "failed to add group")
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to accept group invitation")
 	}
 	return http.StatusOK, g
 }
 
-func getGroup(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
-	//session := ctx.Value(db.Session{}).(db.Session)
-	groupID := strings.TrimSpace(mux.Vars(httpReq)["group_id"])
-	if groupID == "" {
-		return http.StatusBadRequest, errors.Errorf("expecting /group/<group_id> in URL")
-	}
-
-	log.Debugf("getGroup(%s)", groupID)
-	g, err := db.GetGroup(groupID)
-	if err != nil {
-		log.Errorf("getGroup(%s): %+v", groupID, err)
-		return http.StatusNotFound, errors.Wrapf(err, "group not found")
+func declineGroupInvitation(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	if err := db.DeclineGroupInvitation(ctx, session.User, mux.Vars(httpReq)["group_id"]); err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to decline group invitation")
 	}
-	return http.StatusOK, g
-} //getGroup()
+	return http.StatusOK, nil
+}
 
 func updGroup(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
 	session := ctx.Value(db.Session{}).(db.Session)
@@ -478,15 +1385,12 @@ func updGroup(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Re
 	if groupID == "" {
 		return http.StatusBadRequest, errors.Errorf("expecting /group/<group_id> in URL")
 	}
-	if !session.User.Admin {
-		return http.StatusUnauthorized, errors.Errorf("only account admin user can change groups")
-	}
 	group, err := db.GetGroup(groupID)
 	if err != nil {
 		return http.StatusNotFound, nil
 	}
-	if group.Account.ID != session.User.Account.ID {
-		return http.StatusUnauthorized, errors.Errorf("group does not belong to your account")
+	if err := db.Authorize(session.User, db.PermGroupsManage, group.Account.ID, group.ID); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "you cannot change this group")
 	}
 
 	var changes db.Group
@@ -510,7 +1414,7 @@ func updGroup(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Re
 	group.Data = changes.Data
 
 	//apply the changes
-	if err := db.UpdGroup(session.User, *group); err != nil {
+	if err := db.UpdGroup(ctx, session.User, *group); err != nil {
 		return http.StatusMethodNotAllowed, errors.Wrapf(err, "failed to update group")
 	}
 
@@ -528,10 +1432,7 @@ func delGroup(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Re
 	if groupID == "" {
 		return http.StatusBadRequest, errors.Errorf("expecting /group/<group_id> in URL")
 	}
-	if !session.User.Admin {
-		return http.StatusUnauthorized, errors.Errorf("only account admin user can delete a group")
-	}
-	if err := db.DelGroup(session.User, groupID); err != nil {
+	if err := db.DelGroup(ctx, session.User, groupID); err != nil {
 		return http.StatusMethodNotAllowed, errors.Wrapf(err, "group not deleted")
 	}
 	return http.StatusNoContent, nil
@@ -560,15 +1461,12 @@ func updGroupFields(ctx context.Context, httpRes http.ResponseWriter, httpReq *h
 	if groupID == "" {
 		return http.StatusBadRequest, errors.Errorf("expecting /group/<group_id> in URL")
 	}
-	if !session.User.Admin {
-		return http.StatusUnauthorized, errors.Errorf("only account admin user can change groups")
-	}
 	group, err := db.GetGroup(groupID)
 	if err != nil {
 		return http.StatusNotFound, nil
 	}
-	if group.Account.ID != session.User.Account.ID {
-		return http.StatusUnauthorized, errors.Errorf("group does not belong to your account")
+	if err := db.Authorize(session.User, db.PermGroupsManage, group.Account.ID, group.ID); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "you cannot change this group")
 	}
 
 	var changes db.Group
@@ -593,7 +1491,7 @@ func updGroupFields(ctx context.Context, httpRes http.ResponseWriter, httpReq *h
 	// group.Data = changes.Data
 
 	// //apply the changes
-	// if err := db.UpdGroup(session.User, *group); err != nil {
+	// if err := db.UpdGroup(ctx, session.User, *group); err != nil {
 	// 	return http.StatusMethodNotAllowed, errors.Wrapf(err, "failed to update group")
 	// }
 
@@ -611,8 +1509,12 @@ func delGroupFields(ctx context.Context, httpRes http.ResponseWriter, httpReq *h
 	if groupID == "" {
 		return http.StatusBadRequest, errors.Errorf("expecting /group/<group_id> in URL")
 	}
-	if !session.User.Admin {
-		return http.StatusUnauthorized, errors.Errorf("only account admin user can delete a group")
+	group, err := db.GetGroup(groupID)
+	if err != nil {
+		return http.StatusNotFound, nil
+	}
+	if err := db.Authorize(session.User, db.PermGroupsManage, group.Account.ID, group.ID); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "you cannot change this group")
 	}
 	return http.StatusInternalServerError, errors.Errorf("NYI")
 
@@ -631,9 +1533,8 @@ func getGroupMembers(ctx context.Context, httpRes http.ResponseWriter, httpReq *
 		return http.StatusNotFound, errors.Errorf("group(%s) not found", mux.Vars(httpReq)["group_id"])
 	}
 
-	//can only see your own group members
-	if !session.User.Account.Admin && group.Account.ID != session.User.Account.ID {
-		return http.StatusUnauthorized, errors.Errorf("group(%s) belongs to another account - you cannot see the members", group.ID)
+	if err := db.Authorize(session.User, db.PermMembersRead, group.Account.ID, group.ID); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "you cannot see the members of group(%s)", group.ID)
 	}
 	members, err := db.GetGroupMembers(
 		group.ID,
@@ -656,9 +1557,8 @@ func addGroupMember(ctx context.Context, httpRes http.ResponseWriter, httpReq *h
 	}
 	log.Debugf("group: %+v", group)
 
-	//can only see your own group members
-	if !session.User.Account.Admin && group.Account.ID != session.User.Account.ID {
-		return http.StatusUnauthorized, errors.Errorf("group(%s) belongs to another account - you cannot see the members", group.ID)
+	if err := db.Authorize(session.User, db.PermMembersManage, group.Account.ID, group.ID); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "you cannot add members to group(%s)", group.ID)
 	}
 
 	//see what is being added
@@ -674,6 +1574,9 @@ func addGroupMember(ctx context.Context, httpRes http.ResponseWriter, httpReq *h
 		group.ID,
 		newMember.Type,
 		newMember.ID)
+	if quota, ok := err.(db.QuotaExceededError); ok {
+		return http.StatusForbidden, quota
+	}
 	if err != nil {
 		return http.StatusInternalServerError, errors.Wrapf(err, "failed to add as group member")
 	}
@@ -702,7 +1605,7 @@ func delGroupMember(ctx context.Context, httpRes http.ResponseWriter, httpReq *h
 }
 
 func urlParamInt(httpReq *http.Request, paramName string, min, max, def int) int {
-	i := 10
+	i := def
 	if s := httpReq.URL.Query().Get(paramName); s != "" {
 		if i64, err := strconv.ParseInt(s, 10, 64); err == nil {
 			i = int(i64)
@@ -719,24 +1622,67 @@ func urlParamInt(httpReq *http.Request, paramName string, min, max, def int) int
 
 func getPersons(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
 	session := ctx.Value(db.Session{}).(db.Session)
-	if !session.User.Account.Admin {
-		return http.StatusUnauthorized, nil
+	query := httpReq.URL.Query()
+	filter := db.PersonsFilter{}
+	for param, value := range map[string]**string{
+		"name":        &filter.Name,
+		"surname":     &filter.Surname,
+		"email":       &filter.Email,
+		"phone":       &filter.Phone,
+		"national_id": &filter.NationalID,
+		"group_id":    &filter.GroupID,
+		"q":           &filter.Query,
+	} {
+		if v := query.Get(param); v != "" {
+			*value = &v
+		}
+	}
+	for param, value := range map[string]**db.SqlDate{
+		"dob_from": &filter.DobFrom,
+		"dob_to":   &filter.DobTo,
+	} {
+		if v := query.Get(param); v != "" {
+			t, err := time.ParseInLocation("2006-01-02", v, time.UTC)
+			if err != nil {
+				return http.StatusBadRequest, errors.Errorf("%s=%s is not CCYY-MM-DD", param, v)
+			}
+			d := db.SqlDate(t)
+			*value = &d
+		}
+	}
+	if v := query.Get("gender"); v != "" {
+		var g db.SqlGender
+		if err := g.Scan([]byte(v)); err != nil || g == db.SqlGenderUndefined {
+			return http.StatusBadRequest, errors.Errorf("gender=%s is not male|female", v)
+		}
+		filter.Gender = &g
 	}
 
-	//sysadmin only for now (other users can get access to users they know the ID of, e.g. family members or people who entered an event)
-	filter := db.PersonsFilter{}
-	if n := httpReq.URL.Query().Get("name"); n != "" {
-		filter.Name = &n
+	//sysadmin can search all persons, others only the members of groups they can read
+	if err := db.Authorize(session.User, db.PermSystemManage, "", ""); err != nil {
+		if filter.GroupID == nil {
+			return http.StatusUnauthorized, errors.Errorf("specify group_id to search members of your group")
+		}
+		group, err := db.GetGroup(*filter.GroupID)
+		if err != nil {
+			return http.StatusNotFound, errors.Errorf("group(%s) not found", *filter.GroupID)
+		}
+		if err := db.Authorize(session.User, db.PermMembersRead, group.Account.ID, group.ID); err != nil {
+			return http.StatusUnauthorized, errors.Wrapf(err, "you cannot read members of group(%s)", group.ID)
+		}
 	}
-	if n := httpReq.URL.Query().Get("surname"); n != "" {
-		filter.Surname = &n
+
+	sort := []string{"surname", "name"}
+	if v := query.Get("sort"); v != "" {
+		sort = strings.Split(v, ",")
 	}
 	persons, err := db.GetPersons(
 		filter,
-		[]string{"surname", "name"},
+		sort,
+		urlParamInt(httpReq, "offset", 0, 1000000, 0),
 		urlParamInt(httpReq, "limit", 1, 100, 10))
 	if err != nil {
-		return http.StatusInternalServerError, errors.Wrapf(err, "failed to get persons")
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to get persons")
 	}
 	return http.StatusOK, persons
 }
@@ -752,3 +1698,448 @@ func getBoolParam(v string, d bool) bool {
 	}
 	return d
 }
+
+func getFamily(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	household, err := db.GetHousehold(session.User)
+	if err != nil {
+		return http.StatusNotFound, errors.Wrapf(err, "failed to get household")
+	}
+	return http.StatusOK, household
+}
+
+func addFamilyMember(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	var req db.AddFamilyMemberRequest
+	if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
+	}
+	person, err := db.AddFamilyMember(ctx, session.User, req)
+	if pending, ok := err.(db.FamilyRequestPendingError); ok {
+		return http.StatusAccepted, pending.Request
+	}
+	if err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to add family member")
+	}
+	return http.StatusOK, person
+}
+
+func getFamilyRequests(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	requestStatus := db.ConsentStatus(httpReq.URL.Query().Get("status"))
+	if requestStatus == "" {
+		requestStatus = db.ConsentPending
+	}
+	requests, err := db.GetFamilyRequests(session.User, requestStatus)
+	if err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to get family requests")
+	}
+	return http.StatusOK, requests
+}
+
+//decideFamilyRequest makes a handler to approve or decline a family request
+func decideFamilyRequest(approve bool) api.ContextHandler {
+	return func(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+		session := ctx.Value(db.Session{}).(db.Session)
+		request, err := db.DecideFamilyRequest(ctx, session.User, mux.Vars(httpReq)["request_id"], approve)
+		if err != nil {
+			return http.StatusBadRequest, errors.Wrapf(err, "failed to decide family request")
+		}
+		return http.StatusOK, request
+	}
+}
+
+func joinGroup(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	var req struct {
+		PersonID string `json:"person_id,omitempty" doc:"Yourself if not specified"`
+	}
+	if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil && err != io.EOF {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
+	}
+	person, err := db.JoinGroup(ctx, session.User, mux.Vars(httpReq)["group_id"], req.PersonID)
+	if quota, ok := err.(db.QuotaExceededError); ok {
+		return http.StatusForbidden, quota
+	}
+	if consent, ok := err.(db.ConsentRequiredError); ok {
+		return http.StatusAccepted, consent.Consent
+	}
+	if err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to join group")
+	}
+	return http.StatusOK, person
+}
+
+func getConsents(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	consentStatus := db.ConsentStatus(httpReq.URL.Query().Get("status"))
+	if consentStatus == "" {
+		consentStatus = db.ConsentPending
+	}
+	consents, err := db.GetConsents(session.User, consentStatus)
+	if err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to get consents")
+	}
+	return http.StatusOK, consents
+}
+
+//decideConsent makes a handler to approve or decline a consent request
+func decideConsent(approve bool) api.ContextHandler {
+	return func(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+		session := ctx.Value(db.Session{}).(db.Session)
+		var req struct {
+			Note string `json:"note,omitempty"`
+		}
+		if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil && err != io.EOF {
+			return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
+		}
+		consent, err := db.DecideConsent(ctx, session.User, mux.Vars(httpReq)["consent_id"], approve, req.Note)
+		if quota, ok := err.(db.QuotaExceededError); ok {
+			return http.StatusForbidden, quota
+		}
+		if err != nil {
+			return http.StatusBadRequest, errors.Wrapf(err, "failed to decide consent")
+		}
+		return http.StatusOK, consent
+	}
+}
+
+func applyToGroup(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	var req db.GroupApplicationRequest
+	if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
+	}
+	application, err := db.ApplyToGroup(ctx, session.User, mux.Vars(httpReq)["group_id"], req)
+	if quota, ok := err.(db.QuotaExceededError); ok {
+		return http.StatusForbidden, quota
+	}
+	if consent, ok := err.(db.ConsentRequiredError); ok {
+		return http.StatusAccepted, consent.Consent
+	}
+	if err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to apply to group")
+	}
+	return http.StatusOK, application
+}
+
+func getGroupApplications(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	applicationStatus := db.GroupApplicationStatus(httpReq.URL.Query().Get("status"))
+	if applicationStatus == "" {
+		applicationStatus = db.GroupApplicationPending
+	}
+	applications, err := db.GetGroupApplications(session.User, mux.Vars(httpReq)["group_id"], applicationStatus)
+	if err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to get group applications")
+	}
+	return http.StatusOK, applications
+}
+
+//reviewGroupApplication makes a handler to accept or reject an application
+func reviewGroupApplication(accept bool) api.ContextHandler {
+	return func(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+		session := ctx.Value(db.Session{}).(db.Session)
+		var req struct {
+			Reason string `json:"reason,omitempty"`
+		}
+		if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil && err != io.EOF {
+			return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
+		}
+		vars := mux.Vars(httpReq)
+		application, err := db.ReviewGroupApplication(ctx, session.User, vars["group_id"], vars["person_id"], accept, req.Reason)
+		if quota, ok := err.(db.QuotaExceededError); ok {
+			return http.StatusForbidden, quota
+		}
+		if err != nil {
+			return http.StatusBadRequest, errors.Wrapf(err, "failed to review group application")
+		}
+		return http.StatusOK, application
+	}
+}
+
+func importPersons(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	var req db.ImportRequest
+	if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
+	}
+	//API keys have no scope to manage users, and their sessions act as account admin
+	if req.CreateUsers && session.ApiKey != nil {
+		return http.StatusForbidden, errors.Errorf("API keys cannot create users, login to import with create_users")
+	}
+	report, err := db.Import(ctx, session.User, req)
+	if err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to import")
+	}
+	return http.StatusOK, report
+}
+
+func getCountries(httpRes http.ResponseWriter, httpReq *http.Request) {
+	countries, err := db.GetCountries(httpReq.URL.Query().Get("name"))
+	if err != nil {
+		http.Error(httpRes, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	httpRes.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(httpRes).Encode(countries)
+}
+
+func getCountryRegions(httpRes http.ResponseWriter, httpReq *http.Request) {
+	countryID := mux.Vars(httpReq)["country_id"]
+	if _, err := db.GetCountryByID(countryID); err != nil {
+		http.Error(httpRes, fmt.Sprintf("country(%s) not found", countryID), http.StatusNotFound)
+		return
+	}
+	regions, err := db.CountryRegions(countryID, httpReq.URL.Query().Get("name"))
+	if err != nil {
+		http.Error(httpRes, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	httpRes.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(httpRes).Encode(regions)
+}
+
+func getCountry(httpRes http.ResponseWriter, httpReq *http.Request) {
+	country, err := db.GetCountryByID(mux.Vars(httpReq)["country_id"])
+	if err != nil {
+		http.Error(httpRes, err.Error(), http.StatusNotFound)
+		return
+	}
+	httpRes.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(httpRes).Encode(country)
+}
+
+func getRegion(httpRes http.ResponseWriter, httpReq *http.Request) {
+	region, err := db.GetRegion(mux.Vars(httpReq)["region_id"])
+	if err != nil {
+		http.Error(httpRes, err.Error(), http.StatusNotFound)
+		return
+	}
+	httpRes.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(httpRes).Encode(region)
+}
+
+func addCountry(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	if err := db.Authorize(session.User, db.PermSystemManage, "", ""); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "only sysadmin can add countries")
+	}
+	var req db.NewCountry
+	if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
+	}
+	country, err := db.AddCountry(ctx, session.User, req)
+	if err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to add country")
+	}
+	return http.StatusOK, country
+}
+
+func updCountry(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	if err := db.Authorize(session.User, db.PermSystemManage, "", ""); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "only sysadmin can update countries")
+	}
+	var req db.UpdCountryRequest
+	if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
+	}
+	country, err := db.UpdCountry(ctx, session.User, mux.Vars(httpReq)["country_id"], req)
+	if err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to update country")
+	}
+	return http.StatusOK, country
+}
+
+func delCountry(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	if err := db.Authorize(session.User, db.PermSystemManage, "", ""); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "only sysadmin can delete countries")
+	}
+	if err := db.DelCountry(ctx, session.User, mux.Vars(httpReq)["country_id"]); err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to delete country")
+	}
+	return http.StatusOK, nil
+}
+
+func loadISO3166(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	if err := db.Authorize(session.User, db.PermSystemManage, "", ""); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "only sysadmin can load countries")
+	}
+	load, err := db.LoadISO3166(ctx, session.User)
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrapf(err, "failed to load ISO 3166")
+	}
+	return http.StatusOK, load
+}
+
+func addRegion(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	if err := db.Authorize(session.User, db.PermSystemManage, "", ""); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "only sysadmin can add regions")
+	}
+	var req db.NewRegion
+	if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
+	}
+	region, err := db.AddRegion(ctx, session.User, mux.Vars(httpReq)["country_id"], req)
+	if err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to add region")
+	}
+	return http.StatusOK, region
+}
+
+func updRegion(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	if err := db.Authorize(session.User, db.PermSystemManage, "", ""); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "only sysadmin can update regions")
+	}
+	var req db.NewRegion
+	if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
+	}
+	region, err := db.UpdRegion(ctx, session.User, mux.Vars(httpReq)["region_id"], req)
+	if err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to update region")
+	}
+	return http.StatusOK, region
+}
+
+func delRegion(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	if err := db.Authorize(session.User, db.PermSystemManage, "", ""); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "only sysadmin can delete regions")
+	}
+	if err := db.DelRegion(ctx, session.User, mux.Vars(httpReq)["region_id"]); err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to delete region")
+	}
+	return http.StatusOK, nil
+}
+
+func exportPerson(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	export, err := db.ExportPerson(ctx, session.User, mux.Vars(httpReq)["person_id"])
+	if err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "cannot export person")
+	}
+	httpRes.Header().Set("Content-Disposition", "attachment; filename=\"person-"+export.Person.ID+".json\"")
+	return http.StatusOK, export
+}
+
+func requestPersonErasure(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	var req struct {
+		Reason string `json:"reason,omitempty"`
+	}
+	if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil && err != io.EOF {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
+	}
+	erasure, err := db.RequestPersonErasure(ctx, session.User, mux.Vars(httpReq)["person_id"], req.Reason)
+	if err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to request erasure")
+	}
+	return http.StatusOK, erasure
+}
+
+func getPersonErasures(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	erasureStatus := db.PersonErasureStatus(httpReq.URL.Query().Get("status"))
+	if erasureStatus == "" {
+		erasureStatus = db.PersonErasureRequested
+	}
+	erasures, err := db.GetPersonErasures(session.User, erasureStatus)
+	if err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "cannot get erasure requests")
+	}
+	return http.StatusOK, erasures
+}
+
+func completePersonErasure(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	if err := db.Authorize(session.User, db.PermSystemManage, "", ""); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "only sysadmin can process erasure requests")
+	}
+	var req struct {
+		Note string `json:"note,omitempty"`
+	}
+	if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil && err != io.EOF {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
+	}
+	erasure, err := db.CompletePersonErasure(ctx, session.User, mux.Vars(httpReq)["erasure_id"], req.Note)
+	if err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to erase person")
+	}
+	return http.StatusOK, erasure
+}
+
+func rejectPersonErasure(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+	session := ctx.Value(db.Session{}).(db.Session)
+	if err := db.Authorize(session.User, db.PermSystemManage, "", ""); err != nil {
+		return http.StatusUnauthorized, errors.Wrapf(err, "only sysadmin can process erasure requests")
+	}
+	var req struct {
+		Note string `json:"note"`
+	}
+	if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
+	}
+	erasure, err := db.RejectPersonErasure(ctx, session.User, mux.Vars(httpReq)["erasure_id"], req.Note)
+	if err != nil {
+		return http.StatusBadRequest, errors.Wrapf(err, "failed to reject erasure")
+	}
+	return http.StatusOK, erasure
+}
+
+//getAddresses makes a handler for addresses of a person, group or event identified by the url var
+func getAddresses(tableName string, idVar string) api.ContextHandler {
+	return func(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+		session := ctx.Value(db.Session{}).(db.Session)
+		addresses, err := db.GetAddresses(session.User, tableName, mux.Vars(httpReq)[idVar])
+		if err != nil {
+			return http.StatusUnauthorized, errors.Wrapf(err, "cannot get addresses")
+		}
+		return http.StatusOK, addresses
+	}
+}
+
+func addAddress(tableName string, idVar string) api.ContextHandler {
+	return func(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+		session := ctx.Value(db.Session{}).(db.Session)
+		var req db.NewAddress
+		if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil {
+			return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
+		}
+		address, err := db.AddAddress(ctx, session.User, tableName, mux.Vars(httpReq)[idVar], req)
+		if err != nil {
+			return http.StatusBadRequest, errors.Wrapf(err, "failed to add address")
+		}
+		return http.StatusOK, address
+	}
+}
+
+func updAddress(tableName string, idVar string) api.ContextHandler {
+	return func(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+		session := ctx.Value(db.Session{}).(db.Session)
+		var req db.NewAddress
+		if err := json.NewDecoder(httpReq.Body).Decode(&req); err != nil {
+			return http.StatusBadRequest, errors.Wrapf(err, "failed to decode body")
+		}
+		address, err := db.UpdAddress(ctx, session.User, tableName, mux.Vars(httpReq)[idVar], mux.Vars(httpReq)["address_id"], req)
+		if err != nil {
+			return http.StatusBadRequest, errors.Wrapf(err, "failed to update address")
+		}
+		return http.StatusOK, address
+	}
+}
+
+func delAddress(tableName string, idVar string) api.ContextHandler {
+	return func(ctx context.Context, httpRes http.ResponseWriter, httpReq *http.Request) (status int, res interface{}) {
+		session := ctx.Value(db.Session{}).(db.Session)
+		if err := db.DelAddress(ctx, session.User, tableName, mux.Vars(httpReq)[idVar], mux.Vars(httpReq)["address_id"]); err != nil {
+			return http.StatusBadRequest, errors.Wrapf(err, "failed to delete address")
+		}
+		return http.StatusOK, nil
+	}
+}
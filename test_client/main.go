@@ -43,13 +43,16 @@ func main() {
 
 	//now work with new test account
 	//first need to change admin password
-	//acc admin login should fail on temp password
+	//acc admin login on temp password only gives a session to change the password
 	Post(addr+"/login", "", map[string]interface{}{"username": testAccAdminUser.Username, "password": tempPassword}, 200, &loginResp)
 	log.Debugf("ACC Admin Login: %+v", loginResp)
+	if loginResp.Scope != db.SessionScopeChangePassword {
+		panic(errors.Errorf("login with temp password gave session scope \"%s\"", loginResp.Scope))
+	}
 	t = loginResp.Token
 
-	//acc admin create more acc users
-	Post(addr+"/users", t, map[string]interface{}{"username": "one", "password": "one", "account_id": testAccAdminUser.Account.ID}, 200, nil)
+	//acc admin cannot create more acc users before changing the password
+	Post(addr+"/users", t, map[string]interface{}{"username": "one", "password": "one", "account_id": testAccAdminUser.Account.ID}, 403, nil)
 
 	//acc admin logout
 	Post(addr+"/logout", t, nil, 200, nil)